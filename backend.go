@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	/* Values of the 'backend' config property */
+	smartKeyBackendName = "smartkey"
+	localBackendName    = "local"
+)
+
+/*Backend performs the cryptographic operations behind the KMS gRPC service, so SmartKey can be swapped for another implementation. */
+type Backend interface {
+	/* Encrypt returns the cipher for the given plain data. */
+	Encrypt(ctx context.Context, plain []byte) ([]byte, error)
+	/* Decrypt returns the plain data for a cipher produced by Encrypt. */
+	Decrypt(ctx context.Context, cipher []byte) ([]byte, error)
+	/* Health returns an error when the backend cannot serve requests. */
+	Health(ctx context.Context) error
+	/* KeyInfo returns the metadata of the key used by the backend. */
+	KeyInfo(ctx context.Context) (*KeyObject, error)
+}
+
+/*newBackend creates the Backend selected by the 'backend' config property, SmartKey by default. With secondaryConfigFile, DEKs are also wrapped by the backend of that config file; with escrowFile, Decrypt is answered from escrowed DEKs. */
+func newBackend(config map[string]string, allowInsecure bool) (Backend, error) {
+	var backend Backend
+	var err error
+	switch config["backend"] {
+	case "", smartKeyBackendName:
+		backend, err = newSmartKeyBackend(config)
+	case localBackendName:
+		if !allowInsecure {
+			return nil, errors.New("local backend is insecure and must be enabled with the -insecureLocalBackend flag")
+		}
+		log.Println("WARNING: using insecure local key file backend", config["localKeyFile"], "- do not use in production")
+		backend, err = newLocalBackendFromConfig(config)
+	default:
+		return nil, errors.New("unknown backend " + config["backend"])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if secondaryConfigFile, isPresent := config["secondaryConfigFile"]; isPresent {
+		secondary, err := newSecondaryBackend(secondaryConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		backend = &dualBackend{primary: backend, secondary: secondary}
+	}
+	if _, isPresent := config["escrowFile"]; isPresent {
+		escrow, err := newEscrowBackend(backend, config)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("WARNING: recovery mode, Decrypt is answered from the", len(escrow.deks), "DEKs of escrow file", config["escrowFile"])
+		backend = escrow
+	}
+	return backend, nil
+}
+
+/* smartKeyBackendOf returns the SmartKey backend encrypting new data, unwrapping dual and recovery mode backends. */
+func smartKeyBackendOf(backend Backend) (*smartKeyBackend, bool) {
+	switch b := backend.(type) {
+	case *smartKeyBackend:
+		return b, true
+	case *dualBackend:
+		return smartKeyBackendOf(b.primary)
+	case *escrowBackend:
+		return smartKeyBackendOf(b.backend)
+	}
+	return nil, false
+}
+
+/* newLocalBackendFromConfig creates a local backend from the localKeyFile and iv config properties. */
+func newLocalBackendFromConfig(config map[string]string) (Backend, error) {
+	key, err := readLocalKeyFile(config["localKeyFile"])
+	if err != nil {
+		return nil, err
+	}
+	/* The AES cipher keeps its own expanded copy of the key */
+	defer zeroBytes(key)
+	iv, err := base64.StdEncoding.DecodeString(config["iv"])
+	if err != nil {
+		return nil, errors.New("invalid iv: " + err.Error())
+	}
+	return newLocalBackend(key, iv)
+}
+
+/*smartKeyBackend is a Backend calling SmartKey REST APIs. */
+type smartKeyBackend struct {
+	config      map[string]string
+	rateLimiter *smartKeyRateLimiter
+	/* encrypts and decrypts group concurrent calls into SmartKey batch requests, nil when batching is disabled */
+	encrypts *batcher
+	decrypts *batcher
+	/* keys holds the primary key and previous keys when a state file is configured, ciphers then carry their key id */
+	keys *keyRing
+	/* trustedKids are keys added to the ring when a cipher uses them, rotationPrefix is the name prefix of keys created by the rotation of other instances, empty without rotation */
+	trustedKids    map[string]bool
+	rotationPrefix string
+}
+
+/*newSmartKeyBackend creates a Backend for the SmartKey account and key defined in config. */
+func newSmartKeyBackend(config map[string]string) (*smartKeyBackend, error) {
+	rateLimiter, err := newSmartKeyRateLimiter(config)
+	if err != nil {
+		return nil, err
+	}
+	batchWindow, batchSize, err := parseBatchConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedKids, err := parseTrustedKeyIDs(config)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &smartKeyBackend{config: config, rateLimiter: rateLimiter, trustedKids: trustedKids}
+	if _, isPresent := config["keyRotationInterval"]; isPresent {
+		b.rotationPrefix = defaultKeyRotationNamePrefix
+		if namePrefix, isPresent := config["keyRotationNamePrefix"]; isPresent {
+			b.rotationPrefix = namePrefix
+		}
+	}
+	if stateFile, isPresent := config["stateFile"]; isPresent {
+		macKey, err := stateFileMacKey(config)
+		if err != nil {
+			return nil, err
+		}
+		if b.keys, err = loadKeyRing(stateFile, macKey, previousStateFileMacKey(config), config["encryptionKeyUuid"], time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if batchWindow > 0 {
+		b.encrypts = newBatcher("encrypt", batchWindow, batchSize, b.batchEncrypt)
+		b.decrypts = newBatcher("decrypt", batchWindow, batchSize, b.batchDecrypt)
+	}
+	return b, nil
+}
+
+/* primaryKid returns the id of the key encrypting new data. */
+func (b *smartKeyBackend) primaryKid() string {
+	if b.keys == nil {
+		return b.config["encryptionKeyUuid"]
+	}
+	return b.keys.primary().Kid
+}
+
+/* sealCipher adds the key id to a cipher when the key ring is enabled. */
+func (b *smartKeyBackend) sealCipher(kid string, cipher []byte) []byte {
+	if b.keys == nil {
+		return cipher
+	}
+	return formatKeyCipher(kid, cipher)
+}
+
+/* openCipher returns the key id and SmartKey cipher of a cipher returned by Encrypt. Ciphers only carry a key id with the key ring, ciphers without key id were encrypted with the legacy key of the ring or encryptionKeyUuid. */
+func (b *smartKeyBackend) openCipher(ctx context.Context, data []byte) (string, []byte, error) {
+	if b.keys == nil {
+		return b.config["encryptionKeyUuid"], data, nil
+	}
+	kid, cipher, ok := parseKeyCipher(data)
+	if !ok {
+		return b.keys.legacyKid(), data, nil
+	}
+	if err := b.checkRingKey(ctx, kid); err != nil {
+		return "", nil, err
+	}
+	return kid, cipher, nil
+}
+
+/* knownKid returns the key of a cipher without calling SmartKey, false when the cipher carries a key which is not in the ring. */
+func (b *smartKeyBackend) knownKid(data []byte) (string, bool) {
+	if b.keys == nil {
+		return b.config["encryptionKeyUuid"], true
+	}
+	kid, _, ok := parseKeyCipher(data)
+	if !ok {
+		return b.keys.legacyKid(), true
+	}
+	return kid, b.keys.has(kid)
+}
+
+/* checkRingKey accepts the key of a cipher when it is in the ring. Other keys are added to the ring when they are listed in trustedKeyIds, or with rotation when their SmartKey name has the rotation prefix and they permit DECRYPT, as they were then created by the rotation of another instance. */
+func (b *smartKeyBackend) checkRingKey(ctx context.Context, kid string) error {
+	if b.keys.has(kid) {
+		return nil
+	}
+	record := keyRecord{Kid: kid, Created: time.Now()}
+	if !b.trustedKids[kid] {
+		if len(b.rotationPrefix) == 0 {
+			return errors.New("cipher was encrypted with key " + kid + " which is not in the key ring, add it to 'trustedKeyIds' if it is trusted")
+		}
+		key, err := getKeyByID(ctx, b.config, kid)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(key.Name, b.rotationPrefix+"-") {
+			return errors.New("cipher was encrypted with key " + kid + " which is neither in the key ring nor a rotated key, add it to 'trustedKeyIds' if it is trusted")
+		}
+		if err := checkDecryptCapabilities(key); err != nil {
+			return errors.New("cipher was encrypted with key " + kid + " which cannot decrypt: " + err.Error())
+		}
+		record.Name = key.Name
+	}
+	if err := b.keys.add(record); err != nil {
+		return errors.New("unable to record key " + kid + ": " + err.Error())
+	}
+	log.Println("Key", kid, "of another plugin instance is added to the key ring")
+	return nil
+}
+
+/* recordUse records in the state file that a key encrypted or decrypted data, a failure to save is only logged. */
+func (b *smartKeyBackend) recordUse(kid string) {
+	if b.keys == nil {
+		return
+	}
+	if err := b.keys.recordUse(kid, time.Now()); err != nil {
+		log.Println("WARNING: Unable to record the use of key", kid+":", err)
+	}
+}
+
+/* batchEncrypt encrypts a batch with the primary key through the rate limiter, a batch carries the requests of several callers so it is not bound to a request context. */
+func (b *smartKeyBackend) batchEncrypt(plains [][]byte) ([][]byte, []error, error) {
+	ctx := context.Background()
+	kid := b.primaryKid()
+	var ciphers [][]byte
+	var errs []error
+	err := b.rateLimiter.call(ctx, "encrypt", func() error {
+		var err error
+		ciphers, errs, err = batchEncrypt(ctx, b.config, kid, plains)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range ciphers {
+		if errs[i] == nil {
+			ciphers[i] = b.sealCipher(kid, ciphers[i])
+		}
+	}
+	b.recordUse(kid)
+	return ciphers, errs, nil
+}
+
+/* batchDecrypt decrypts a batch, each cipher with its own key, through the rate limiter. */
+func (b *smartKeyBackend) batchDecrypt(data [][]byte) ([][]byte, []error, error) {
+	ctx := context.Background()
+	plains := make([][]byte, len(data))
+	errs := make([]error, len(data))
+
+	/* Ciphers of unknown keys are not sent, indexes maps the batch items to the ciphers */
+	var kids []string
+	var ciphers [][]byte
+	var indexes []int
+	for i := range data {
+		kid, cipher, err := b.openCipher(ctx, data[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		kids = append(kids, kid)
+		ciphers = append(ciphers, cipher)
+		indexes = append(indexes, i)
+	}
+	if len(indexes) == 0 {
+		return plains, errs, nil
+	}
+
+	var batchPlains [][]byte
+	var batchErrs []error
+	err := b.rateLimiter.call(ctx, "decrypt", func() error {
+		var err error
+		batchPlains, batchErrs, err = batchDecrypt(ctx, b.config, kids, ciphers)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for j, i := range indexes {
+		plains[i], errs[i] = batchPlains[j], batchErrs[j]
+		if errs[i] == nil {
+			b.recordUse(kids[j])
+		}
+	}
+	return plains, errs, nil
+}
+
+/*Encrypt encrypts plain data using the primary SmartKey key. */
+func (b *smartKeyBackend) Encrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	if b.encrypts != nil {
+		return b.encrypts.do(ctx, plain)
+	}
+	kid := b.primaryKid()
+	var cipher []byte
+	err := b.rateLimiter.call(ctx, "encrypt", func() error {
+		var err error
+		cipher, err = encryptWithKey(ctx, b.config, kid, plain)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.recordUse(kid)
+	return b.sealCipher(kid, cipher), nil
+}
+
+/*Decrypt decrypts cipher using the SmartKey key which encrypted it. */
+func (b *smartKeyBackend) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	if b.decrypts != nil {
+		return b.decrypts.do(ctx, data)
+	}
+	kid, cipher, err := b.openCipher(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	var plain []byte
+	err = b.rateLimiter.call(ctx, "decrypt", func() error {
+		var err error
+		plain, err = decryptWithKey(ctx, b.config, kid, cipher)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.recordUse(kid)
+	return plain, nil
+}
+
+/*Health checks that the SmartKey API key can still authenticate. */
+func (b *smartKeyBackend) Health(ctx context.Context) error {
+	_, err := auth(ctx, b.config)
+	return err
+}
+
+/*KeyInfo fetches the security object of the primary key from SmartKey. */
+func (b *smartKeyBackend) KeyInfo(ctx context.Context) (*KeyObject, error) {
+	return getKeyByID(ctx, b.config, b.primaryKid())
+}
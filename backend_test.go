@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"golang.org/x/net/context"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+func newTestSmartKeyConfig() map[string]string {
+	config := make(map[string]string)
+	config["smartkeyURL"] = "https://www.smartkey.io"
+	config["encryptionKeyUuid"] = "uuid1"
+	config["smartkeyApiKey"] = "api_key"
+	return config
+}
+
+func newTestSmartKeyBackend(t *testing.T, config map[string]string) *smartKeyBackend {
+	backend, err := newSmartKeyBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestSmartKeyBackend_Health(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/sys/v1/session/auth",
+		httpmock.NewStringResponder(200, `{"expires_in": 0,"access_token": "","entity_id": ""}`))
+
+	backend := newTestSmartKeyBackend(t, newTestSmartKeyConfig())
+	if err := backend.Health(nil); err != nil {
+		t.Error(err)
+	}
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/sys/v1/session/auth",
+		httpmock.NewStringResponder(401, `{}`))
+
+	if err := backend.Health(nil); err == nil {
+		t.Error("Test case should fail as authentication is rejected")
+	}
+}
+
+func TestSmartKeyBackend_KeyInfo(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "https://www.smartkey.io/crypto/v1/keys/uuid1",
+		httpmock.NewStringResponder(200, `{"key_size": 256, "obj_type": "AES"}`))
+
+	key, err := newTestSmartKeyBackend(t, newTestSmartKeyConfig()).KeyInfo(nil)
+	if err != nil || key.KeySize != 256 || key.ObjType != "AES" {
+		t.Error("Invalid key info")
+	}
+}
+
+func TestSmartKeyBackend_EncryptDecrypt(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/encrypt",
+		httpmock.NewStringResponder(200, `{"kid": "1", "cipher": "Y2lwaGVy", "iv":"iv"}`))
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/decrypt",
+		httpmock.NewStringResponder(200, `{"kid": "1", "plain": "cGxhaW4=", "iv":"iv"}`))
+
+	backend := newTestSmartKeyBackend(t, newTestSmartKeyConfig())
+
+	cipher, err := backend.Encrypt(nil, []byte("plain"))
+	if err != nil || string(cipher) != "Y2lwaGVy" {
+		t.Error("Encryption test case failed")
+	}
+
+	plain, err := backend.Decrypt(nil, cipher)
+	if err != nil || string(plain) != "plain" {
+		t.Error("Decryption test case failed")
+	}
+}
+
+func TestNewBackend_LocalRequiresInsecureFlag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "local.key")
+	if err := generateLocalKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	config := make(map[string]string)
+	config["backend"] = "local"
+	config["localKeyFile"] = keyFile
+	config["iv"] = "rFvgbU6EygpLUObqFZxITg=="
+
+	if _, err := newBackend(config, false); err == nil {
+		t.Error("Test case should fail as local backend is not explicitly enabled")
+	}
+
+	backend, err := newBackend(config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.(*localBackend); !ok {
+		t.Error("Local backend expected")
+	}
+}
+
+func TestNewBackend_Negative_UnknownBackend(t *testing.T) {
+	config := make(map[string]string)
+	config["backend"] = "unknown"
+
+	if _, err := newBackend(config, true); err == nil {
+		t.Error("Test case should fail as backend is unknown")
+	}
+}
+
+func TestSmartKeyBackend_StateFile(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	smartkey.AddKey("uuid-2", 256)
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	legacy, err := newTestSmartKeyBackend(t, config).Encrypt(nil, []byte("legacy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config["stateFile"] = filepath.Join(dir, "state.json")
+	backend := newTestSmartKeyBackend(t, config)
+	before, err := backend.Encrypt(nil, []byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := backend.keys.primary(); record.FirstUsed == nil || record.LastUsed == nil {
+		t.Error("Use of the key should be recorded", record)
+	}
+
+	/* After encryptionKeyUuid changes, older ciphers resolve through the state file */
+	config["encryptionKeyUuid"] = "uuid-2"
+	backend = newTestSmartKeyBackend(t, config)
+	for cipher, plain := range map[string]string{string(legacy): "legacy", string(before): "before"} {
+		decrypted, err := backend.Decrypt(nil, []byte(cipher))
+		if err != nil || string(decrypted) != plain {
+			t.Errorf("%q should decrypt after encryptionKeyUuid changed: %v", plain, err)
+		}
+	}
+	if after, err := backend.Encrypt(nil, []byte("after")); err != nil || !strings.HasPrefix(string(after), "smartkey:uuid-2:") {
+		t.Error("New data should be encrypted with the new encryptionKeyUuid", string(after), err)
+	}
+
+	config["smartkeyApiKey"] = "other-api-key"
+	if _, err := newSmartKeyBackend(config); err == nil {
+		t.Error("Test case should fail as the state file is signed with another key")
+	}
+}
+
+func TestSmartKeyBackend_Negative_UnknownKeyID(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	smartkey.AddKey("uuid-2", 256)
+	smartkey.UpdateKey("uuid-2", func(key *smartkeytest.Key) { key.Name = "other" })
+	cipher, err := encryptWithKey(context.Background(), config, "uuid-2", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := formatKeyCipher("uuid-2", cipher)
+
+	/* Without key ring the key id is not trusted */
+	if _, err := newTestSmartKeyBackend(t, config).Decrypt(nil, data); err == nil {
+		t.Error("Test case should fail as ciphers carry no key id without state file")
+	}
+
+	config["stateFile"] = filepath.Join(dir, "state.json")
+	backend := newTestSmartKeyBackend(t, config)
+	if _, err := backend.Decrypt(nil, data); err == nil || !strings.Contains(err.Error(), "not in the key ring") {
+		t.Error("Test case should fail as the key is not in the ring, got", err)
+	}
+	if backend.keys.has("uuid-2") {
+		t.Error("Rejected key should not be added to the ring")
+	}
+
+	/* Rotated keys of other instances are recognised by their name */
+	config["keyRotationInterval"] = "2160h"
+	backend = newTestSmartKeyBackend(t, config)
+	if _, err := backend.Decrypt(nil, data); err == nil || !strings.Contains(err.Error(), "rotated key") {
+		t.Error("Test case should fail as the key is not a rotated key, got", err)
+	}
+	smartkey.UpdateKey("uuid-2", func(key *smartkeytest.Key) { key.Name = "kubernetes-kms-2024Q1" })
+	if plain, err := backend.Decrypt(nil, data); err != nil || string(plain) != "secret" {
+		t.Error("Rotated key of another instance should be accepted", err)
+	}
+	if !backend.keys.has("uuid-2") || backend.primaryKid() != "uuid-1" {
+		t.Error("Rotated key should be added to the ring without becoming primary", backend.keys.keys())
+	}
+
+	/* Or listed in trustedKeyIds */
+	os.Remove(config["stateFile"])
+	delete(config, "keyRotationInterval")
+	config["trustedKeyIds"] = "uuid-3, uuid-2"
+	backend = newTestSmartKeyBackend(t, config)
+	if plain, err := backend.Decrypt(nil, data); err != nil || string(plain) != "secret" || !backend.keys.has("uuid-2") {
+		t.Error("Trusted key should be accepted", err)
+	}
+	config["trustedKeyIds"] = "uuid-2,../sys"
+	if _, err := newSmartKeyBackend(config); err == nil {
+		t.Error("Test case should fail as a trusted key id is invalid")
+	}
+}
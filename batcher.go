@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/status"
+)
+
+/* Largest batch sent to SmartKey when smartkeyBatchSize is not configured */
+const defaultBatchSize = 100
+
+/* batcherMetrics exposes the number of batches and of batched items of each operation on /debug/vars */
+var batcherMetrics = expvar.NewMap("smartkey_batcher")
+
+/*batchCall is an item waiting in a batch, done is closed once output or err is set. */
+type batchCall struct {
+	input  []byte
+	output []byte
+	err    error
+	done   chan struct{}
+}
+
+/*batcher groups the calls received during a short window into one batch, sent when the window ends or the batch is full. */
+type batcher struct {
+	name    string
+	window  time.Duration
+	maxSize int
+	/* run performs a batch, returning an output or an error per input, or an error for the whole batch */
+	run func(inputs [][]byte) ([][]byte, []error, error)
+
+	mutex   sync.Mutex
+	pending []*batchCall
+	timer   *time.Timer
+}
+
+func newBatcher(name string, window time.Duration, maxSize int, run func(inputs [][]byte) ([][]byte, []error, error)) *batcher {
+	return &batcher{name: name, window: window, maxSize: maxSize, run: run}
+}
+
+/* do adds input to the current batch and waits for its result. The batch is not cancelled with ctx, the caller only stops waiting. */
+func (b *batcher) do(ctx context.Context, input []byte) ([]byte, error) {
+	call := &batchCall{input: input, done: make(chan struct{})}
+
+	b.mutex.Lock()
+	b.pending = append(b.pending, call)
+	if len(b.pending) >= b.maxSize {
+		batch := b.takePending()
+		b.mutex.Unlock()
+		go b.flush(batch)
+	} else {
+		if len(b.pending) == 1 {
+			b.timer = time.AfterFunc(b.window, b.flushPending)
+		}
+		b.mutex.Unlock()
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case <-call.done:
+		return call.output, call.err
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+/* takePending removes the current batch, must be called with the lock held. */
+func (b *batcher) takePending() []*batchCall {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+/* flushPending sends the current batch when its window ends. */
+func (b *batcher) flushPending() {
+	b.mutex.Lock()
+	batch := b.takePending()
+	b.mutex.Unlock()
+	b.flush(batch)
+}
+
+/* flush runs a batch and hands each result to its caller. */
+func (b *batcher) flush(batch []*batchCall) {
+	if len(batch) == 0 {
+		return
+	}
+	batcherMetrics.Add(b.name+"_batches", 1)
+	batcherMetrics.Add(b.name+"_items", int64(len(batch)))
+
+	inputs := make([][]byte, len(batch))
+	for i, call := range batch {
+		inputs[i] = call.input
+	}
+	outputs, errs, err := b.run(inputs)
+	if err == nil && (len(outputs) != len(batch) || len(errs) != len(batch)) {
+		err = errors.New("batch returned " + strconv.Itoa(len(outputs)) + " results for " + strconv.Itoa(len(batch)) + " items")
+	}
+
+	for i, call := range batch {
+		if err != nil {
+			call.err = err
+		} else {
+			call.output, call.err = outputs[i], errs[i]
+		}
+		close(call.done)
+	}
+}
+
+/* parseBatchConfig reads the optional smartkeyBatchWindow (eg. "5ms") and smartkeyBatchSize config properties. Batching is disabled when the window is not set. */
+func parseBatchConfig(config map[string]string) (time.Duration, int, error) {
+	value, isPresent := config["smartkeyBatchWindow"]
+	if !isPresent {
+		return 0, 0, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, 0, errors.New("property 'smartkeyBatchWindow' must be a positive duration, eg. 5ms")
+	}
+
+	size := defaultBatchSize
+	if value, isPresent := config["smartkeyBatchSize"]; isPresent {
+		size, err = strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return 0, 0, errors.New("property 'smartkeyBatchSize' must be a positive integer")
+		}
+	}
+	return window, size, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+/* reverseBatch reverses each input, failing inputs equal to "fail". */
+func reverseBatch(calls *int, mutex *sync.Mutex) func(inputs [][]byte) ([][]byte, []error, error) {
+	return func(inputs [][]byte) ([][]byte, []error, error) {
+		mutex.Lock()
+		*calls++
+		mutex.Unlock()
+		outputs := make([][]byte, len(inputs))
+		errs := make([]error, len(inputs))
+		for i, input := range inputs {
+			if string(input) == "fail" {
+				errs[i] = errors.New("item failed")
+				continue
+			}
+			for j := range input {
+				outputs[i] = append(outputs[i], input[len(input)-1-j])
+			}
+		}
+		return outputs, errs, nil
+	}
+}
+
+func TestBatcher_Positive_GroupsConcurrentCalls(t *testing.T) {
+	var calls int
+	var mutex sync.Mutex
+	b := newBatcher("test", 50*time.Millisecond, 100, reverseBatch(&calls, &mutex))
+
+	var wg sync.WaitGroup
+	for _, input := range []string{"abc", "de", "fail", "f"} {
+		wg.Add(1)
+		go func(input string) {
+			defer wg.Done()
+			output, err := b.do(context.Background(), []byte(input))
+			switch {
+			case input == "fail" && err == nil:
+				t.Error("Item error should be returned to its caller")
+			case input != "fail" && (err != nil || len(output) != len(input) || output[0] != input[len(input)-1]):
+				t.Error("Unexpected result", input, string(output), err)
+			}
+		}(input)
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Error("Concurrent calls should be sent in one batch, got", calls)
+	}
+}
+
+func TestBatcher_Positive_MaxSize(t *testing.T) {
+	var calls int
+	var mutex sync.Mutex
+	b := newBatcher("test", time.Hour, 2, reverseBatch(&calls, &mutex))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := b.do(context.Background(), []byte("ab")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 2 {
+		t.Error("Full batches should be sent without waiting for the window, got", calls)
+	}
+}
+
+func TestBatcher_Negative_BatchError(t *testing.T) {
+	b := newBatcher("test", time.Millisecond, 10, func(inputs [][]byte) ([][]byte, []error, error) {
+		return nil, nil, errors.New("SmartKey unavailable")
+	})
+	if _, err := b.do(context.Background(), []byte("a")); err == nil || err.Error() != "SmartKey unavailable" {
+		t.Error("Batch error should be returned to every caller, got", err)
+	}
+
+	b = newBatcher("test", time.Millisecond, 10, func(inputs [][]byte) ([][]byte, []error, error) {
+		return [][]byte{}, []error{}, nil
+	})
+	if _, err := b.do(context.Background(), []byte("a")); err == nil {
+		t.Error("Missing results should fail")
+	}
+}
+
+func TestBatcher_Negative_ContextCancelled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	b := newBatcher("test", time.Millisecond, 10, func(inputs [][]byte) ([][]byte, []error, error) {
+		<-release
+		return inputs, make([]error, len(inputs)), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := b.do(ctx, []byte("a")); status.Code(err) != codes.DeadlineExceeded {
+		t.Error("Caller should stop waiting at its deadline, got", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.do(cancelled, []byte("b")); status.Code(err) != codes.Canceled {
+		t.Error("Cancelled caller should get Canceled, got", err)
+	}
+}
+
+func TestParseBatchConfig(t *testing.T) {
+	if window, _, err := parseBatchConfig(map[string]string{}); err != nil || window != 0 {
+		t.Error("Batching should be disabled by default")
+	}
+	window, size, err := parseBatchConfig(map[string]string{"smartkeyBatchWindow": "5ms"})
+	if err != nil || window != 5*time.Millisecond || size != defaultBatchSize {
+		t.Error("Invalid batch config", window, size, err)
+	}
+	for _, config := range []map[string]string{
+		{"smartkeyBatchWindow": "soon"},
+		{"smartkeyBatchWindow": "0s"},
+		{"smartkeyBatchWindow": "5ms", "smartkeyBatchSize": "0"},
+	} {
+		if _, _, err := parseBatchConfig(config); err == nil {
+			t.Error("Test case should fail for", config)
+		}
+	}
+}
+
+func TestEndToEnd_SmartKey_Batching(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	config["smartkeyBatchWindow"] = "50ms"
+
+	client, stop := startTestPlugin(t, config, newTestSmartKeyBackend(t, config))
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const callers = 30
+	ciphers := make([][]byte, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: []byte{byte(i)}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ciphers[i] = response.Cipher
+		}(i)
+	}
+	wg.Wait()
+	if smartkey.RequestCount("encrypt") != 0 || smartkey.RequestCount("batchencrypt") >= callers {
+		t.Error("Concurrent encryptions should be batched, batches:", smartkey.RequestCount("batchencrypt"))
+	}
+
+	/* An invalid cipher fails alone */
+	for i := 0; i <= callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == callers {
+				if _, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: []byte("not a cipher")}); err == nil {
+					t.Error("Invalid cipher should fail")
+				}
+				return
+			}
+			response, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: ciphers[i]})
+			if err != nil || len(response.Plain) != 1 || response.Plain[0] != byte(i) {
+				t.Error("Batched decryption failed", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if smartkey.RequestCount("decrypt") != 0 || smartkey.RequestCount("batchdecrypt") == 0 {
+		t.Error("Decryptions should be batched")
+	}
+}
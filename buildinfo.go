@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	goruntime "runtime"
+)
+
+/* Build metadata, injected at build time with -ldflags "-X main.runtimeVersion=... -X main.gitCommit=... -X main.buildDate=..." */
+var (
+	runtimeVersion = "0.1.0"
+	gitCommit      = "unknown"
+	buildDate      = "unknown"
+)
+
+/*buildInfo describes the running binary. */
+type buildInfo struct {
+	Runtime     string   `json:"runtime"`
+	Version     string   `json:"version"`
+	GitCommit   string   `json:"gitCommit"`
+	BuildDate   string   `json:"buildDate"`
+	GoVersion   string   `json:"goVersion"`
+	APIVersions []string `json:"apiVersions"`
+}
+
+func init() {
+	/* Served with the other metrics on /debug/vars of the debug HTTP server */
+	expvar.Publish("build_info", expvar.Func(func() interface{} { return currentBuildInfo() }))
+}
+
+/* currentBuildInfo returns the build metadata of the binary. */
+func currentBuildInfo() buildInfo {
+	return buildInfo{
+		Runtime:     runtime,
+		Version:     runtimeVersion,
+		GitCommit:   gitCommit,
+		BuildDate:   buildDate,
+		GoVersion:   goruntime.Version(),
+		APIVersions: supportedVersions,
+	}
+}
+
+/* serveVersion handles /version on the debug HTTP server. */
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentBuildInfo())
+}
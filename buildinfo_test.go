@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeVersion(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	serveVersion(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	var info buildInfo
+	if err := json.Unmarshal(recorder.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Runtime != runtime || info.Version != runtimeVersion || info.GitCommit != gitCommit || info.BuildDate != buildDate {
+		t.Error("Unexpected build info", info)
+	}
+	if len(info.APIVersions) != 1 || info.APIVersions[0] != version {
+		t.Error("Supported API versions expected", info.APIVersions)
+	}
+}
+
+func TestBuildInfoMetric(t *testing.T) {
+	metric := expvar.Get("build_info")
+	if metric == nil {
+		t.Fatal("build_info metric expected")
+	}
+	var info buildInfo
+	if err := json.Unmarshal([]byte(metric.String()), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != runtimeVersion || info.GitCommit != gitCommit {
+		t.Error("Unexpected build_info metric", info)
+	}
+}
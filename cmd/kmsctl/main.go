@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+/* KMS API version expected by the apiserver */
+const apiVersion = "v1beta1"
+
+/* Payload used for the encrypt/decrypt round trip */
+const testPayload = "kmsctl round trip test payload"
+
+/* This is the main function of the diagnostic tool for the KMS plugin socket. */
+func main() {
+	socketFile := flag.String("socketFile", "/etc/smartkey/smartkey.socket", "socket file of the KMS plugin")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of each call to the plugin")
+	flag.Parse()
+
+	if err := diagnose(*socketFile, *timeout, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stdout, "Diagnosis: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stdout, "Diagnosis: plugin is healthy")
+}
+
+/* diagnose checks the plugin listening on socketFile step by step, printing each result, and returns the first problem found. */
+func diagnose(socketFile string, timeout time.Duration, out io.Writer) error {
+	/* Socket file */
+	info, err := os.Stat(socketFile)
+	if os.IsNotExist(err) {
+		return fail(out, "socket", errors.New("socket missing: "+socketFile+" does not exist, is the plugin running with this socketFile?"))
+	}
+	if os.IsPermission(err) {
+		return fail(out, "socket", errors.New("permission denied: cannot access "+socketFile+", run as a user allowed to use the socket"))
+	}
+	if err != nil {
+		return fail(out, "socket", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fail(out, "socket", errors.New(socketFile+" is not a unix socket"))
+	}
+	pass(out, "socket", socketFile+" exists", 0)
+
+	/* Connection */
+	start := time.Now()
+	conn, err := net.DialTimeout("unix", socketFile, timeout)
+	switch {
+	case errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM):
+		return fail(out, "connect", errors.New("permission denied: cannot connect to "+socketFile+", run as a user allowed to use the socket"))
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fail(out, "connect", errors.New("connection refused: "+socketFile+" is stale, the plugin is not listening on it"))
+	case err != nil:
+		return fail(out, "connect", err)
+	}
+	conn.Close()
+	pass(out, "connect", "connected", time.Since(start))
+
+	grpcConn, err := grpc.Dial(socketFile, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+	if err != nil {
+		return fail(out, "connect", err)
+	}
+	defer grpcConn.Close()
+	client := k8spb.NewKeyManagementServiceClient(grpcConn)
+
+	/* Version */
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start = time.Now()
+	versionResponse, err := client.Version(ctx, &k8spb.VersionRequest{Version: apiVersion})
+	if status.Code(err) == codes.FailedPrecondition {
+		return fail(out, "version", errors.New("version mismatch: "+status.Convert(err).Message()))
+	}
+	if status.Code(err) == codes.PermissionDenied {
+		return fail(out, "version", callerNotAllowed())
+	}
+	if err != nil {
+		return fail(out, "version", errors.New("version call failed: "+status.Convert(err).Message()))
+	}
+	if versionResponse.Version != apiVersion {
+		return fail(out, "version", errors.New("version mismatch: plugin implements "+versionResponse.Version+", apiserver expects "+apiVersion))
+	}
+	pass(out, "version", versionResponse.RuntimeName+" "+versionResponse.RuntimeVersion+", API "+versionResponse.Version, time.Since(start))
+
+	/* Encrypt and decrypt round trip */
+	start = time.Now()
+	encrypted, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: apiVersion, Plain: []byte(testPayload)})
+	if status.Code(err) == codes.PermissionDenied {
+		return fail(out, "encrypt", callerNotAllowed())
+	}
+	if err != nil {
+		return fail(out, "encrypt", errors.New("backend failure on encrypt: "+status.Convert(err).Message()))
+	}
+	pass(out, "encrypt", fmt.Sprintf("%d bytes cipher", len(encrypted.Cipher)), time.Since(start))
+
+	start = time.Now()
+	decrypted, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: apiVersion, Cipher: encrypted.Cipher})
+	if status.Code(err) == codes.PermissionDenied {
+		return fail(out, "decrypt", callerNotAllowed())
+	}
+	if err != nil {
+		return fail(out, "decrypt", errors.New("backend failure on decrypt: "+status.Convert(err).Message()))
+	}
+	if !bytes.Equal(decrypted.Plain, []byte(testPayload)) {
+		return fail(out, "decrypt", errors.New("backend failure: decrypted data does not match the test payload"))
+	}
+	pass(out, "decrypt", "round trip succeeded", time.Since(start))
+
+	return nil
+}
+
+/* callerNotAllowed describes a call rejected by the peer policy of the plugin. */
+func callerNotAllowed() error {
+	return errors.New("permission denied: the plugin does not allow the uid, gids or executable of this process (allowedPeerUids, allowedPeerGids, allowedPeerExecutables), the rejection is logged by the plugin as an AUDIT: line")
+}
+
+func pass(out io.Writer, step string, message string, latency time.Duration) {
+	if latency > 0 {
+		fmt.Fprintf(out, "[OK]   %-8s %s (%v)\n", step, message, latency.Round(time.Microsecond))
+		return
+	}
+	fmt.Fprintf(out, "[OK]   %-8s %s\n", step, message)
+}
+
+func fail(out io.Writer, step string, err error) error {
+	fmt.Fprintf(out, "[FAIL] %-8s %s\n", step, err.Error())
+	return err
+}
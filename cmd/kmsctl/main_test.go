@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+/* fakePlugin is a KMS plugin reversing data instead of encrypting it. */
+type fakePlugin struct {
+	version      string
+	checkVersion bool
+	versionErr   error
+	encryptErr   error
+}
+
+func (p *fakePlugin) Version(ctx context.Context, request *k8spb.VersionRequest) (*k8spb.VersionResponse, error) {
+	if p.versionErr != nil {
+		return nil, p.versionErr
+	}
+	if p.checkVersion && request.Version != p.version {
+		return nil, status.Errorf(codes.FailedPrecondition, "unsupported KMS API version %q, supported versions: %s", request.Version, p.version)
+	}
+	return &k8spb.VersionResponse{Version: p.version, RuntimeName: "fake", RuntimeVersion: "0.0.1"}, nil
+}
+
+func (p *fakePlugin) Encrypt(ctx context.Context, request *k8spb.EncryptRequest) (*k8spb.EncryptResponse, error) {
+	if p.encryptErr != nil {
+		return nil, p.encryptErr
+	}
+	return &k8spb.EncryptResponse{Cipher: reverse(request.Plain)}, nil
+}
+
+func (p *fakePlugin) Decrypt(ctx context.Context, request *k8spb.DecryptRequest) (*k8spb.DecryptResponse, error) {
+	return &k8spb.DecryptResponse{Plain: reverse(request.Cipher)}, nil
+}
+
+func reverse(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed
+}
+
+func startFakePlugin(t *testing.T, plugin *fakePlugin) (string, func()) {
+	dir, err := ioutil.TempDir("", "kmsctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketFile := filepath.Join(dir, "smartkey.socket")
+
+	listener, err := net.Listen("unix", socketFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	k8spb.RegisterKeyManagementServiceServer(server, plugin)
+	go server.Serve(listener)
+
+	return socketFile, func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDiagnose_Positive_Healthy(t *testing.T) {
+	socketFile, stop := startFakePlugin(t, &fakePlugin{version: apiVersion})
+	defer stop()
+
+	var out bytes.Buffer
+	if err := diagnose(socketFile, 5*time.Second, &out); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if strings.Contains(out.String(), "[FAIL]") || !strings.Contains(out.String(), "round trip succeeded") {
+		t.Error("Unexpected output", out.String())
+	}
+}
+
+func TestDiagnose_Negative_SocketMissing(t *testing.T) {
+	var out bytes.Buffer
+	err := diagnose("/path/to/missing.socket", time.Second, &out)
+	if err == nil || !strings.Contains(err.Error(), "socket missing") {
+		t.Error("Socket missing diagnosis expected, got", err)
+	}
+}
+
+func TestDiagnose_Negative_StaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kmsctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketFile := filepath.Join(dir, "smartkey.socket")
+
+	/* Leave a socket file nobody listens to */
+	listener, err := net.Listen("unix", socketFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	var out bytes.Buffer
+	err = diagnose(socketFile, time.Second, &out)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Error("Connection refused diagnosis expected, got", err)
+	}
+}
+
+func TestDiagnose_Negative_VersionMismatch(t *testing.T) {
+	socketFile, stop := startFakePlugin(t, &fakePlugin{version: "v2"})
+	defer stop()
+
+	var out bytes.Buffer
+	err := diagnose(socketFile, 5*time.Second, &out)
+	if err == nil || !strings.Contains(err.Error(), "version mismatch") {
+		t.Error("Version mismatch diagnosis expected, got", err)
+	}
+}
+
+func TestDiagnose_Negative_VersionRejected(t *testing.T) {
+	socketFile, stop := startFakePlugin(t, &fakePlugin{version: "v2", checkVersion: true})
+	defer stop()
+
+	var out bytes.Buffer
+	err := diagnose(socketFile, 5*time.Second, &out)
+	if err == nil || !strings.Contains(err.Error(), "version mismatch") || !strings.Contains(err.Error(), "supported versions: v2") {
+		t.Error("Version mismatch diagnosis expected, got", err)
+	}
+}
+
+func TestDiagnose_Negative_CallerNotAllowed(t *testing.T) {
+	socketFile, stop := startFakePlugin(t, &fakePlugin{version: apiVersion, versionErr: status.Error(codes.PermissionDenied, "caller is not allowed to use the KMS plugin")})
+	defer stop()
+
+	var out bytes.Buffer
+	err := diagnose(socketFile, 5*time.Second, &out)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") || !strings.Contains(err.Error(), "AUDIT:") {
+		t.Error("Peer policy diagnosis expected, got", err)
+	}
+}
+
+func TestDiagnose_Negative_BackendFailure(t *testing.T) {
+	socketFile, stop := startFakePlugin(t, &fakePlugin{version: apiVersion, encryptErr: errors.New("SmartKey returned status 503")})
+	defer stop()
+
+	var out bytes.Buffer
+	err := diagnose(socketFile, 5*time.Second, &out)
+	if err == nil || !strings.Contains(err.Error(), "backend failure") || !strings.Contains(err.Error(), "503") {
+		t.Error("Backend failure diagnosis expected, got", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+/* This is the main function of the fake SmartKey server used for integration testing. */
+func main() {
+	listenAddr := flag.String("listen", "127.0.0.1:8443", "HTTP listen address")
+	apiKey := flag.String("apiKey", "test-api-key", "API key accepted by the server")
+	keyUUID := flag.String("keyUuid", "test-key", "uuid of the AES key to create")
+	keySize := flag.Int("keySize", 256, "size in bits of the AES key to create")
+	latency := flag.Duration("latency", 0, "latency added to every request")
+	statusCode := flag.Int("failStatus", 0, "HTTP status returned instead of handling requests, eg. 500 or 401")
+	retryAfter := flag.Duration("retryAfter", 0, "Retry-After header returned with failStatus, eg. 2s with failStatus 429")
+	malformed := flag.Bool("malformed", false, "return malformed JSON bodies")
+	flag.Parse()
+
+	server := smartkeytest.New(*apiKey)
+	if _, err := server.AddKey(*keyUUID, *keySize); err != nil {
+		log.Fatalf("Failed to create key, error: %v", err)
+	}
+
+	if *latency > 0 || *statusCode != 0 || *malformed {
+		server.InjectFailure(smartkeytest.Failure{
+			Latency:    *latency,
+			StatusCode: *statusCode,
+			RetryAfter: *retryAfter,
+			Malformed:  *malformed,
+		})
+	}
+
+	log.Printf("Fake SmartKey listening on http://%s with key %s", *listenAddr, *keyUUID)
+	httpServer := &http.Server{Addr: *listenAddr, Handler: server, ReadHeaderTimeout: 10 * time.Second}
+	log.Fatal(httpServer.ListenAndServe())
+}
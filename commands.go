@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+/* Timeout of encrypt and decrypt commands */
+const commandTimeout = 30 * time.Second
+
+/*command is a subcommand of the smartkey-kms binary. */
+type command struct {
+	name        string
+	description string
+	run         func(args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+/* commands lists the subcommands, serve is the default when the first argument is a flag. */
+var commands = []command{
+	{"serve", "run the KMS gRPC server (default)", func(args []string, stdin io.Reader, stdout io.Writer) error { return runServe(args) }},
+	{"validate-config", "check the config file, SmartKey API key and encryption key, then exit", runValidateConfig},
+	{"encrypt", "encrypt stdin to stdout using SmartKey or a running plugin", runEncrypt},
+	{"decrypt", "decrypt stdin to stdout using SmartKey or a running plugin", runDecrypt},
+	{"migrate", "re-encrypt the DEKs of KMS encrypted etcd values from an old key to a new key", runMigrate},
+	{"escrow-export", "export the DEKs of etcd values encrypted to an RSA public key, for disaster recovery", runEscrowExport},
+	{"escrow-check", "check an escrow file can be decrypted with the RSA private key", runEscrowCheck},
+	{"keys", "list the keys recorded in the state file with their first and last use", runKeys},
+	{"key-usage", "report Decrypt calls per key of a running plugin, or the resources per key in an etcd snapshot", runKeyUsage},
+	{"version", "print version information", runVersion},
+	{"generate-local-key", "create a key file for the insecure local backend", runGenerateLocalKey},
+}
+
+/* runCommand runs the subcommand named by the first argument. */
+func runCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	/* Keep "smartkey-kms -socketFile ... -config ..." working as before subcommands existed */
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:], stdin, stdout)
+		}
+	}
+
+	if args[0] != "help" {
+		fmt.Fprintln(stdout, "unknown command "+args[0])
+	}
+	fmt.Fprintln(stdout, "Usage: smartkey-kms <command> [flags]")
+	for _, cmd := range commands {
+		fmt.Fprintf(stdout, "  %-20s %s\n", cmd.name, cmd.description)
+	}
+	if args[0] != "help" {
+		return errors.New("unknown command " + args[0])
+	}
+	return nil
+}
+
+/* runValidateConfig handles the validate-config command. */
+func runValidateConfig(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	configFile := flags.String("config", "", "config file location")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(*configFile) == 0 {
+		return errors.New("configFile parameter not specified")
+	}
+
+	if _, err := parseConfigFile(*configFile); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "config file "+*configFile+" is valid")
+	return nil
+}
+
+/* runEncrypt handles the encrypt command. */
+func runEncrypt(args []string, stdin io.Reader, stdout io.Writer) error {
+	return runCrypt("encrypt", args, stdin, stdout)
+}
+
+/* runDecrypt handles the decrypt command. */
+func runDecrypt(args []string, stdin io.Reader, stdout io.Writer) error {
+	return runCrypt("decrypt", args, stdin, stdout)
+}
+
+/* runCrypt reads stdin, encrypts or decrypts it with the backend from a config file or a running plugin, and writes the result to stdout. */
+func runCrypt(operation string, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet(operation, flag.ContinueOnError)
+	configFile := flags.String("config", "", "config file location, to call SmartKey directly")
+	socketFile := flags.String("socketFile", "", "socket file of a running plugin")
+	insecureLocalBackend := flags.Bool("insecureLocalBackend", false, "allow the insecure local key file backend, for development only")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (len(*configFile) == 0) == (len(*socketFile) == 0) {
+		return errors.New("exactly one of config or socketFile parameters must be specified")
+	}
+
+	input, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	var output []byte
+	if len(*configFile) > 0 {
+		backend, err := newBackendFromConfigFile(*configFile, *insecureLocalBackend)
+		if err != nil {
+			return err
+		}
+		if operation == "encrypt" {
+			output, err = backend.Encrypt(ctx, input)
+		} else {
+			output, err = backend.Decrypt(ctx, input)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		client, conn, err := dialPlugin(*socketFile)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if operation == "encrypt" {
+			response, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: input})
+			if err != nil {
+				return err
+			}
+			output = response.Cipher
+		} else {
+			response, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: input})
+			if err != nil {
+				return err
+			}
+			output = response.Plain
+		}
+	}
+
+	_, err = stdout.Write(output)
+	return err
+}
+
+/* runMigrate handles the migrate command. */
+func runMigrate(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	oldConfigFile := flags.String("oldConfig", "", "config file of the key currently encrypting the values")
+	newConfigFile := flags.String("newConfig", "", "config file of the key to migrate to")
+	insecureLocalBackend := flags.Bool("insecureLocalBackend", false, "allow the insecure local key file backend, for development only")
+	etcd := addEtcdFlags(flags, "migrate")
+	providerName := flags.String("providerName", "", "only migrate values of this KMS provider name")
+	dryRun := flags.Bool("dryRun", false, "report what would be migrated without writing")
+	stateFile := flags.String("stateFile", "", "file recording progress, to resume an interrupted migration")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(*oldConfigFile) == 0 || len(*newConfigFile) == 0 {
+		return errors.New("oldConfig and newConfig parameters must be specified")
+	}
+	if err := etcd.check(); err != nil {
+		return err
+	}
+
+	fromBackend, err := newBackendFromConfigFile(*oldConfigFile, *insecureLocalBackend)
+	if err != nil {
+		return err
+	}
+	toBackend, err := newBackendFromConfigFile(*newConfigFile, *insecureLocalBackend)
+	if err != nil {
+		return err
+	}
+
+	store, err := etcd.open(!*dryRun)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	stats, err := migrate(context.Background(), store, fromBackend, toBackend, migrationOptions{
+		dryRun:       *dryRun,
+		providerName: *providerName,
+		stateFile:    *stateFile,
+		progress:     stdout,
+	})
+	if err != nil {
+		return err
+	}
+	if stats.Failed > 0 {
+		return fmt.Errorf("%d values could not be migrated", stats.Failed)
+	}
+	return nil
+}
+
+/* runEscrowExport handles the escrow-export command. Anyone able to run it can read every secret: it needs the plugin config, etcd credentials and a reason, recorded in the escrow file and logged. */
+func runEscrowExport(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("escrow-export", flag.ContinueOnError)
+	configFile := flags.String("config", "", "config file of the backend encrypting the DEKs")
+	insecureLocalBackend := flags.Bool("insecureLocalBackend", false, "allow the insecure local key file backend, for development only")
+	publicKeyFile := flags.String("publicKey", "", "PEM encoded RSA public key of the operators, at least 2048 bits")
+	out := flags.String("out", "", "escrow file to write")
+	reason := flags.String("reason", "", "reason of the export, eg. a change ticket, recorded in the escrow file")
+	etcd := addEtcdFlags(flags, "export")
+	providerName := flags.String("providerName", "", "only export DEKs of this KMS provider name")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(*configFile) == 0 || len(*publicKeyFile) == 0 || len(*out) == 0 {
+		return errors.New("config, publicKey and out parameters must be specified")
+	}
+	if len(strings.TrimSpace(*reason)) == 0 {
+		return errors.New("reason parameter must be specified, it is recorded in the escrow file")
+	}
+	if err := etcd.check(); err != nil {
+		return err
+	}
+
+	/* Every DEK goes through the memory of the command */
+	if err := disableCoreDumps(); err != nil {
+		log.Println("WARNING: Unable to disable core dumps:", err)
+	}
+
+	publicKey, err := readRSAPublicKey(*publicKeyFile)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := publicKeyFingerprint(publicKey)
+	if err != nil {
+		return err
+	}
+	backend, err := newBackendFromConfigFile(*configFile, *insecureLocalBackend)
+	if err != nil {
+		return err
+	}
+	store, err := etcd.open(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	log.Printf("AUDIT: escrow export by uid %d to public key SHA-256 %s, reason: %s", os.Getuid(), fingerprint, *reason)
+	entries, stats, err := exportEscrow(context.Background(), store, backend, publicKey, *providerName, stdout)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&escrowFile{
+		Version:         escrowFileVersion,
+		Created:         time.Now().UTC().Format(time.RFC3339),
+		Reason:          *reason,
+		PublicKeySHA256: fingerprint,
+		Entries:         entries,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(*out, data); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, stats)
+	log.Println("AUDIT: escrow export wrote", stats.Exported, "DEKs to", *out)
+	if stats.Failed > 0 {
+		return fmt.Errorf("%d DEKs could not be exported", stats.Failed)
+	}
+	return nil
+}
+
+/* runEscrowCheck handles the escrow-check command, which decrypts every DEK of an escrow file without printing them. */
+func runEscrowCheck(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("escrow-check", flag.ContinueOnError)
+	escrowFile := flags.String("escrowFile", "", "escrow file written by escrow-export")
+	privateKeyFile := flags.String("privateKey", "", "PEM encoded RSA private key matching the export public key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(*escrowFile) == 0 || len(*privateKeyFile) == 0 {
+		return errors.New("escrowFile and privateKey parameters must be specified")
+	}
+
+	privateKey, err := readRSAPrivateKey(*privateKeyFile)
+	if err != nil {
+		return err
+	}
+	deks, err := loadEscrowFile(*escrowFile, privateKey)
+	if err != nil {
+		return err
+	}
+	for _, dek := range deks {
+		zeroBytes(dek)
+	}
+	fmt.Fprintln(stdout, "escrow file", *escrowFile, "holds", len(deks), "DEKs decryptable with", *privateKeyFile)
+	return nil
+}
+
+/*etcdFlags selects a live etcd cluster or a snapshot holding the apiserver objects. */
+type etcdFlags struct {
+	endpoints  *string
+	certFile   *string
+	keyFile    *string
+	caCertFile *string
+	snapshot   *string
+	prefix     *string
+}
+
+/* addEtcdFlags defines the etcd flags of a command, the snapshot is used instead of a live cluster for the verb. */
+func addEtcdFlags(flags *flag.FlagSet, verb string) *etcdFlags {
+	return &etcdFlags{
+		endpoints:  flags.String("etcdEndpoints", "", "comma separated endpoints of a live etcd cluster"),
+		certFile:   flags.String("etcdCert", "", "etcd client certificate file"),
+		keyFile:    flags.String("etcdKey", "", "etcd client key file"),
+		caCertFile: flags.String("etcdCACert", "", "etcd CA certificate file"),
+		snapshot:   flags.String("snapshot", "", "etcd snapshot file to "+verb+" instead of a live cluster"),
+		prefix:     flags.String("prefix", "/registry/", "etcd key prefix of the apiserver objects"),
+	}
+}
+
+/* check verifies exactly one of a live cluster or a snapshot is selected. */
+func (f *etcdFlags) check() error {
+	if (len(*f.endpoints) == 0) == (len(*f.snapshot) == 0) {
+		return errors.New("exactly one of etcdEndpoints or snapshot parameters must be specified")
+	}
+	return nil
+}
+
+/* open connects to the live cluster or opens the snapshot, read only unless writable is set. */
+func (f *etcdFlags) open(writable bool) (kvStore, error) {
+	if len(*f.snapshot) > 0 {
+		return newSnapshotEtcdStore(*f.snapshot, *f.prefix, writable)
+	}
+	return newLiveEtcdStore(strings.Split(*f.endpoints, ","),
+		etcdTLSConfig{certFile: *f.certFile, keyFile: *f.keyFile, caCertFile: *f.caCertFile}, *f.prefix)
+}
+
+/* newBackendFromConfigFile parses and validates a config file and creates its backend. */
+func newBackendFromConfigFile(configFile string, allowInsecure bool) (Backend, error) {
+	config, err := parseConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return newBackend(config, allowInsecure)
+}
+
+/* runKeys handles the keys command which prints the key ring of the state file, it does not change the state file. */
+func runKeys(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("keys", flag.ContinueOnError)
+	configFile := flags.String("config", "", "config file location")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(*configFile) == 0 {
+		return errors.New("configFile parameter not specified")
+	}
+
+	config, err := parseConfigFile(*configFile)
+	if err != nil {
+		return err
+	}
+	stateFile, isPresent := config["stateFile"]
+	if !isPresent {
+		return errors.New("property 'stateFile' missing in config file " + *configFile)
+	}
+	macKey, err := stateFileMacKey(config)
+	if err != nil {
+		return err
+	}
+	ring, err := readKeyRing(stateFile, macKey, previousStateFileMacKey(config))
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "KID\tNAME\tROLE\tCREATED\tFIRST USED\tLAST USED")
+	for _, record := range ring.keys() {
+		var roles []string
+		if record.Kid == ring.primary().Kid {
+			roles = append(roles, "primary")
+		}
+		if record.Kid == ring.legacyKid() {
+			roles = append(roles, "legacy")
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", record.Kid, orDash(record.Name), orDash(strings.Join(roles, ",")),
+			record.Created.UTC().Format(time.RFC3339), formatUseTime(record.FirstUsed), formatUseTime(record.LastUsed))
+	}
+	return writer.Flush()
+}
+
+/* formatUseTime formats a first or last used time, "never" when the key was not used. */
+func formatUseTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+/* orDash returns "-" for empty table cells. */
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+/* runVersion handles the version command. */
+func runVersion(args []string, stdin io.Reader, stdout io.Writer) error {
+	info := currentBuildInfo()
+	fmt.Fprintln(stdout, info.Runtime+" KMS plugin")
+	fmt.Fprintln(stdout, "  Version:     "+info.Version)
+	fmt.Fprintln(stdout, "  Git commit:  "+info.GitCommit)
+	fmt.Fprintln(stdout, "  Build date:  "+info.BuildDate)
+	fmt.Fprintln(stdout, "  Go version:  "+info.GoVersion)
+	fmt.Fprintln(stdout, "  KMS API:     "+strings.Join(info.APIVersions, ", "))
+	return nil
+}
+
+/* runGenerateLocalKey handles the generate-local-key command which creates a key file for the local backend. */
+func runGenerateLocalKey(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("generate-local-key", flag.ContinueOnError)
+	out := flags.String("out", "", "path of the key file to create")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*out) == 0 {
+		return errors.New("out parameter not specified")
+	}
+	if err := generateLocalKeyFile(*out); err != nil {
+		return err
+	}
+	log.Println("Local AES-256 key written to", *out)
+	return nil
+}
+
+/* dialPlugin connects to the gRPC server of a running plugin. */
+func dialPlugin(socketFile string) (k8spb.KeyManagementServiceClient, *grpc.ClientConn, error) {
+	conn, err := grpc.Dial(socketFile, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(netProtocol, addr, timeout)
+	}), grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMessageSize), grpc.MaxCallSendMsgSize(maxMessageSize)))
+	if err != nil {
+		return nil, nil, errors.New("unable to connect to " + socketFile + ": " + err.Error())
+	}
+	return k8spb.NewKeyManagementServiceClient(conn), conn, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+/* writeTestConfigFile writes config as a JSON config file in dir. */
+func writeTestConfigFile(t *testing.T, dir string, config map[string]string) string {
+	var properties []string
+	for key, value := range config {
+		properties = append(properties, "\""+key+"\": \""+value+"\"")
+	}
+	configFile := filepath.Join(dir, "smartkey-grpc.conf")
+	if err := ioutil.WriteFile(configFile, []byte("{"+strings.Join(properties, ",")+"}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+func TestRunCommand_ValidateConfig(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	config["socketFile"] = "unix-sockfile-path"
+
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := writeTestConfigFile(t, dir, config)
+
+	var stdout bytes.Buffer
+	if err := runCommand([]string{"validate-config", "-config", configFile}, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "is valid") {
+		t.Error("Validation result expected, got", stdout.String())
+	}
+
+	smartkey.UpdateKey("uuid-1", func(key *smartkeytest.Key) { key.Enabled = false })
+	if err := runCommand([]string{"validate-config", "-config", configFile}, nil, &stdout); err == nil {
+		t.Error("Test case should fail as [encryptionKeyUuid] is invalid")
+	}
+}
+
+func TestRunCommand_EncryptDecrypt_Config(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	config["socketFile"] = "unix-sockfile-path"
+
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := writeTestConfigFile(t, dir, config)
+
+	plain := []byte{0, 1, 2, 'p', 'l', 'a', 'i', 'n', 0xff}
+	var encrypted, decrypted bytes.Buffer
+	if err := runCommand([]string{"encrypt", "-config", configFile}, bytes.NewReader(plain), &encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand([]string{"decrypt", "-config", configFile}, bytes.NewReader(encrypted.Bytes()), &decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), plain) {
+		t.Error("Decrypted data does not match plain data")
+	}
+}
+
+func TestRunCommand_EncryptDecrypt_Socket(t *testing.T) {
+	socketFile, stop := serveTestPlugin(t, make(map[string]string), newTestLocalBackend(t))
+	defer stop()
+
+	var encrypted, decrypted bytes.Buffer
+	if err := runCommand([]string{"encrypt", "-socketFile", socketFile}, strings.NewReader("secret"), &encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand([]string{"decrypt", "-socketFile", socketFile}, bytes.NewReader(encrypted.Bytes()), &decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.String() != "secret" {
+		t.Error("Decrypted data does not match plain data")
+	}
+}
+
+func TestRunCommand_Negative_EncryptNeedsOneTarget(t *testing.T) {
+	var stdout bytes.Buffer
+	if err := runCommand([]string{"encrypt"}, strings.NewReader("secret"), &stdout); err == nil {
+		t.Error("Test case should fail as neither config nor socketFile is specified")
+	}
+	if err := runCommand([]string{"encrypt", "-config", "a", "-socketFile", "b"}, strings.NewReader("secret"), &stdout); err == nil {
+		t.Error("Test case should fail as both config and socketFile are specified")
+	}
+}
+
+func TestRunCommand_Keys(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	config["socketFile"] = "unix-sockfile-path"
+
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := writeTestConfigFile(t, dir, config)
+
+	var stdout bytes.Buffer
+	if err := runCommand([]string{"keys", "-config", configFile}, nil, &stdout); err == nil {
+		t.Error("Test case should fail as stateFile is not configured")
+	}
+
+	config["stateFile"] = filepath.Join(dir, "state.json")
+	configFile = writeTestConfigFile(t, dir, config)
+	if err := runCommand([]string{"keys", "-config", configFile}, nil, &stdout); err == nil {
+		t.Error("Test case should fail as the state file does not exist")
+	}
+	if _, err := newTestSmartKeyBackend(t, config).Encrypt(nil, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand([]string{"keys", "-config", configFile}, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "uuid-1") || !strings.Contains(stdout.String(), "primary,legacy") || strings.Contains(stdout.String(), "never") {
+		t.Error("Key list expected, got", stdout.String())
+	}
+}
+
+func TestRunCommand_Version(t *testing.T) {
+	var stdout bytes.Buffer
+	if err := runCommand([]string{"version"}, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), runtimeVersion) || !strings.Contains(stdout.String(), version) ||
+		!strings.Contains(stdout.String(), gitCommit) || !strings.Contains(stdout.String(), buildDate) {
+		t.Error("Version information expected, got", stdout.String())
+	}
+}
+
+func TestRunCommand_Negative_UnknownCommand(t *testing.T) {
+	var stdout bytes.Buffer
+	if err := runCommand([]string{"unknown"}, nil, &stdout); err == nil {
+		t.Error("Test case should fail as command is unknown")
+	}
+	if !strings.Contains(stdout.String(), "validate-config") {
+		t.Error("Usage expected, got", stdout.String())
+	}
+}
+
+func TestRunCommand_Negative_ServeFlagsWithoutSubcommand(t *testing.T) {
+	/* Flags without a subcommand run serve, which needs the config flag */
+	err := runCommand([]string{"-socketFile", "/path/to/sock/file"}, nil, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "configFile") {
+		t.Error("Serve parameters should be validated, got", err)
+	}
+}
@@ -11,4 +11,18 @@ conf/smartkey-grpc.service /lib/systemd/system/
 conf/smartkey-grpc.conf /etc/smartkey/
 conf/smartkey.yaml /etc/smartkey/" > debian/install
 
+# The service runs as the smartkey user, which owns the socket directory and reads the config files
+cat > debian/postinst <<'EOF'
+#!/bin/sh
+set -e
+if [ "$1" = "configure" ]; then
+	getent passwd smartkey >/dev/null || adduser --system --group --no-create-home --home /nonexistent smartkey
+	chown smartkey:smartkey /etc/smartkey
+	chmod 0750 /etc/smartkey
+	chown root:smartkey /etc/smartkey/smartkey-grpc.conf
+	chmod 0640 /etc/smartkey/smartkey-grpc.conf
+fi
+#DEBHELPER#
+EOF
+
 debuild -us -uc
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"log"
+
+	"golang.org/x/net/context"
+)
+
+/* Prefix of ciphers wrapped by two backends: "dual:<base64 primary cipher>:<base64 secondary cipher>" */
+const dualCipherPrefix = "dual:"
+
+/* dualBackendMetrics exposes the Decrypt calls answered by the secondary backend and the failures of each backend on /debug/vars */
+var dualBackendMetrics = expvar.NewMap("dual_backend")
+
+/*dualBackend is a Backend wrapping each DEK with two backends, both ciphers are returned so Decrypt succeeds while either backend is available. */
+type dualBackend struct {
+	primary   Backend
+	secondary Backend
+}
+
+/* formatDualCipher combines the ciphers of the primary and secondary backends. */
+func formatDualCipher(primary []byte, secondary []byte) []byte {
+	encoding := base64.StdEncoding
+	data := make([]byte, len(dualCipherPrefix)+encoding.EncodedLen(len(primary))+1+encoding.EncodedLen(len(secondary)))
+	n := copy(data, dualCipherPrefix)
+	encoding.Encode(data[n:], primary)
+	n += encoding.EncodedLen(len(primary))
+	data[n] = ':'
+	encoding.Encode(data[n+1:], secondary)
+	return data
+}
+
+/* parseDualCipher returns the ciphers of the primary and secondary backends, or false for ciphers of a single backend. */
+func parseDualCipher(data []byte) ([]byte, []byte, bool) {
+	if !bytes.HasPrefix(data, []byte(dualCipherPrefix)) {
+		return nil, nil, false
+	}
+	parts := bytes.Split(data[len(dualCipherPrefix):], []byte(":"))
+	if len(parts) != 2 {
+		return nil, nil, false
+	}
+	primary, err := base64.StdEncoding.DecodeString(string(parts[0]))
+	if err != nil {
+		return nil, nil, false
+	}
+	secondary, err := base64.StdEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, nil, false
+	}
+	return primary, secondary, true
+}
+
+/*Encrypt encrypts plain data with both backends concurrently, it fails when either fails so every cipher can be decrypted by both. */
+func (b *dualBackend) Encrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	var secondary []byte
+	var secondaryErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		secondary, secondaryErr = b.secondary.Encrypt(ctx, plain)
+	}()
+	primary, err := b.primary.Encrypt(ctx, plain)
+	<-done
+
+	if err != nil {
+		dualBackendMetrics.Add("primary_encrypt_failures", 1)
+		return nil, err
+	}
+	if secondaryErr != nil {
+		dualBackendMetrics.Add("secondary_encrypt_failures", 1)
+		return nil, errors.New("secondary backend: " + secondaryErr.Error())
+	}
+	return formatDualCipher(primary, secondary), nil
+}
+
+/*Decrypt decrypts with the primary backend, then with the secondary backend when the primary fails. Ciphers of a single backend, written before dual mode was enabled, are decrypted by the primary backend. */
+func (b *dualBackend) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	primary, secondary, ok := parseDualCipher(data)
+	if !ok {
+		return b.primary.Decrypt(ctx, data)
+	}
+
+	plain, err := b.primary.Decrypt(ctx, primary)
+	if err == nil {
+		return plain, nil
+	}
+	dualBackendMetrics.Add("primary_decrypt_failures", 1)
+	log.Println("WARNING: Primary backend failed to decrypt, using the secondary backend:", err)
+
+	plain, secondaryErr := b.secondary.Decrypt(ctx, secondary)
+	if secondaryErr != nil {
+		dualBackendMetrics.Add("secondary_decrypt_failures", 1)
+		return nil, errors.New("primary backend: " + err.Error() + "; secondary backend: " + secondaryErr.Error())
+	}
+	dualBackendMetrics.Add("secondary_decrypts", 1)
+	return plain, nil
+}
+
+/*Health checks both backends, Encrypt needs both. */
+func (b *dualBackend) Health(ctx context.Context) error {
+	if err := b.primary.Health(ctx); err != nil {
+		return err
+	}
+	if err := b.secondary.Health(ctx); err != nil {
+		return errors.New("secondary backend: " + err.Error())
+	}
+	return nil
+}
+
+/*KeyInfo returns the metadata of the primary key. */
+func (b *dualBackend) KeyInfo(ctx context.Context) (*KeyObject, error) {
+	return b.primary.KeyInfo(ctx)
+}
+
+/* parseSecondaryConfigFile parses and validates the config file of the secondary backend, which cannot have a secondary backend itself. */
+func parseSecondaryConfigFile(configFile string) (map[string]string, error) {
+	var config map[string]string
+	if data, err := ioutil.ReadFile(configFile); err == nil && json.Unmarshal(data, &config) == nil {
+		if _, isPresent := config["secondaryConfigFile"]; isPresent {
+			return nil, errors.New("property 'secondaryConfigFile' is not allowed in the secondary config file " + configFile)
+		}
+	}
+	return parseConfigFile(configFile)
+}
+
+/* newSecondaryBackend creates the backend of secondaryConfigFile. The local backend is allowed as an escrow key, the DEKs are then as well protected as the local key file. */
+func newSecondaryBackend(configFile string) (Backend, error) {
+	config, err := parseSecondaryConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if config["backend"] == localBackendName {
+		log.Println("WARNING: DEKs are also wrapped by the local key file", config["localKeyFile"]+", protect it like the SmartKey API key")
+		return newLocalBackendFromConfig(config)
+	}
+	return newBackend(config, false)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+func TestDualCipher(t *testing.T) {
+	data := formatDualCipher([]byte("smartkey:uuid-1:Y2lwaGVy"), []byte("bG9jYWw="))
+	if !strings.HasPrefix(string(data), "dual:") {
+		t.Error("Unexpected cipher format", string(data))
+	}
+	primary, secondary, ok := parseDualCipher(data)
+	if !ok || string(primary) != "smartkey:uuid-1:Y2lwaGVy" || string(secondary) != "bG9jYWw=" {
+		t.Error("Dual cipher should be parsed", string(primary), string(secondary))
+	}
+	for _, single := range []string{"Y2lwaGVy", "smartkey:uuid-1:Y2lwaGVy", "dual:Y2lwaGVy", "dual:!:Y2lwaGVy", "dual:a:b:c"} {
+		if _, _, ok := parseDualCipher([]byte(single)); ok {
+			t.Errorf("%q should not be a dual cipher", single)
+		}
+	}
+}
+
+func TestDualBackend_Positive(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	primary := newTestSmartKeyBackend(t, config)
+	backend := &dualBackend{primary: primary, secondary: newTestLocalBackend(t)}
+
+	single, err := primary.Encrypt(nil, []byte("single"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := backend.Encrypt(nil, []byte("secret"))
+	if err != nil || !bytes.HasPrefix(cipher, []byte(dualCipherPrefix)) {
+		t.Fatal("Dual cipher expected", string(cipher), err)
+	}
+	if plain, err := backend.Decrypt(nil, cipher); err != nil || string(plain) != "secret" {
+		t.Error("Dual cipher should decrypt with the primary backend", err)
+	}
+	if plain, err := backend.Decrypt(nil, single); err != nil || string(plain) != "single" {
+		t.Error("Ciphers written before dual mode should decrypt", err)
+	}
+
+	/* SmartKey is unreachable, the secondary backend decrypts */
+	secondaryDecrypts := func() int64 {
+		if value, ok := dualBackendMetrics.Get("secondary_decrypts").(*expvar.Int); ok {
+			return value.Value()
+		}
+		return 0
+	}
+	before := secondaryDecrypts()
+	smartkey.InjectFailure(smartkeytest.Failure{StatusCode: 503})
+	if plain, err := backend.Decrypt(nil, cipher); err != nil || string(plain) != "secret" {
+		t.Error("Dual cipher should decrypt with the secondary backend", err)
+	}
+	if secondaryDecrypts() != before+1 {
+		t.Error("Secondary decrypts should be counted")
+	}
+	if _, err := backend.Encrypt(nil, []byte("secret")); err == nil {
+		t.Error("Test case should fail as the primary backend cannot encrypt")
+	}
+	if _, err := backend.Decrypt(nil, single); err == nil {
+		t.Error("Test case should fail as single ciphers need the primary backend")
+	}
+	if err := backend.Health(nil); err == nil {
+		t.Error("Test case should fail as the primary backend is unhealthy")
+	}
+}
+
+func TestDualBackend_Negative_SecondaryFails(t *testing.T) {
+	secondary, secondaryConfig := newTestSmartKey(t)
+	defer secondary.Close()
+	backend := &dualBackend{primary: newTestLocalBackend(t), secondary: newTestSmartKeyBackend(t, secondaryConfig)}
+
+	secondary.InjectFailure(smartkeytest.Failure{StatusCode: 503})
+	if _, err := backend.Encrypt(nil, []byte("secret")); err == nil || !strings.Contains(err.Error(), "secondary") {
+		t.Error("Test case should fail as the secondary backend cannot encrypt", err)
+	}
+	if err := backend.Health(nil); err == nil {
+		t.Error("Test case should fail as the secondary backend is unhealthy")
+	}
+}
+
+func TestNewBackend_SecondaryConfigFile(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "escrow.key")
+	if err := generateLocalKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	secondaryDir := filepath.Join(dir, "secondary")
+	os.Mkdir(secondaryDir, 0700)
+	secondaryConfigFile := writeTestConfigFile(t, secondaryDir, map[string]string{
+		"backend": "local", "localKeyFile": keyFile, "iv": config["iv"], "socketFile": "unused",
+	})
+	config["socketFile"] = "unix-sockfile-path"
+	config["secondaryConfigFile"] = secondaryConfigFile
+	configFile := writeTestConfigFile(t, dir, config)
+
+	parsed, err := parseConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := newBackend(parsed, false)
+	if err != nil {
+		t.Fatal("Local backend should be allowed as secondary backend", err)
+	}
+	if _, ok := backend.(*dualBackend); !ok {
+		t.Fatal("Dual backend expected")
+	}
+	cipher, err := backend.Encrypt(nil, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := backend.Decrypt(nil, cipher); err != nil || string(plain) != "secret" {
+		t.Error("Dual cipher should decrypt", err)
+	}
+
+	/* A secondary backend cannot have a secondary backend */
+	writeTestConfigFile(t, secondaryDir, map[string]string{
+		"backend": "local", "localKeyFile": keyFile, "iv": config["iv"], "socketFile": "unused", "secondaryConfigFile": secondaryConfigFile,
+	})
+	if _, err := parseConfigFile(configFile); err == nil {
+		t.Error("Test case should fail as the secondary config file has a secondary backend")
+	}
+}
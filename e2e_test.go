@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+/* serveTestPlugin serves the plugin on a unix socket in a temporary directory and returns the socket file. */
+func serveTestPlugin(t *testing.T, config map[string]string, backend Backend) (string, func()) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketFile := filepath.Join(dir, "smartkey.socket")
+
+	server, err := NewWithBackend(socketFile, config, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.startServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	return socketFile, func() {
+		server.Server.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+/* startTestPlugin serves the plugin on a unix socket and returns a client connected to it. */
+func startTestPlugin(t *testing.T, config map[string]string, backend Backend) (k8spb.KeyManagementServiceClient, func()) {
+	socketFile, stopServer := serveTestPlugin(t, config, backend)
+
+	client, conn, err := dialPlugin(socketFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, func() {
+		conn.Close()
+		stopServer()
+	}
+}
+
+func newTestSmartKey(t *testing.T) (*smartkeytest.Server, map[string]string) {
+	smartkey := smartkeytest.NewServer("api-key")
+	if _, err := smartkey.AddKey("uuid-1", 256); err != nil {
+		t.Fatal(err)
+	}
+
+	config := make(map[string]string)
+	config["smartkeyURL"] = smartkey.URL
+	config["smartkeyApiKey"] = "api-key"
+	config["encryptionKeyUuid"] = "uuid-1"
+	config["iv"] = "rFvgbU6EygpLUObqFZxITg=="
+	return smartkey, config
+}
+
+func TestEndToEnd_SmartKey_RoundTrip(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+
+	client, stop := startTestPlugin(t, config, newTestSmartKeyBackend(t, config))
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	versionResponse, err := client.Version(ctx, &k8spb.VersionRequest{Version: version})
+	if err != nil || versionResponse.Version != version {
+		t.Fatal("Version call failed", err)
+	}
+
+	encrypted, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encrypted.Cipher) == "secret" || len(encrypted.Cipher) == 0 {
+		t.Fatal("Invalid cipher")
+	}
+
+	decrypted, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: encrypted.Cipher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted.Plain) != "secret" {
+		t.Error("Decrypted data does not match plain data")
+	}
+
+	if smartkey.RequestCount("encrypt") != 1 || smartkey.RequestCount("decrypt") != 1 {
+		t.Error("SmartKey should be called once per operation")
+	}
+}
+
+func TestEndToEnd_ParseConfigFile_AuthRejected(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	smartkey.InjectFailure(smartkeytest.Failure{StatusCode: 401})
+
+	configData := []byte("{\"" +
+		"smartkeyApiKey\": \"" + config["smartkeyApiKey"] + "\"," +
+		"\"encryptionKeyUuid\": \"" + config["encryptionKeyUuid"] + "\"," +
+		"\"iv\": \"" + config["iv"] + "\"," +
+		"\"socketFile\": \"unix-sockfile-path\"," +
+		"\"smartkeyURL\": \"" + config["smartkeyURL"] + "\"" +
+		"}")
+	ioutil.WriteFile("smartkey-grpc_tmp.conf", configData, 0644)
+
+	_, err := parseConfigFile("smartkey-grpc_tmp.conf")
+
+	os.Remove("smartkey-grpc_tmp.conf")
+
+	if err == nil {
+		t.Error("Test case should fail as SmartKey rejects the API key")
+	}
+}
+
+func TestEndToEnd_SmartKey_ErrorIsReturned(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+
+	client, stop := startTestPlugin(t, config, newTestSmartKeyBackend(t, config))
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	smartkey.InjectFailure(smartkeytest.Failure{StatusCode: 503})
+	if _, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")}); err == nil {
+		t.Error("Test case should fail as SmartKey is unavailable")
+	}
+
+	smartkey.InjectFailure(smartkeytest.Failure{Malformed: true})
+	if _, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")}); err == nil {
+		t.Error("Test case should fail as SmartKey response is malformed")
+	}
+}
+
+func TestEndToEnd_Property_BinaryRoundTrip(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+
+	client, stop := startTestPlugin(t, config, newTestSmartKeyBackend(t, config))
+	defer stop()
+
+	roundTrip := func(plain []byte) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		encrypted, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: plain})
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		decrypted, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: encrypted.Cipher})
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return bytes.Equal(decrypted.Plain, plain)
+	}
+
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 20, Values: randomPayloads}); err != nil {
+		t.Error(err)
+	}
+	for _, size := range []int{0, 1, 15, 16, 17, maxObjectSize} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		if !roundTrip(plain) {
+			t.Errorf("Round trip failed for a payload of %d bytes", size)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	/* Interval between two health checks of the endpoints when smartkeyHealthCheckInterval is not configured */
+	defaultHealthCheckInterval = 30 * time.Second
+	/* A recovered endpoint of higher priority is selected again after being healthy this long, when smartkeyFailbackDelay is not configured */
+	defaultFailbackDelay = 5 * time.Minute
+	/* Timeout of a health check request */
+	healthCheckTimeout = 10 * time.Second
+	/* Longest wait for an endpoint to answer a call when several endpoints are configured without smartkeyRequestTimeout, then the call fails over to another endpoint. Calls to a single endpoint are only limited by the caller. */
+	defaultRequestTimeout = 2 * time.Second
+	/* SmartKey API answering 2xx while the endpoint is available, without authentication */
+	smartKeyHealthPath = "/sys/v1/health"
+)
+
+/* Values of smartkeyEndpointStrategy */
+const (
+	priorityStrategy   = "priority"
+	roundRobinStrategy = "round-robin"
+)
+
+/* endpointMetrics exposes the requests, failures, health and selection of each SmartKey endpoint on /debug/vars */
+var endpointMetrics = expvar.NewMap("smartkey_endpoints")
+
+/* Endpoint pools shared by the SmartKey calls of a config, by endpoint properties */
+var (
+	endpointPoolsMutex sync.Mutex
+	endpointPools      = make(map[string]*endpointPool)
+)
+
+/*smartKeyEndpoint is a SmartKey API base URL. */
+type smartKeyEndpoint struct {
+	url string
+	/* position in smartkeyURL, 0 is the highest priority */
+	priority int
+	metrics  *expvar.Map
+
+	/* guarded by the pool mutex */
+	healthy      bool
+	healthySince time.Time
+}
+
+/*endpointPool selects the SmartKey endpoint of each call. With the priority strategy every call goes to the selected endpoint, which stays selected until it fails; a recovered endpoint of higher priority is selected again after failbackDelay. With the round-robin strategy calls are spread over the healthy endpoints. A failed call is retried on the other endpoints. */
+type endpointPool struct {
+	endpoints      []*smartKeyEndpoint
+	roundRobin     bool
+	checkInterval  time.Duration
+	failbackDelay  time.Duration
+	requestTimeout time.Duration
+	now            func() time.Time
+
+	mutex sync.Mutex
+	/* selected endpoint of the priority strategy */
+	current int
+	/* next endpoint of the round-robin strategy */
+	next int
+}
+
+/* smartKeyEndpoints returns the endpoint pool of config, shared by every call with the same endpoint properties. */
+func smartKeyEndpoints(config map[string]string) (*endpointPool, error) {
+	poolKey := strings.Join([]string{config["smartkeyURL"], config["smartkeyEndpointStrategy"],
+		config["smartkeyHealthCheckInterval"], config["smartkeyFailbackDelay"], config["smartkeyRequestTimeout"]}, "|")
+
+	endpointPoolsMutex.Lock()
+	defer endpointPoolsMutex.Unlock()
+	if pool, ok := endpointPools[poolKey]; ok {
+		return pool, nil
+	}
+	pool, err := newEndpointPool(config)
+	if err != nil {
+		return nil, err
+	}
+	endpointPools[poolKey] = pool
+	return pool, nil
+}
+
+/* newEndpointPool reads smartkeyURL, a comma separated list of endpoints by priority, and the optional smartkeyEndpointStrategy ("priority" or "round-robin"), smartkeyHealthCheckInterval, smartkeyFailbackDelay and smartkeyRequestTimeout config properties. */
+func newEndpointPool(config map[string]string) (*endpointPool, error) {
+	checkInterval, err := parseDurationProperty(config, "smartkeyHealthCheckInterval", defaultHealthCheckInterval)
+	if err != nil {
+		return nil, err
+	}
+	failbackDelay, err := parseDurationProperty(config, "smartkeyFailbackDelay", defaultFailbackDelay)
+	if err != nil {
+		return nil, err
+	}
+	requestTimeout, err := parseDurationProperty(config, "smartkeyRequestTimeout", defaultRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, isPresent := config["smartkeyRequestTimeout"]; !isPresent && !strings.Contains(config["smartkeyURL"], ",") {
+		requestTimeout = 0
+	}
+	strategy, isPresent := config["smartkeyEndpointStrategy"]
+	if !isPresent {
+		strategy = priorityStrategy
+	}
+	if strategy != priorityStrategy && strategy != roundRobinStrategy {
+		return nil, errors.New("property 'smartkeyEndpointStrategy' must be " + priorityStrategy + " or " + roundRobinStrategy)
+	}
+
+	p := &endpointPool{roundRobin: strategy == roundRobinStrategy, checkInterval: checkInterval, failbackDelay: failbackDelay, requestTimeout: requestTimeout, now: time.Now}
+	for i, value := range strings.Split(config["smartkeyURL"], ",") {
+		value = strings.TrimRight(strings.TrimSpace(value), "/")
+		if len(value) == 0 {
+			return nil, errors.New("property 'smartkeyURL' must be a comma separated list of URLs")
+		}
+		endpoint := &smartKeyEndpoint{url: value, priority: i, metrics: new(expvar.Map).Init(), healthy: true, healthySince: p.now()}
+		endpoint.metrics.Set("healthy", expvarInt(1))
+		endpoint.metrics.Set("selected", expvarInt(0))
+		endpointMetrics.Set(value, endpoint.metrics)
+		p.endpoints = append(p.endpoints, endpoint)
+	}
+	if !p.roundRobin {
+		p.endpoints[0].metrics.Set("selected", expvarInt(1))
+	}
+	return p, nil
+}
+
+/* do calls fn with the base URL of each endpoint in selection order, until an endpoint answers or ctx is done. Each call gets a context limited to requestTimeout, when set. Network errors, timeouts and 5xx responses fail over to the next endpoint when failover is set, the last error is returned when every endpoint failed. */
+func (p *endpointPool) do(ctx context.Context, failover bool, fn func(ctx context.Context, baseURL string) error) error {
+	if ctx.Err() != nil {
+		return &unreachableError{err: ctx.Err()}
+	}
+	var err error
+	for _, endpoint := range p.candidates() {
+		endpoint.metrics.Add("requests", 1)
+		attemptCtx, cancel := context.WithCancel(ctx)
+		if p.requestTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, p.requestTimeout)
+		}
+		err = fn(attemptCtx, endpoint.url)
+		cancel()
+		if err == nil || !isEndpointFailure(err) {
+			p.markUp(endpoint)
+			return err
+		}
+		if ctx.Err() != nil {
+			/* The caller gave up, the endpoint may still be healthy */
+			return err
+		}
+		endpoint.metrics.Add("failures", 1)
+		p.markDown(endpoint, err)
+		if !failover {
+			return err
+		}
+	}
+	return err
+}
+
+/* candidates returns the endpoints in the order a call tries them: the selected endpoint or the next in round-robin first, unhealthy endpoints last as they may have recovered. */
+func (p *endpointPool) candidates() []*smartKeyEndpoint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ordered := make([]*smartKeyEndpoint, 0, len(p.endpoints))
+	if p.roundRobin {
+		for i := range p.endpoints {
+			ordered = append(ordered, p.endpoints[(p.next+i)%len(p.endpoints)])
+		}
+		p.next = (p.next + 1) % len(p.endpoints)
+	} else {
+		ordered = append(ordered, p.endpoints[p.current])
+		for i, endpoint := range p.endpoints {
+			if i != p.current {
+				ordered = append(ordered, endpoint)
+			}
+		}
+	}
+
+	candidates := make([]*smartKeyEndpoint, 0, len(ordered))
+	for _, endpoint := range ordered {
+		if endpoint.healthy {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	for _, endpoint := range ordered {
+		if !endpoint.healthy {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	return candidates
+}
+
+/* markUp records an endpoint answered. The priority strategy selects it when the selected endpoint is down. */
+func (p *endpointPool) markUp(endpoint *smartKeyEndpoint) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !endpoint.healthy {
+		log.Println("SmartKey endpoint", endpoint.url, "recovered")
+		endpoint.healthy = true
+		endpoint.healthySince = p.now()
+		endpoint.metrics.Set("healthy", expvarInt(1))
+	}
+	if !p.roundRobin && !p.endpoints[p.current].healthy {
+		p.selectEndpoint(endpoint.priority)
+	}
+}
+
+/* markDown records an endpoint failed. The priority strategy fails over to the healthy endpoint of highest priority when it was selected. */
+func (p *endpointPool) markDown(endpoint *smartKeyEndpoint, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if endpoint.healthy {
+		log.Println("WARNING: SmartKey endpoint", endpoint.url, "failed:", err)
+		endpoint.healthy = false
+		endpoint.metrics.Set("healthy", expvarInt(0))
+	}
+	if !p.roundRobin && p.current == endpoint.priority {
+		for _, candidate := range p.endpoints {
+			if candidate.healthy {
+				p.selectEndpoint(candidate.priority)
+				return
+			}
+		}
+	}
+}
+
+/* selectEndpoint makes an endpoint the selected one of the priority strategy, must be called with the lock held. */
+func (p *endpointPool) selectEndpoint(priority int) {
+	if priority == p.current {
+		return
+	}
+	previous := p.endpoints[p.current]
+	log.Println("SmartKey endpoint switched from", previous.url, "to", p.endpoints[priority].url)
+	previous.metrics.Set("selected", expvarInt(0))
+	previous.metrics.Add("failovers", 1)
+	p.current = priority
+	p.endpoints[priority].metrics.Set("selected", expvarInt(1))
+}
+
+/* check probes every endpoint, then the priority strategy fails back to an endpoint of higher priority healthy for failbackDelay. */
+func (p *endpointPool) check() {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	for _, endpoint := range p.endpoints {
+		response, err := client.Get(endpoint.url + smartKeyHealthPath)
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode < 200 || response.StatusCode > 299 {
+				err = &SmartKeyError{StatusCode: response.StatusCode, Message: "health check failed"}
+			}
+		}
+		if err != nil {
+			p.markDown(endpoint, err)
+		} else {
+			p.markUp(endpoint)
+		}
+	}
+
+	if p.roundRobin {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, endpoint := range p.endpoints[:p.current] {
+		if endpoint.healthy && p.now().Sub(endpoint.healthySince) >= p.failbackDelay {
+			p.selectEndpoint(endpoint.priority)
+			return
+		}
+	}
+}
+
+/* run checks the endpoints every checkInterval until stop is closed. */
+func (p *endpointPool) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+/* isEndpointFailure reports whether an error means the endpoint is unavailable, rather than the request being rejected. */
+func isEndpointFailure(err error) bool {
+	if smartKeyErr, ok := err.(*SmartKeyError); ok {
+		return smartKeyErr.StatusCode >= 500
+	}
+	_, ok := err.(*unreachableError)
+	return ok
+}
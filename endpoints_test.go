@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+/* newTestSmartKeyRegions starts two fake SmartKey endpoints sharing the key uuid-1, as regions of the same deployment. */
+func newTestSmartKeyRegions(t *testing.T, strategy string) (*smartkeytest.Server, *smartkeytest.Server, map[string]string) {
+	material := make([]byte, 32)
+	rand.Read(material)
+	first := smartkeytest.NewServer("api-key")
+	second := smartkeytest.NewServer("api-key")
+	first.ImportKey("uuid-1", material)
+	second.ImportKey("uuid-1", material)
+
+	config := map[string]string{
+		"smartkeyURL":              first.URL + ", " + second.URL + "/",
+		"smartkeyApiKey":           "api-key",
+		"encryptionKeyUuid":        "uuid-1",
+		"iv":                       "rFvgbU6EygpLUObqFZxITg==",
+		"smartkeyEndpointStrategy": strategy,
+	}
+	return first, second, config
+}
+
+func TestEndpointPool_Positive_PriorityFailover(t *testing.T) {
+	first, second, config := newTestSmartKeyRegions(t, "priority")
+	defer first.Close()
+	defer second.Close()
+	backend := newTestSmartKeyBackend(t, config)
+	endpoints, _ := smartKeyEndpoints(config)
+
+	cipher, err := backend.Encrypt(nil, []byte("secret"))
+	if err != nil || first.RequestCount("encrypt") != 1 || second.RequestCount("encrypt") != 0 {
+		t.Fatal("First endpoint should be used", err)
+	}
+
+	/* The first region fails, calls move to the second one */
+	first.InjectFailure(smartkeytest.Failure{StatusCode: 503})
+	if plain, err := backend.Decrypt(nil, cipher); err != nil || string(plain) != "secret" {
+		t.Fatal("Decrypt should fail over to the second endpoint", err)
+	}
+	if second.RequestCount("decrypt") != 1 {
+		t.Error("Second endpoint should answer")
+	}
+
+	/* The second endpoint stays selected after the first recovers */
+	first.ClearFailure()
+	before := first.RequestCount("decrypt")
+	backend.Decrypt(nil, cipher)
+	if first.RequestCount("decrypt") != before || second.RequestCount("decrypt") != 2 {
+		t.Error("Selected endpoint should be sticky")
+	}
+	if selected, ok := endpointMetrics.Get(second.URL).(*expvar.Map).Get("selected").(*expvar.Int); !ok || selected.Value() != 1 {
+		t.Error("Selected endpoint should be reported in metrics")
+	}
+
+	/* Health checks fail back once the first endpoint was healthy for the failback delay */
+	endpoints.check()
+	backend.Decrypt(nil, cipher)
+	if second.RequestCount("decrypt") != 3 {
+		t.Error("Fail back should wait for the failback delay")
+	}
+	endpoints.now = func() time.Time { return time.Now().Add(defaultFailbackDelay) }
+	endpoints.check()
+	backend.Decrypt(nil, cipher)
+	if first.RequestCount("decrypt") != before+1 {
+		t.Error("Endpoint of highest priority should be selected again")
+	}
+	if first.RequestCount("health") == 0 || second.RequestCount("health") == 0 {
+		t.Error("Every endpoint should be health checked")
+	}
+}
+
+func TestEndpointPool_Positive_RoundRobin(t *testing.T) {
+	first, second, config := newTestSmartKeyRegions(t, "round-robin")
+	defer first.Close()
+	defer second.Close()
+	backend := newTestSmartKeyBackend(t, config)
+
+	for i := 0; i < 4; i++ {
+		if _, err := backend.Encrypt(nil, []byte("secret")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.RequestCount("encrypt") != 2 || second.RequestCount("encrypt") != 2 {
+		t.Error("Calls should be spread over the endpoints", first.RequestCount("encrypt"), second.RequestCount("encrypt"))
+	}
+
+	/* An unreachable endpoint is skipped */
+	first.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := backend.Encrypt(nil, []byte("secret")); err != nil {
+			t.Fatal("Encrypt should fail over to the reachable endpoint", err)
+		}
+	}
+	if second.RequestCount("encrypt") != 6 {
+		t.Error("Reachable endpoint should answer every call", second.RequestCount("encrypt"))
+	}
+}
+
+func TestEndpointPool_Positive_HangingEndpoint(t *testing.T) {
+	/* An endpoint accepting connections but never answering, like a black-holed load balancer */
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer hanging.Close()
+	defer close(release)
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	config["smartkeyURL"] = hanging.URL + "," + smartkey.URL
+	config["smartkeyRequestTimeout"] = "200ms"
+	backend := newTestSmartKeyBackend(t, config)
+
+	start := time.Now()
+	if _, err := backend.Encrypt(nil, []byte("secret")); err != nil || time.Since(start) > 2*time.Second {
+		t.Fatal("Call should fail over once the hanging endpoint times out", err, time.Since(start))
+	}
+	if healthy, ok := endpointMetrics.Get(hanging.URL).(*expvar.Map).Get("healthy").(*expvar.Int); !ok || healthy.Value() != 0 {
+		t.Error("Hanging endpoint should be marked unhealthy")
+	}
+
+	/* The caller's deadline bounds the call, a caller giving up does not mark the endpoint down */
+	config["smartkeyURL"] = hanging.URL
+	config["smartkeyRequestTimeout"] = "10s"
+	backend = newTestSmartKeyBackend(t, config)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := backend.Encrypt(ctx, []byte("secret")); err == nil || time.Since(start) > 2*time.Second {
+		t.Error("Call should stop at the caller's deadline", err, time.Since(start))
+	}
+	endpoints, _ := smartKeyEndpoints(config)
+	if !endpoints.endpoints[0].healthy {
+		t.Error("Endpoint should not be marked down when the caller gives up")
+	}
+}
+
+func TestEndpointPool_RequestTimeout(t *testing.T) {
+	/* A single endpoint has nowhere to fail over, its calls are only bounded by the caller */
+	single, err := newEndpointPool(map[string]string{"smartkeyURL": "https://eu.smartkey.io"})
+	if err != nil || single.requestTimeout != 0 {
+		t.Error("Single endpoint should have no request timeout by default", err)
+	}
+	several, err := newEndpointPool(map[string]string{"smartkeyURL": "https://eu.smartkey.io,https://us.smartkey.io"})
+	if err != nil || several.requestTimeout != defaultRequestTimeout {
+		t.Error("Several endpoints should have the default request timeout", err)
+	}
+	configured, err := newEndpointPool(map[string]string{"smartkeyURL": "https://eu.smartkey.io", "smartkeyRequestTimeout": "30s"})
+	if err != nil || configured.requestTimeout != 30*time.Second {
+		t.Error("Configured request timeout should apply to a single endpoint", err)
+	}
+}
+
+func TestEndpointPool_Negative(t *testing.T) {
+	first, second, config := newTestSmartKeyRegions(t, "priority")
+	defer first.Close()
+	defer second.Close()
+	backend := newTestSmartKeyBackend(t, config)
+
+	/* Rejected requests are not retried on other endpoints */
+	first.UpdateKey("uuid-1", func(key *smartkeytest.Key) { key.KeyOps = []string{"DECRYPT"} })
+	if _, err := backend.Encrypt(nil, []byte("secret")); err == nil || second.RequestCount("encrypt") != 0 {
+		t.Error("A rejected request should not fail over", err)
+	}
+
+	/* Creating a key is not idempotent, it is not repeated on another endpoint */
+	first.InjectFailure(smartkeytest.Failure{StatusCode: 503, Times: 1})
+	if _, err := createKey(context.Background(), config, "kubernetes-kms-test", 256); err == nil || second.RequestCount("create") != 0 {
+		t.Error("Key creation should not fail over", err)
+	}
+
+	first.InjectFailure(smartkeytest.Failure{StatusCode: 503})
+	second.InjectFailure(smartkeytest.Failure{StatusCode: 502})
+	if _, err := backend.Encrypt(nil, []byte("secret")); err == nil {
+		t.Error("Test case should fail as every endpoint fails")
+	}
+
+	for _, invalid := range []map[string]string{
+		{"smartkeyURL": "https://eu.smartkey.io,,https://us.smartkey.io"},
+		{"smartkeyURL": "https://eu.smartkey.io", "smartkeyEndpointStrategy": "random"},
+		{"smartkeyURL": "https://eu.smartkey.io", "smartkeyHealthCheckInterval": "often"},
+		{"smartkeyURL": "https://eu.smartkey.io", "smartkeyFailbackDelay": "-1m"},
+		{"smartkeyURL": "https://eu.smartkey.io", "smartkeyRequestTimeout": "soon"},
+	} {
+		if _, err := newEndpointPool(invalid); err == nil {
+			t.Error("Test case should fail as the endpoint config is invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	/* Version of the escrow file format */
+	escrowFileVersion = 1
+	/* Smallest RSA key accepted to protect escrowed DEKs */
+	minEscrowKeySize = 2048
+)
+
+/* OAEP label of escrowed DEKs, so they cannot be confused with other data encrypted to the same RSA key */
+var escrowLabel = []byte("smartkey-kubernetes-kms escrow")
+
+/* escrowMetrics exposes the Decrypt calls answered from the escrow file in recovery mode on /debug/vars */
+var escrowMetrics = expvar.NewMap("escrow")
+
+/*escrowEntry is a DEK of the escrow file. */
+type escrowEntry struct {
+	/* DEK cipher stored in etcd, base64 encoded */
+	Cipher string `json:"cipher"`
+	/* DEK encrypted with RSA-OAEP SHA-256 to the escrow public key, base64 encoded */
+	Key string `json:"key"`
+}
+
+/*escrowFile holds DEKs encrypted to an operator RSA key, to decrypt secrets without SmartKey. */
+type escrowFile struct {
+	Version int    `json:"version"`
+	Created string `json:"created"`
+	Reason  string `json:"reason"`
+	/* SHA-256 of the PKIX encoded public key */
+	PublicKeySHA256 string        `json:"publicKeySha256"`
+	Entries         []escrowEntry `json:"entries"`
+}
+
+/*escrowStats counts the values processed by an escrow export. */
+type escrowStats struct {
+	Scanned  int
+	Exported int
+	Failed   int
+}
+
+func (s escrowStats) String() string {
+	return fmt.Sprintf("scanned %d, exported %d DEKs, failed %d", s.Scanned, s.Exported, s.Failed)
+}
+
+/* readRSAPublicKey reads a PEM encoded RSA public key, PKIX ("PUBLIC KEY") or PKCS #1 ("RSA PUBLIC KEY"), of at least minEscrowKeySize bits. */
+func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	var publicKey *rsa.PublicKey
+	if block.Type == "RSA PUBLIC KEY" {
+		publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		var key interface{}
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if publicKey, ok = key.(*rsa.PublicKey); !ok {
+				err = errors.New("not an RSA key")
+			}
+		}
+	}
+	if err != nil {
+		return nil, errors.New("invalid public key " + path + ": " + err.Error())
+	}
+	if publicKey.N.BitLen() < minEscrowKeySize {
+		return nil, fmt.Errorf("public key %s must have at least %d bits", path, minEscrowKeySize)
+	}
+	return publicKey, nil
+}
+
+/* readRSAPrivateKey reads a PEM encoded RSA private key, PKCS #1 or PKCS #8. */
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	if privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return privateKey, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("invalid private key " + path + ": " + err.Error())
+	}
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid private key " + path + ": not an RSA key")
+	}
+	return privateKey, nil
+}
+
+func readPEMBlock(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("unable to read key file " + path + ": " + err.Error())
+	}
+	block, _ := pem.Decode(data)
+	if block == nil && (bytes.HasPrefix(bytes.TrimSpace(data), []byte("age1")) || bytes.Contains(data, []byte("AGE-SECRET-KEY-1"))) {
+		return nil, errors.New("invalid key file " + path + ": age keys are not supported, use an RSA key")
+	}
+	if block == nil {
+		return nil, errors.New("invalid key file " + path + ": no PEM block found")
+	}
+	return block, nil
+}
+
+/* publicKeyFingerprint returns the hex SHA-256 of the PKIX encoded public key. */
+func publicKeyFingerprint(publicKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/* exportEscrow decrypts the DEK of every KMS envelope in store with backend and encrypts it to publicKey. DEKs which cannot be decrypted are counted and skipped. */
+func exportEscrow(ctx context.Context, store kvStore, backend Backend, publicKey *rsa.PublicKey, providerName string, progress io.Writer) ([]escrowEntry, escrowStats, error) {
+	var stats escrowStats
+	var entries []escrowEntry
+	exported := make(map[string]bool)
+
+	err := store.Walk(ctx, nil, func(position []byte, key []byte, value []byte) error {
+		stats.Scanned++
+		if stats.Scanned%migrationProgressInterval == 0 {
+			progressf(progress, "%s\n", stats)
+		}
+		envelope, isKMS, err := parseKMSEnvelope(value)
+		if !isKMS {
+			return nil
+		}
+		if err != nil {
+			stats.Failed++
+			progressf(progress, "%s: %v\n", key, err)
+			return nil
+		}
+		if (len(providerName) > 0 && envelope.providerName != providerName) || exported[string(envelope.encryptedDEK)] {
+			return nil
+		}
+
+		dek, err := backend.Decrypt(ctx, envelope.encryptedDEK)
+		if err == nil && !validDEK(dek) {
+			err = errors.New("decrypted DEK is invalid")
+		}
+		if err != nil {
+			stats.Failed++
+			progressf(progress, "%s: unable to decrypt DEK: %v\n", key, err)
+			return nil
+		}
+		encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, dek, escrowLabel)
+		zeroBytes(dek)
+		if err != nil {
+			return err
+		}
+
+		exported[string(envelope.encryptedDEK)] = true
+		entries = append(entries, escrowEntry{
+			Cipher: base64.StdEncoding.EncodeToString(envelope.encryptedDEK),
+			Key:    base64.StdEncoding.EncodeToString(encryptedKey),
+		})
+		stats.Exported++
+		return nil
+	})
+	return entries, stats, err
+}
+
+/* loadEscrowFile decrypts the DEKs of an escrow file with the private key, by DEK cipher. */
+func loadEscrowFile(path string, privateKey *rsa.PrivateKey) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("unable to read escrow file " + path + ": " + err.Error())
+	}
+	var escrow escrowFile
+	if err := json.Unmarshal(data, &escrow); err != nil {
+		return nil, errors.New("unable to parse escrow file " + path + ": " + err.Error())
+	}
+	if escrow.Version != escrowFileVersion {
+		return nil, fmt.Errorf("unsupported escrow file version %d in %s", escrow.Version, path)
+	}
+	fingerprint, err := publicKeyFingerprint(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if fingerprint != escrow.PublicKeySHA256 {
+		return nil, errors.New("escrow file " + path + " was exported to another key, public key SHA-256 " + escrow.PublicKeySHA256)
+	}
+
+	deks := make(map[string][]byte, len(escrow.Entries))
+	for i, entry := range escrow.Entries {
+		cipher, err := base64.StdEncoding.DecodeString(entry.Cipher)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %d in escrow file %s: %v", i, path, err)
+		}
+		encryptedKey, err := base64.StdEncoding.DecodeString(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %d in escrow file %s: %v", i, path, err)
+		}
+		dek, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, encryptedKey, escrowLabel)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt entry %d of escrow file %s: %v", i, path, err)
+		}
+		deks[string(cipher)] = dek
+	}
+	return deks, nil
+}
+
+/*escrowBackend is a Backend in recovery mode, answering Decrypt from escrowed DEKs so secrets can be read without SmartKey. Other calls go to the wrapped backend. */
+type escrowBackend struct {
+	backend Backend
+	deks    map[string][]byte
+}
+
+/* newEscrowBackend loads the escrowFile with the escrowPrivateKeyFile config properties. */
+func newEscrowBackend(backend Backend, config map[string]string) (*escrowBackend, error) {
+	privateKey, err := readRSAPrivateKey(config["escrowPrivateKeyFile"])
+	if err != nil {
+		return nil, err
+	}
+	deks, err := loadEscrowFile(config["escrowFile"], privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &escrowBackend{backend: backend, deks: deks}, nil
+}
+
+/*Encrypt encrypts with the wrapped backend, escrowed DEKs are only used to decrypt. */
+func (b *escrowBackend) Encrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	return b.backend.Encrypt(ctx, plain)
+}
+
+/*Decrypt returns the escrowed DEK of the cipher, or decrypts with the wrapped backend when the cipher was not escrowed. */
+func (b *escrowBackend) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	if dek, ok := b.deks[string(data)]; ok {
+		escrowMetrics.Add("decrypts", 1)
+		return append([]byte(nil), dek...), nil
+	}
+	escrowMetrics.Add("misses", 1)
+	return b.backend.Decrypt(ctx, data)
+}
+
+/*Health is healthy while escrowed DEKs can be served, whatever the state of the wrapped backend. */
+func (b *escrowBackend) Health(ctx context.Context) error {
+	return nil
+}
+
+/*KeyInfo returns the metadata of the key of the wrapped backend. */
+func (b *escrowBackend) KeyInfo(ctx context.Context) (*KeyObject, error) {
+	return b.backend.KeyInfo(ctx)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+/* writeTestRSAKey writes a PEM public and private key pair of the given size in dir. */
+func writeTestRSAKey(t *testing.T, dir string, name string, bits int) (string, string) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyFile := filepath.Join(dir, name+".pub")
+	privateKeyFile := filepath.Join(dir, name+".pem")
+	ioutil.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600)
+	ioutil.WriteFile(privateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}), 0600)
+	return publicKeyFile, privateKeyFile
+}
+
+/* writeTestEscrowFile exports the DEKs of store encrypted by backend to an escrow file in dir and returns its path and the private key file. */
+func writeTestEscrowFile(t *testing.T, dir string, store kvStore, backend Backend) (string, string) {
+	publicKeyFile, privateKeyFile := writeTestRSAKey(t, dir, "escrow", 2048)
+	publicKey, err := readRSAPublicKey(publicKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := exportEscrow(context.Background(), store, backend, publicKey, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, _ := publicKeyFingerprint(publicKey)
+	escrowFileName := filepath.Join(dir, "escrow.json")
+	data, _ := json.Marshal(&escrowFile{Version: escrowFileVersion, PublicKeySHA256: fingerprint, Entries: entries})
+	ioutil.WriteFile(escrowFileName, data, 0600)
+	return escrowFileName, privateKeyFile
+}
+
+func TestExportEscrow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := newTestBackendWithRandomKey(t)
+	otherBackend := newTestBackendWithRandomKey(t)
+
+	store := newMemStore()
+	store.values["/registry/secrets/default/a"] = newTestEnvelope(t, backend, "smartkey", "a")
+	store.values["/registry/secrets/default/b"] = newTestEnvelope(t, backend, "smartkey", "b")
+	store.values["/registry/secrets/default/c"] = store.values["/registry/secrets/default/a"]
+	store.values["/registry/secrets/default/d"] = newTestEnvelope(t, otherBackend, "smartkey", "d")
+	store.values["/registry/configmaps/default/e"] = []byte("plain")
+
+	publicKeyFile, privateKeyFile := writeTestRSAKey(t, dir, "escrow", 2048)
+	publicKey, _ := readRSAPublicKey(publicKeyFile)
+	entries, stats, err := exportEscrow(context.Background(), store, backend, publicKey, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || stats.Exported != 2 || stats.Failed != 1 || stats.Scanned != 5 {
+		t.Error("Each DEK of the backend should be exported once", stats)
+	}
+
+	fingerprint, _ := publicKeyFingerprint(publicKey)
+	escrowFileName := filepath.Join(dir, "escrow.json")
+	data, _ := json.Marshal(&escrowFile{Version: escrowFileVersion, PublicKeySHA256: fingerprint, Entries: entries})
+	ioutil.WriteFile(escrowFileName, data, 0600)
+
+	privateKey, err := readRSAPrivateKey(privateKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deks, err := loadEscrowFile(escrowFileName, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, _, _ := parseKMSEnvelope(store.values["/registry/secrets/default/a"])
+	dek, _ := backend.Decrypt(nil, envelope.encryptedDEK)
+	if len(deks) != 2 || !bytes.Equal(deks[string(envelope.encryptedDEK)], dek) {
+		t.Error("Escrowed DEKs should be decrypted with the private key")
+	}
+
+	_, otherPrivateKeyFile := writeTestRSAKey(t, dir, "other", 2048)
+	otherPrivateKey, _ := readRSAPrivateKey(otherPrivateKeyFile)
+	if _, err := loadEscrowFile(escrowFileName, otherPrivateKey); err == nil {
+		t.Error("Test case should fail as the escrow file was exported to another key")
+	}
+	weakPublicKeyFile, _ := writeTestRSAKey(t, dir, "weak", 1024)
+	if _, err := readRSAPublicKey(weakPublicKeyFile); err == nil {
+		t.Error("Test case should fail as the public key is too small")
+	}
+	agePublicKeyFile := filepath.Join(dir, "age.pub")
+	ioutil.WriteFile(agePublicKeyFile, []byte("age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p\n"), 0600)
+	if _, err := readRSAPublicKey(agePublicKeyFile); err == nil || !strings.Contains(err.Error(), "age keys are not supported") {
+		t.Error("Test case should fail as age recipients are not supported, got", err)
+	}
+}
+
+func TestEscrowBackend_RecoveryMode(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newMemStore()
+	store.values["/registry/secrets/default/a"] = newTestEnvelope(t, newTestSmartKeyBackend(t, config), "smartkey", "a")
+	escrowFileName, privateKeyFile := writeTestEscrowFile(t, dir, store, newTestSmartKeyBackend(t, config))
+
+	config["socketFile"] = "unix-sockfile-path"
+	config["escrowFile"] = escrowFileName
+	config["escrowPrivateKeyFile"] = privateKeyFile
+	configFile := writeTestConfigFile(t, dir, config)
+
+	/* SmartKey is unavailable, the plugin still starts and decrypts escrowed DEKs */
+	smartkey.InjectFailure(smartkeytest.Failure{StatusCode: 503})
+	backend, err := newBackendFromConfigFile(configFile, false)
+	if err != nil {
+		t.Fatal("Recovery mode should start without SmartKey", err)
+	}
+	envelope, _, _ := parseKMSEnvelope(store.values["/registry/secrets/default/a"])
+	if dek, err := backend.Decrypt(nil, envelope.encryptedDEK); err != nil || !validDEK(dek) {
+		t.Error("Escrowed DEK should be decrypted without SmartKey", err)
+	}
+	if _, err := backend.Decrypt(nil, []byte("bm90IGVzY3Jvd2Vk")); err == nil {
+		t.Error("Test case should fail as the cipher was not escrowed and SmartKey is unavailable")
+	}
+	if _, ok := smartKeyBackendOf(backend); !ok {
+		t.Error("SmartKey backend should be found behind the recovery mode")
+	}
+
+	delete(config, "escrowPrivateKeyFile")
+	configFile = writeTestConfigFile(t, dir, config)
+	if _, err := parseConfigFile(configFile); err == nil {
+		t.Error("Test case should fail as the escrow private key is missing")
+	}
+}
+
+func TestRunCommand_Escrow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "local.key")
+	if err := generateLocalKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	config := map[string]string{"backend": "local", "localKeyFile": keyFile, "iv": "rFvgbU6EygpLUObqFZxITg==", "socketFile": "unused"}
+	configFile := writeTestConfigFile(t, dir, config)
+	parsed, _ := parseConfigFile(configFile)
+	backend, err := newBackend(parsed, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(dir, "snapshot.db")
+	writeTestSnapshot(t, snapshot, [][2]string{
+		{"/registry/secrets/default/a", string(newTestEnvelope(t, backend, "smartkey", "a"))},
+		{"/registry/secrets/default/b", string(newTestEnvelope(t, backend, "smartkey", "b"))},
+	})
+	publicKeyFile, privateKeyFile := writeTestRSAKey(t, dir, "escrow", 2048)
+	escrowFileName := filepath.Join(dir, "escrow.json")
+
+	var stdout bytes.Buffer
+	exportArgs := []string{"escrow-export", "-config", configFile, "-insecureLocalBackend", "-publicKey", publicKeyFile,
+		"-out", escrowFileName, "-snapshot", snapshot}
+	if err := runCommand(exportArgs, nil, &stdout); err == nil {
+		t.Error("Test case should fail as the reason is missing")
+	}
+	if err := runCommand(append(exportArgs, "-reason", "CHG-1234 disaster recovery drill"), nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "exported 2 DEKs") {
+		t.Error("Export statistics expected, got", stdout.String())
+	}
+	if info, err := os.Stat(escrowFileName); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Escrow file should be readable by its owner only", err)
+	}
+
+	stdout.Reset()
+	if err := runCommand([]string{"escrow-check", "-escrowFile", escrowFileName, "-privateKey", privateKeyFile}, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "holds 2 DEKs") {
+		t.Error("Escrow check result expected, got", stdout.String())
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+)
+
+/* Number of entries read from etcd at once */
+const etcdPageSize = 100
+
+/* Name of the bbolt bucket holding the revisions of every key in an etcd database */
+var etcdKeyBucket = []byte("key")
+
+/*liveEtcdStore is a kvStore reading and writing a running etcd cluster. */
+type liveEtcdStore struct {
+	client *clientv3.Client
+	prefix string
+}
+
+/*etcdTLSConfig holds the client certificate used to connect to etcd. */
+type etcdTLSConfig struct {
+	certFile   string
+	keyFile    string
+	caCertFile string
+}
+
+/*newLiveEtcdStore connects to etcd and walks the keys under prefix, eg. /registry/. */
+func newLiveEtcdStore(endpoints []string, tlsConfig etcdTLSConfig, prefix string) (*liveEtcdStore, error) {
+	config := clientv3.Config{Endpoints: endpoints, DialTimeout: 10 * time.Second}
+
+	if len(tlsConfig.certFile) > 0 || len(tlsConfig.caCertFile) > 0 {
+		config.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		if len(tlsConfig.certFile) > 0 {
+			cert, err := tls.LoadX509KeyPair(tlsConfig.certFile, tlsConfig.keyFile)
+			if err != nil {
+				return nil, errors.New("unable to load etcd client certificate: " + err.Error())
+			}
+			config.TLS.Certificates = []tls.Certificate{cert}
+		}
+		if len(tlsConfig.caCertFile) > 0 {
+			caCert, err := ioutil.ReadFile(tlsConfig.caCertFile)
+			if err != nil {
+				return nil, errors.New("unable to read etcd CA certificate: " + err.Error())
+			}
+			config.TLS.RootCAs = x509.NewCertPool()
+			if !config.TLS.RootCAs.AppendCertsFromPEM(caCert) {
+				return nil, errors.New("invalid etcd CA certificate " + tlsConfig.caCertFile)
+			}
+		}
+	}
+
+	client, err := clientv3.New(config)
+	if err != nil {
+		return nil, errors.New("unable to connect to etcd: " + err.Error())
+	}
+	return &liveEtcdStore{client: client, prefix: prefix}, nil
+}
+
+/*Walk reads the keys under the prefix page by page, the position is the key. */
+func (s *liveEtcdStore) Walk(ctx context.Context, after []byte, fn func(position []byte, key []byte, value []byte) error) error {
+	end := clientv3.GetPrefixRangeEnd(s.prefix)
+	start := s.prefix
+	if len(after) > 0 {
+		start = string(after) + "\x00"
+	}
+
+	for {
+		response, err := s.client.Get(ctx, start, clientv3.WithRange(end), clientv3.WithLimit(etcdPageSize),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		if err != nil {
+			return errors.New("unable to read etcd: " + err.Error())
+		}
+		for _, kv := range response.Kvs {
+			if err := fn(kv.Key, kv.Key, kv.Value); err != nil {
+				return err
+			}
+		}
+		if !response.More || len(response.Kvs) == 0 {
+			return nil
+		}
+		start = string(response.Kvs[len(response.Kvs)-1].Key) + "\x00"
+	}
+}
+
+/*Put writes the value only if etcd still holds oldValue. */
+func (s *liveEtcdStore) Put(ctx context.Context, position []byte, key []byte, oldValue []byte, newValue []byte) error {
+	response, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(string(key)), "=", string(oldValue))).
+		Then(clientv3.OpPut(string(key), string(newValue))).
+		Commit()
+	if err != nil {
+		return errors.New("unable to write etcd: " + err.Error())
+	}
+	if !response.Succeeded {
+		return errConflict
+	}
+	return nil
+}
+
+/*Close closes the etcd client. */
+func (s *liveEtcdStore) Close() error {
+	return s.client.Close()
+}
+
+/*snapshotEtcdStore is a kvStore reading and writing the bbolt database of an etcd snapshot (or of a stopped member). Every revision of every key is migrated. */
+type snapshotEtcdStore struct {
+	db     *bolt.DB
+	prefix []byte
+}
+
+/*newSnapshotEtcdStore opens an etcd snapshot file, read only unless writable is set. */
+func newSnapshotEtcdStore(path string, prefix string, writable bool) (*snapshotEtcdStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: !writable, Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.New("unable to open etcd snapshot " + path + ": " + err.Error())
+	}
+	return &snapshotEtcdStore{db: db, prefix: []byte(prefix)}, nil
+}
+
+/*snapshotEntry is an entry read from a snapshot. */
+type snapshotEntry struct {
+	position []byte
+	key      []byte
+	value    []byte
+}
+
+/*Walk reads the revisions under the prefix page by page, the position is the revision. */
+func (s *snapshotEtcdStore) Walk(ctx context.Context, after []byte, fn func(position []byte, key []byte, value []byte) error) error {
+	for {
+		/* Read a page then release the transaction, fn may write */
+		var page []snapshotEntry
+		done := false
+		err := s.db.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(etcdKeyBucket)
+			if bucket == nil {
+				return errors.New("invalid etcd snapshot: bucket 'key' missing")
+			}
+			cursor := bucket.Cursor()
+			position, value := cursor.First()
+			if len(after) > 0 {
+				position, value = cursor.Seek(after)
+				if bytes.Equal(position, after) {
+					position, value = cursor.Next()
+				}
+			}
+			for ; position != nil; position, value = cursor.Next() {
+				after = append([]byte(nil), position...)
+
+				var kv mvccpb.KeyValue
+				if err := kv.Unmarshal(value); err != nil {
+					return errors.New("invalid etcd snapshot entry: " + err.Error())
+				}
+				if !bytes.HasPrefix(kv.Key, s.prefix) {
+					continue
+				}
+				page = append(page, snapshotEntry{
+					position: after,
+					key:      append([]byte(nil), kv.Key...),
+					value:    append([]byte(nil), kv.Value...),
+				})
+				if len(page) == etcdPageSize {
+					return nil
+				}
+			}
+			done = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range page {
+			if err := fn(entry.position, entry.key, entry.value); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+/*Put updates the revision only if it still holds oldValue. */
+func (s *snapshotEtcdStore) Put(ctx context.Context, position []byte, key []byte, oldValue []byte, newValue []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(etcdKeyBucket)
+		if bucket == nil {
+			return errors.New("invalid etcd snapshot: bucket 'key' missing")
+		}
+		var kv mvccpb.KeyValue
+		if err := kv.Unmarshal(bucket.Get(position)); err != nil {
+			return errors.New("invalid etcd snapshot entry: " + err.Error())
+		}
+		if !bytes.Equal(kv.Key, key) || !bytes.Equal(kv.Value, oldValue) {
+			return errConflict
+		}
+		kv.Value = newValue
+		data, err := kv.Marshal()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(position, data)
+	})
+}
+
+/*Close closes the snapshot database. */
+func (s *snapshotEtcdStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/net/context"
+)
+
+/* writeTestSnapshot creates an etcd database with one revision per value, in order. */
+func writeTestSnapshot(t *testing.T, path string, values [][2]string) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(etcdKeyBucket)
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			/* etcd revision keys are the big endian main revision, '_' and the sub revision */
+			revision := make([]byte, 17)
+			binary.BigEndian.PutUint64(revision, uint64(i+1))
+			revision[8] = '_'
+
+			kv := mvccpb.KeyValue{Key: []byte(value[0]), Value: []byte(value[1]), CreateRevision: int64(i + 1), ModRevision: int64(i + 1), Version: 1}
+			data, err := kv.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(revision, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotEtcdStore_Migrate(t *testing.T) {
+	oldBackend := newTestBackendWithRandomKey(t)
+	newBackend := newTestBackendWithRandomKey(t)
+
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.db")
+
+	/* More values than a page, with entries outside of the prefix */
+	var values [][2]string
+	for i := 0; i < 2*etcdPageSize+10; i++ {
+		values = append(values, [2]string{fmt.Sprintf("/registry/secrets/default/s%d", i), string(newTestEnvelope(t, oldBackend, "smartkey", fmt.Sprintf("data-%d", i)))})
+		if i%3 == 0 {
+			values = append(values, [2]string{fmt.Sprintf("/other/%d", i), "other"})
+		}
+	}
+	writeTestSnapshot(t, snapshot, values)
+
+	store, err := newSnapshotEtcdStore(snapshot, "/registry/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := migrate(context.Background(), store, oldBackend, newBackend, migrationOptions{})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned != 2*etcdPageSize+10 || stats.Migrated != 2*etcdPageSize+10 || stats.Failed != 0 {
+		t.Error("Unexpected stats", stats)
+	}
+
+	store, err = newSnapshotEtcdStore(snapshot, "/registry/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	count := 0
+	store.Walk(context.Background(), nil, func(position []byte, key []byte, value []byte) error {
+		checkEnvelope(t, newBackend, value, fmt.Sprintf("data-%d", count))
+		count++
+		return nil
+	})
+	if count != 2*etcdPageSize+10 {
+		t.Error("Unexpected number of entries", count)
+	}
+}
+
+func TestSnapshotEtcdStore_Negative_Conflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.db")
+	writeTestSnapshot(t, snapshot, [][2]string{{"/registry/secrets/default/a", "value"}})
+
+	store, err := newSnapshotEtcdStore(snapshot, "/registry/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var position []byte
+	store.Walk(context.Background(), nil, func(p []byte, key []byte, value []byte) error {
+		position = p
+		return nil
+	})
+	if err := store.Put(context.Background(), position, []byte("/registry/secrets/default/a"), []byte("other"), []byte("new")); err != errConflict {
+		t.Error("Conflict expected, got", err)
+	}
+}
+
+/* startTestEtcd runs the etcd binary in a temporary directory, the test is skipped when etcd is not installed. */
+func startTestEtcd(t *testing.T) (string, func()) {
+	etcdPath, err := exec.LookPath("etcd")
+	if err != nil {
+		t.Skip("etcd binary not found")
+	}
+	dir, err := ioutil.TempDir("", "smartkey-kms-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := make([]string, 2)
+	for i := range ports {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = listener.Addr().String()
+		listener.Close()
+	}
+	clientURL := "http://" + ports[0]
+	peerURL := "http://" + ports[1]
+
+	cmd := exec.Command(etcdPath, "--data-dir", dir, "--listen-client-urls", clientURL, "--advertise-client-urls", clientURL,
+		"--listen-peer-urls", peerURL, "--initial-advertise-peer-urls", peerURL, "--initial-cluster", "default="+peerURL)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return clientURL, func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLiveEtcdStore_Migrate(t *testing.T) {
+	endpoint, stop := startTestEtcd(t)
+	defer stop()
+
+	oldBackend := newTestBackendWithRandomKey(t)
+	newBackend := newTestBackendWithRandomKey(t)
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := 0; i < etcdPageSize+10; i++ {
+		value := newTestEnvelope(t, oldBackend, "smartkey", fmt.Sprintf("data-%d", i))
+		if _, err := client.Put(ctx, fmt.Sprintf("/registry/secrets/default/s%03d", i), string(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := newLiveEtcdStore([]string{endpoint}, etcdTLSConfig{}, "/registry/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	stats, err := migrate(ctx, store, oldBackend, newBackend, migrationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Migrated != etcdPageSize+10 || stats.Failed != 0 {
+		t.Error("Unexpected stats", stats)
+	}
+
+	response, err := client.Get(ctx, "/registry/secrets/default/s000")
+	if err != nil || len(response.Kvs) != 1 {
+		t.Fatal("Unable to read migrated value", err)
+	}
+	checkEnvelope(t, newBackend, response.Kvs[0].Value, "data-0")
+}
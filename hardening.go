@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+const (
+	/* Values of the 'seccompFilter' config property */
+	seccompOff     = "off"
+	seccompLog     = "log"
+	seccompEnforce = "enforce"
+)
+
+/* parseSeccompMode parses the optional seccompFilter config property, off by default. */
+func parseSeccompMode(config map[string]string) (string, error) {
+	switch mode := config["seccompFilter"]; mode {
+	case "", seccompOff:
+		return seccompOff, nil
+	case seccompLog, seccompEnforce:
+		return mode, nil
+	}
+	return "", errors.New("property 'seccompFilter' must be off, log or enforce")
+}
+
+/* hardenProcess drops the capabilities of the process and installs the seccomp filter selected by the seccompFilter config property. It is called once the socket is listening, as nothing after needs privileges. */
+func hardenProcess(config map[string]string) error {
+	if os.Geteuid() == 0 {
+		log.Println("WARNING: running as root, run the plugin as an unprivileged user owning the socket directory")
+	}
+	if err := dropCapabilities(); err != nil {
+		log.Println("WARNING: Unable to drop capabilities:", err)
+	}
+
+	mode, err := parseSeccompMode(config)
+	if err != nil || mode == seccompOff {
+		return err
+	}
+	if err := installSeccompFilter(mode == seccompEnforce); err != nil {
+		return errors.New("unable to install seccomp filter: " + err.Error())
+	}
+	log.Println("Seccomp filter installed, mode", mode)
+	return nil
+}
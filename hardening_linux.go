@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	/* prctl options, from linux/prctl.h */
+	prCapBSetDrop        = 24
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+	/* Highest capability number checked when dropping the bounding set, the kernel rejects unknown ones */
+	maxCapability = 63
+	/* capset header version of 64 bit capability sets, from linux/capability.h */
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+/* dropCapabilities clears the bounding, ambient, effective, permitted and inheritable capability sets of every thread. Capabilities are per thread, so the binary must be built with CGO_ENABLED=0. */
+func dropCapabilities() error {
+	for capability := uintptr(0); capability <= maxCapability; capability++ {
+		_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prCapBSetDrop, capability, 0)
+		if errno == syscall.ENOTSUP {
+			return errors.New("capabilities of every thread can only be dropped by a binary built with CGO_ENABLED=0")
+		}
+		/* EINVAL past the last capability of the kernel, EPERM without CAP_SETPCAP when the bounding set is already reduced */
+		if errno != 0 && errno != syscall.EINVAL && errno != syscall.EPERM {
+			return errors.New("unable to drop capability bounding set: " + errno.Error())
+		}
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0); errno != 0 && errno != syscall.EINVAL {
+		return errors.New("unable to clear ambient capabilities: " + errno.Error())
+	}
+
+	header := capHeader{version: linuxCapabilityVersion3}
+	var data [2]capData
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errors.New("unable to clear capabilities: " + errno.Error())
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+/* runTestSubprocess runs the test named test in a new process with env set, for changes which cannot be undone in the test process. */
+func runTestSubprocess(t *testing.T, test string, env string) string {
+	cmd := exec.Command(os.Args[0], "-test.run=^"+test+"$", "-test.v")
+	cmd.Env = append(os.Environ(), env+"=1")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(test, "failed in subprocess:", err, string(output))
+	}
+	return string(output)
+}
+
+/* statusField returns a field of /proc/self/status. */
+func statusField(t *testing.T, name string) string {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, name+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, name+":"))
+		}
+	}
+	t.Fatal(name, "missing from /proc/self/status")
+	return ""
+}
+
+func TestDropCapabilities(t *testing.T) {
+	if os.Getenv("SMARTKEY_TEST_DROP_CAPABILITIES") == "" {
+		output := runTestSubprocess(t, "TestDropCapabilities", "SMARTKEY_TEST_DROP_CAPABILITIES")
+		if strings.Contains(output, "SKIP") {
+			t.Skip("capabilities can only be dropped without cgo")
+		}
+		return
+	}
+
+	if err := dropCapabilities(); err != nil {
+		if strings.Contains(err.Error(), "CGO_ENABLED=0") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	for _, field := range []string{"CapEff", "CapPrm", "CapInh", "CapAmb"} {
+		if value := statusField(t, field); value != "0000000000000000" {
+			t.Error(field, "should be empty, got", value)
+		}
+	}
+	if os.Geteuid() == 0 && statusField(t, "CapBnd") != "0000000000000000" {
+		t.Error("Bounding set should be empty, got", statusField(t, "CapBnd"))
+	}
+}
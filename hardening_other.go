@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+/* dropCapabilities is only implemented on Linux. */
+func dropCapabilities() error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSeccompMode(t *testing.T) {
+	for value, expected := range map[string]string{"": seccompOff, "off": seccompOff, "log": seccompLog, "enforce": seccompEnforce} {
+		mode, err := parseSeccompMode(map[string]string{"seccompFilter": value})
+		if err != nil || mode != expected {
+			t.Error("seccompFilter", value, "should be", expected, err)
+		}
+	}
+	if _, err := parseSeccompMode(map[string]string{"seccompFilter": "strict"}); err == nil {
+		t.Error("Test case should fail as the seccomp mode is unknown")
+	}
+}
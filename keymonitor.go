@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	/* Interval between two checks of the key when keyMonitorInterval is not configured */
+	defaultKeyMonitorInterval = time.Hour
+	/* Warnings logged when keyExpiryWarnings is not configured: 30, 7 and 1 days before deactivation */
+	defaultKeyExpiryWarnings = "720h,168h,24h"
+	/* Readiness is degraded this long before deactivation when keyExpiryDegraded is not configured */
+	defaultKeyExpiryDegraded = 24 * time.Hour
+	/* Timeout of a key metadata fetch */
+	keyMonitorTimeout = 30 * time.Second
+)
+
+/* keyMonitorMetrics exposes the time to the key deactivation, readiness and failed checks on /debug/vars */
+var keyMonitorMetrics = expvar.NewMap("key_monitor")
+
+/*keyMonitor periodically fetches the key metadata, warns before the key deactivation date and degrades readiness before the key becomes unusable. */
+type keyMonitor struct {
+	backend  Backend
+	interval time.Duration
+	/* warning thresholds, longest first */
+	warnings []time.Duration
+	degraded time.Duration
+	now      func() time.Time
+
+	mutex  sync.Mutex
+	ready  bool
+	reason string
+	/* warning thresholds already logged for the current deactivation date */
+	warned map[time.Duration]bool
+}
+
+/* newKeyMonitor reads the optional keyMonitorInterval, keyExpiryWarnings (comma separated durations) and keyExpiryDegraded config properties. */
+func newKeyMonitor(backend Backend, config map[string]string) (*keyMonitor, error) {
+	interval, err := parseDurationProperty(config, "keyMonitorInterval", defaultKeyMonitorInterval)
+	if err != nil {
+		return nil, err
+	}
+	degraded, err := parseDurationProperty(config, "keyExpiryDegraded", defaultKeyExpiryDegraded)
+	if err != nil {
+		return nil, err
+	}
+
+	warningsValue, isPresent := config["keyExpiryWarnings"]
+	if !isPresent {
+		warningsValue = defaultKeyExpiryWarnings
+	}
+	var warnings []time.Duration
+	for _, value := range strings.Split(warningsValue, ",") {
+		if len(strings.TrimSpace(value)) == 0 {
+			continue
+		}
+		warning, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || warning <= 0 {
+			return nil, errors.New("property 'keyExpiryWarnings' must be a comma separated list of positive durations, eg. 720h,168h,24h")
+		}
+		warnings = append(warnings, warning)
+	}
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i] > warnings[j] })
+
+	return &keyMonitor{
+		backend:  backend,
+		interval: interval,
+		warnings: warnings,
+		degraded: degraded,
+		now:      time.Now,
+		ready:    true,
+		warned:   make(map[time.Duration]bool),
+	}, nil
+}
+
+/* run checks the key every interval until stop is closed. */
+func (m *keyMonitor) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+/* check fetches the key metadata and updates readiness and metrics. A failed fetch keeps the previous state, SmartKey may be briefly unavailable. */
+func (m *keyMonitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), keyMonitorTimeout)
+	defer cancel()
+
+	key, err := m.backend.KeyInfo(ctx)
+	if err != nil {
+		keyMonitorMetrics.Add("check_failures", 1)
+		log.Println("Key monitor: unable to fetch key metadata:", err)
+		return
+	}
+	now := m.now()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := checkKeyCapabilities(key, now); err != nil {
+		m.setReady(false, "encryption key is unusable: "+err.Error())
+		log.Println("WARNING: Key monitor:", m.reason)
+		return
+	}
+	if len(key.DeactivationDate) == 0 {
+		keyMonitorMetrics.Delete("expiry_seconds")
+		m.warned = make(map[time.Duration]bool)
+		m.setReady(true, "")
+		return
+	}
+
+	deactivation, _ := parseSmartKeyDate(key.DeactivationDate)
+	remaining := deactivation.Sub(now)
+	keyMonitorMetrics.Set("expiry_seconds", expvarFloat(remaining.Seconds()))
+
+	/* Warn once for the closest threshold crossed, again if the deactivation date is moved past a threshold */
+	var crossed time.Duration
+	for _, warning := range m.warnings {
+		if remaining > warning {
+			delete(m.warned, warning)
+			continue
+		}
+		crossed = warning
+	}
+	if crossed > 0 && !m.warned[crossed] {
+		for _, warning := range m.warnings {
+			if warning >= crossed {
+				m.warned[warning] = true
+			}
+		}
+		log.Printf("WARNING: Key monitor: encryption key deactivates on %s, in %s, rotate it before then", deactivation.Format(time.RFC3339), formatRemaining(remaining))
+	}
+
+	if remaining <= m.degraded {
+		m.setReady(false, fmt.Sprintf("encryption key deactivates on %s, in %s", deactivation.Format(time.RFC3339), formatRemaining(remaining)))
+		return
+	}
+	m.setReady(true, "")
+}
+
+/* setReady records the readiness, must be called with the lock held. */
+func (m *keyMonitor) setReady(ready bool, reason string) {
+	m.ready = ready
+	m.reason = reason
+	if ready {
+		keyMonitorMetrics.Set("ready", expvarInt(1))
+	} else {
+		keyMonitorMetrics.Set("ready", expvarInt(0))
+	}
+}
+
+/* readiness returns false and the reason when the key is unusable or about to be. */
+func (m *keyMonitor) readiness() (bool, string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.ready, m.reason
+}
+
+/* serveReadiness handles /readyz on the debug HTTP server. */
+func (m *keyMonitor) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	ready, reason := m.readiness()
+	if !ready {
+		http.Error(w, "degraded: "+reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+/* formatRemaining formats a duration in days and hours. */
+func formatRemaining(remaining time.Duration) string {
+	if remaining < 24*time.Hour {
+		return remaining.Round(time.Minute).String()
+	}
+	return fmt.Sprintf("%dd%dh", int(remaining.Hours())/24, int(remaining.Hours())%24)
+}
+
+/* parseDurationProperty reads a positive duration config property. */
+func parseDurationProperty(config map[string]string, property string, defaultValue time.Duration) (time.Duration, error) {
+	value, isPresent := config[property]
+	if !isPresent {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, errors.New("property '" + property + "' must be a positive duration, eg. 1h")
+	}
+	return duration, nil
+}
+
+func expvarInt(value int64) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(value)
+	return v
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+/* keyInfoBackend returns the configured key metadata or error from KeyInfo. */
+type keyInfoBackend struct {
+	blockingBackend
+	key *KeyObject
+	err error
+}
+
+func (b *keyInfoBackend) KeyInfo(ctx context.Context) (*KeyObject, error) {
+	return b.key, b.err
+}
+
+func newTestKeyMonitor(t *testing.T, backend Backend, now time.Time, config map[string]string) *keyMonitor {
+	monitor, err := newKeyMonitor(backend, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor.now = func() time.Time { return now }
+	return monitor
+}
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &output
+}
+
+func TestKeyMonitor_Positive_Warnings(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	backend := &keyInfoBackend{key: &KeyObject{ObjType: "AES", KeySize: 256, Enabled: true, KeyOps: requiredKeyOps, DeactivationDate: "20240610T000000Z"}}
+	monitor := newTestKeyMonitor(t, backend, now, map[string]string{})
+	output := captureLog(t)
+
+	/* 9 days left, below the 30 days threshold only */
+	monitor.check()
+	if strings.Count(output.String(), "WARNING") != 1 || !strings.Contains(output.String(), "9d0h") {
+		t.Error("One warning expected, got", output.String())
+	}
+	if value := keyMonitorMetrics.Get("expiry_seconds"); value == nil || value.String() != "777600" {
+		t.Error("Time to expiry metric expected, got", value)
+	}
+	if ready, _ := monitor.readiness(); !ready {
+		t.Error("Readiness should not be degraded 9 days before deactivation")
+	}
+
+	/* The same threshold is not logged twice */
+	monitor.check()
+	if strings.Count(output.String(), "WARNING") != 1 {
+		t.Error("Warning should be logged once per threshold")
+	}
+
+	/* 5 days left crosses the 7 days threshold */
+	monitor.now = func() time.Time { return now.Add(4 * 24 * time.Hour) }
+	monitor.check()
+	if strings.Count(output.String(), "WARNING") != 2 {
+		t.Error("Second warning expected, got", output.String())
+	}
+
+	/* The key is extended, no more warnings */
+	backend.key.DeactivationDate = "20250610T000000Z"
+	monitor.check()
+	if strings.Count(output.String(), "WARNING") != 2 || len(monitor.warned) != 0 {
+		t.Error("Extended key should not be warned about")
+	}
+}
+
+func TestKeyMonitor_Negative_Degraded(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	backend := &keyInfoBackend{key: &KeyObject{ObjType: "AES", KeySize: 256, Enabled: true, KeyOps: requiredKeyOps, DeactivationDate: "20240601T120000Z"}}
+	monitor := newTestKeyMonitor(t, backend, now, map[string]string{"keyExpiryDegraded": "48h"})
+	captureLog(t)
+
+	monitor.check()
+	recorder := httptest.NewRecorder()
+	monitor.serveReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "deactivates on 2024-06-01T12:00:00Z") {
+		t.Error("Readiness should be degraded before deactivation, got", recorder.Code, recorder.Body.String())
+	}
+	if keyMonitorMetrics.Get("ready").String() != "0" {
+		t.Error("Readiness metric should be 0")
+	}
+
+	/* A failed fetch keeps the previous state */
+	backend.err = errors.New("SmartKey unavailable")
+	monitor.check()
+	if ready, _ := monitor.readiness(); ready {
+		t.Error("Failed check should not change readiness")
+	}
+
+	/* A disabled key is unusable */
+	backend.err = nil
+	backend.key = &KeyObject{ObjType: "AES", KeySize: 256, KeyOps: requiredKeyOps}
+	monitor.check()
+	if ready, reason := monitor.readiness(); ready || !strings.Contains(reason, "disabled") {
+		t.Error("Disabled key should degrade readiness, got", reason)
+	}
+
+	/* The key is enabled again without deactivation date */
+	backend.key.Enabled = true
+	monitor.check()
+	recorder = httptest.NewRecorder()
+	monitor.serveReadiness(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK || keyMonitorMetrics.Get("expiry_seconds") != nil {
+		t.Error("Readiness should be restored, got", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestKeyMonitor_Positive_SmartKey(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	captureLog(t)
+
+	deactivation := time.Now().Add(time.Hour).UTC().Format(smartKeyDateFormat)
+	smartkey.UpdateKey("uuid-1", func(key *smartkeytest.Key) { key.DeactivationDate = deactivation })
+
+	config["keyMonitorInterval"] = "10ms"
+	monitor, err := newKeyMonitor(newTestSmartKeyBackend(t, config), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go monitor.run(stop)
+	defer close(stop)
+
+	for i := 0; i < 100 && smartkey.RequestCount("get") < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ready, reason := monitor.readiness(); ready || !strings.Contains(reason, "deactivates") {
+		t.Error("Key deactivating within a day should degrade readiness, got", reason)
+	}
+}
+
+func TestKeyMonitor_Negative_InvalidConfig(t *testing.T) {
+	for property, value := range map[string]string{
+		"keyMonitorInterval": "often",
+		"keyExpiryDegraded":  "-1h",
+		"keyExpiryWarnings":  "720h,soon",
+	} {
+		if _, err := newKeyMonitor(nil, map[string]string{property: value}); err == nil {
+			t.Errorf("Test case should fail as %s is %q", property, value)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+/* Prefix of ciphers carrying the id of the SmartKey key which encrypted them: "smartkey:<kid>:<base64 cipher>". Ciphers without it were encrypted with encryptionKeyUuid. */
+const keyCipherPrefix = "smartkey:"
+
+/* Precision of the last used time of keys, the state file is written at most once per key and interval */
+const keyUsageResolution = time.Hour
+
+/* Label of the state file HMAC key derived from the SmartKey API key when stateFileHmacKey is not configured */
+const stateFileMacLabel = "smartkey-kubernetes-kms state file"
+
+/* formatKeyCipher prefixes a cipher with the id of its key. */
+func formatKeyCipher(kid string, cipher []byte) []byte {
+	data := make([]byte, 0, len(keyCipherPrefix)+len(kid)+1+len(cipher))
+	data = append(data, keyCipherPrefix...)
+	data = append(data, kid...)
+	data = append(data, ':')
+	return append(data, cipher...)
+}
+
+/* parseKeyCipher returns the key id and cipher of a cipher produced by formatKeyCipher, or false for legacy ciphers. */
+func parseKeyCipher(data []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(data, []byte(keyCipherPrefix)) {
+		return "", data, false
+	}
+	rest := data[len(keyCipherPrefix):]
+	separator := bytes.IndexByte(rest, ':')
+	if separator <= 0 || !isKeyID(string(rest[:separator])) {
+		return "", data, false
+	}
+	return string(rest[:separator]), rest[separator+1:], true
+}
+
+/* isKeyID checks a key id only has the characters of SmartKey uuids, it is used in SmartKey URL paths. */
+func isKeyID(kid string) bool {
+	if len(kid) == 0 {
+		return false
+	}
+	for _, c := range kid {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+/*keyRecord is a key which encrypted data, Created is when it was added to the ring. */
+type keyRecord struct {
+	Kid       string     `json:"kid"`
+	Name      string     `json:"name,omitempty"`
+	Created   time.Time  `json:"created"`
+	FirstUsed *time.Time `json:"firstUsed,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+/*keyRingState is persisted in the state file. */
+type keyRingState struct {
+	Primary string `json:"primary"`
+	/* Legacy is the key of ciphers without key id, encryptionKeyUuid when the state file was created */
+	Legacy string      `json:"legacy"`
+	Keys   []keyRecord `json:"keys"`
+}
+
+/*signedKeyRingState is the content of the state file, the HMAC-SHA256 of the compact JSON of State protects it from changes. */
+type signedKeyRingState struct {
+	State json.RawMessage `json:"state"`
+	HMAC  string          `json:"hmac"`
+}
+
+/*keyRing is the primary key encrypting new data and the previous keys, persisted in a state file. */
+type keyRing struct {
+	path   string
+	macKey []byte
+	/* the state file was signed with the previous MAC key, it is signed again by loadKeyRing */
+	resign bool
+
+	mutex sync.RWMutex
+	state keyRingState
+}
+
+/* stateFileMacKey returns the key signing the state file: the optional stateFileHmacKey config property (base64, at least 32 bytes), or a key derived from smartkeyApiKey. */
+func stateFileMacKey(config map[string]string) ([]byte, error) {
+	if encoded, isPresent := config["stateFileHmacKey"]; isPresent {
+		macKey, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(macKey) < 32 {
+			return nil, errors.New("property 'stateFileHmacKey' must be at least 32 bytes encoded in base64")
+		}
+		return macKey, nil
+	}
+	return derivedStateFileMacKey(config), nil
+}
+
+/* previousStateFileMacKey returns the key derived from smartkeyApiKey when stateFileHmacKey is set, so state files signed before it was set can still be verified, nil otherwise. */
+func previousStateFileMacKey(config map[string]string) []byte {
+	if _, isPresent := config["stateFileHmacKey"]; !isPresent {
+		return nil
+	}
+	return derivedStateFileMacKey(config)
+}
+
+func derivedStateFileMacKey(config map[string]string) []byte {
+	mac := hmac.New(sha256.New, []byte(config["smartkeyApiKey"]))
+	mac.Write([]byte(stateFileMacLabel))
+	return mac.Sum(nil)
+}
+
+/* loadKeyRing reads the state file, it is created with configuredKid as primary key when missing. A state file signed with previousMacKey is signed again with macKey. When configuredKid is not in the ring, encryptionKeyUuid was changed and configuredKid becomes primary. */
+func loadKeyRing(path string, macKey []byte, previousMacKey []byte, configuredKid string, now time.Time) (*keyRing, error) {
+	r, err := readKeyRing(path, macKey, previousMacKey)
+	if os.IsNotExist(err) {
+		r = &keyRing{path: path, macKey: macKey}
+		r.state = keyRingState{Primary: configuredKid, Legacy: configuredKid, Keys: []keyRecord{{Kid: configuredKid, Created: now}}}
+		return r, r.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.resign {
+		if err := r.save(); err != nil {
+			return nil, err
+		}
+		r.resign = false
+		log.Println("State file", path, "was signed with the key derived from smartkeyApiKey, it is now signed with stateFileHmacKey")
+	}
+
+	if _, ok := r.find(configuredKid); !ok {
+		log.Println("Key", configuredKid, "of encryptionKeyUuid is not in state file", path+", it becomes the primary key")
+		if err := r.promote(keyRecord{Kid: configuredKid, Created: now}); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+/* readKeyRing reads and verifies the state file without changing it, the error satisfies os.IsNotExist when the file is missing. A file signed with the optional previousMacKey is accepted and marked to be signed again with macKey. */
+func readKeyRing(path string, macKey []byte, previousMacKey []byte) (*keyRing, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.New("unable to read state file " + path + ": " + err.Error())
+	}
+
+	var signed signedKeyRingState
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, errors.New("unable to parse state file " + path + ": " + err.Error())
+	}
+	var state bytes.Buffer
+	if err := json.Compact(&state, signed.State); err != nil {
+		return nil, errors.New("unable to parse state file " + path + ": " + err.Error())
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.HMAC)
+	if err != nil {
+		return nil, errors.New("state file " + path + " has an invalid signature: " + err.Error())
+	}
+	r := &keyRing{path: path, macKey: macKey}
+	if !hmac.Equal(signature, signState(macKey, state.Bytes())) {
+		if previousMacKey == nil || !hmac.Equal(signature, signState(previousMacKey, state.Bytes())) {
+			return nil, errors.New("state file " + path + " has an invalid signature, it was modified or signed with another key")
+		}
+		r.resign = true
+	}
+
+	if err := json.Unmarshal(state.Bytes(), &r.state); err != nil {
+		return nil, errors.New("unable to parse state file " + path + ": " + err.Error())
+	}
+	if _, ok := r.find(r.state.Primary); !ok {
+		return nil, errors.New("invalid state file " + path + ": primary key " + r.state.Primary + " is not in the key list")
+	}
+	if _, ok := r.find(r.state.Legacy); !ok {
+		return nil, errors.New("invalid state file " + path + ": legacy key " + r.state.Legacy + " is not in the key list")
+	}
+	return r, nil
+}
+
+/* validateKeys checks the keys of the plugin at startup. Without state file encryptionKeyUuid is validated by validateKey. With a state file, the key which will be primary must permit every operation of the plugin while the legacy and previous keys must only still decrypt, they may be deactivated. */
+func validateKeys(config map[string]string) error {
+	stateFile, isPresent := config["stateFile"]
+	if !isPresent {
+		_, err := validateKey(config)
+		return err
+	}
+	macKey, err := stateFileMacKey(config)
+	if err != nil {
+		return err
+	}
+	r, err := readKeyRing(stateFile, macKey, previousStateFileMacKey(config))
+	if os.IsNotExist(err) {
+		_, err := validateKey(config)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	/* loadKeyRing promotes encryptionKeyUuid when it is not in the ring */
+	primary := r.primary().Kid
+	records := r.keys()
+	if _, ok := r.find(config["encryptionKeyUuid"]); !ok {
+		primary = config["encryptionKeyUuid"]
+		records = append(records, keyRecord{Kid: primary})
+	}
+	for _, record := range records {
+		key, err := getKeyByID(context.Background(), config, record.Kid)
+		if err != nil {
+			return errors.New("encryption key " + record.Kid + " validation failed: " + err.Error())
+		}
+		if record.Kid == primary {
+			err = checkKeyCapabilities(key, time.Now())
+		} else {
+			err = checkDecryptCapabilities(key)
+		}
+		if err != nil {
+			return errors.New("encryption key " + record.Kid + " validation failed: " + err.Error())
+		}
+	}
+	return nil
+}
+
+/* parseTrustedKeyIDs reads the optional trustedKeyIds config property, a comma separated list of keys whose ciphers are decrypted although they are not in the key ring, eg. keys of other plugin instances. */
+func parseTrustedKeyIDs(config map[string]string) (map[string]bool, error) {
+	trusted := map[string]bool{}
+	if len(strings.TrimSpace(config["trustedKeyIds"])) == 0 {
+		return trusted, nil
+	}
+	for _, kid := range strings.Split(config["trustedKeyIds"], ",") {
+		kid = strings.TrimSpace(kid)
+		if !isKeyID(kid) {
+			return nil, errors.New("property 'trustedKeyIds' must be a comma separated list of key uuids")
+		}
+		trusted[kid] = true
+	}
+	return trusted, nil
+}
+
+/* primary returns the key encrypting new data. */
+func (r *keyRing) primary() keyRecord {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	record, _ := r.find(r.state.Primary)
+	return record
+}
+
+/* legacyKid returns the key of ciphers without key id. */
+func (r *keyRing) legacyKid() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.state.Legacy
+}
+
+/* keys returns every key in the ring, oldest first. */
+func (r *keyRing) keys() []keyRecord {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]keyRecord(nil), r.state.Keys...)
+}
+
+/* promote makes a key primary, adding it to the ring unless it is already there, and saves the state file. Previous keys are kept to decrypt existing data. */
+func (r *keyRing) promote(record keyRecord) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous := r.state
+	keys := append([]keyRecord(nil), previous.Keys...)
+	if _, ok := r.find(record.Kid); !ok {
+		keys = append(keys, record)
+	}
+	r.state = keyRingState{Primary: record.Kid, Legacy: previous.Legacy, Keys: keys}
+	if err := r.save(); err != nil {
+		r.state = previous
+		return err
+	}
+	return nil
+}
+
+/* has returns whether a key is in the ring. */
+func (r *keyRing) has(kid string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	_, ok := r.find(kid)
+	return ok
+}
+
+/* add adds a key which is not primary to the ring, such as a key of another plugin instance, and saves the state file. */
+func (r *keyRing) add(record keyRecord) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.find(record.Kid); ok {
+		return nil
+	}
+	previous := r.state.Keys
+	r.state.Keys = append(append([]keyRecord(nil), previous...), record)
+	if err := r.save(); err != nil {
+		r.state.Keys = previous
+		return err
+	}
+	return nil
+}
+
+/* recordUse updates the first and last used times of a key of the ring. The state file is saved when a time changes by keyUsageResolution. */
+func (r *keyRing) recordUse(kid string, now time.Time) error {
+	r.mutex.RLock()
+	record, ok := r.find(kid)
+	r.mutex.RUnlock()
+	if ok && record.LastUsed != nil && now.Sub(*record.LastUsed) < keyUsageResolution {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	index := -1
+	for i := range r.state.Keys {
+		if r.state.Keys[i].Kid == kid {
+			index = i
+		}
+	}
+	if index < 0 {
+		return errors.New("key " + kid + " is not in the key ring")
+	}
+
+	record = r.state.Keys[index]
+	if record.LastUsed != nil && now.Sub(*record.LastUsed) < keyUsageResolution {
+		return nil
+	}
+	if record.FirstUsed == nil {
+		record.FirstUsed = &now
+	}
+	record.LastUsed = &now
+	r.state.Keys[index] = record
+	return r.save()
+}
+
+/* find returns the record of a key, must be called with the lock held. */
+func (r *keyRing) find(kid string) (keyRecord, bool) {
+	for _, record := range r.state.Keys {
+		if record.Kid == kid {
+			return record, true
+		}
+	}
+	return keyRecord{}, false
+}
+
+/* save signs and writes the state file, must be called with the lock held or before the ring is shared. */
+func (r *keyRing) save() error {
+	state, err := json.Marshal(&r.state)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&signedKeyRingState{
+		State: state,
+		HMAC:  base64.StdEncoding.EncodeToString(signState(r.macKey, state)),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, data)
+}
+
+/* signState returns the HMAC-SHA256 of the compact JSON state. */
+func signState(macKey []byte, state []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(state)
+	return mac.Sum(nil)
+}
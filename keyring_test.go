@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyCipher(t *testing.T) {
+	data := formatKeyCipher("uuid-2", []byte("Y2lwaGVy"))
+	if string(data) != "smartkey:uuid-2:Y2lwaGVy" {
+		t.Error("Unexpected cipher format", string(data))
+	}
+	kid, cipher, ok := parseKeyCipher(data)
+	if !ok || kid != "uuid-2" || string(cipher) != "Y2lwaGVy" {
+		t.Error("Key cipher should be parsed", kid, string(cipher))
+	}
+
+	/* Legacy ciphers are base64 encoded and never contain the prefix */
+	for _, legacy := range []string{"Y2lwaGVy", "smartkey:", "smartkey::Y2lwaGVy", "smartkey:../sys:Y2lwaGVy"} {
+		if _, cipher, ok := parseKeyCipher([]byte(legacy)); ok || !bytes.Equal(cipher, []byte(legacy)) {
+			t.Errorf("%q should be a legacy cipher", legacy)
+		}
+	}
+}
+
+func TestKeyRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	macKey, _ := stateFileMacKey(map[string]string{"smartkeyApiKey": "api-key"})
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	/* A missing state file starts with the configured key */
+	ring, err := loadKeyRing(path, macKey, nil, "uuid-1", created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.primary().Kid != "uuid-1" || ring.legacyKid() != "uuid-1" || !ring.primary().Created.Equal(created) {
+		t.Error("Configured key should be primary", ring.primary())
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("State file should be created for its owner only", err)
+	}
+
+	if err := ring.promote(keyRecord{Kid: "uuid-2", Name: "rotated", Created: created.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The state file wins over the configured key */
+	ring, err = loadKeyRing(path, macKey, nil, "uuid-1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.primary().Kid != "uuid-2" || ring.legacyKid() != "uuid-1" || len(ring.keys()) != 2 || ring.keys()[0].Kid != "uuid-1" {
+		t.Error("Key list should be persisted", ring.keys())
+	}
+
+	/* A new encryptionKeyUuid becomes primary, legacy ciphers still use the first key */
+	ring, err = loadKeyRing(path, macKey, nil, "uuid-3", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.primary().Kid != "uuid-3" || ring.legacyKid() != "uuid-1" || len(ring.keys()) != 3 {
+		t.Error("Changed encryptionKeyUuid should be promoted", ring.keys())
+	}
+}
+
+func TestKeyRing_RecordUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	macKey, _ := stateFileMacKey(map[string]string{"smartkeyApiKey": "api-key"})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ring, err := loadKeyRing(path, macKey, nil, "uuid-1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.primary().FirstUsed != nil || ring.primary().LastUsed != nil {
+		t.Error("New key should never have been used")
+	}
+
+	ring.recordUse("uuid-1", now)
+	ring.recordUse("uuid-1", now.Add(time.Minute))
+	ring.recordUse("uuid-1", now.Add(2*time.Hour))
+	/* Key encrypted by another plugin instance */
+	if err := ring.recordUse("uuid-2", now.Add(3*time.Hour)); err == nil || ring.has("uuid-2") {
+		t.Error("Use of a key not in the ring should be rejected", err)
+	}
+	ring.add(keyRecord{Kid: "uuid-2", Created: now})
+	ring.add(keyRecord{Kid: "uuid-2", Created: now})
+	ring.recordUse("uuid-2", now.Add(3*time.Hour))
+
+	ring, err = readKeyRing(path, macKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ring.keys()
+	if len(keys) != 2 || !keys[0].FirstUsed.Equal(now) || !keys[0].LastUsed.Equal(now.Add(2*time.Hour)) {
+		t.Error("Use times should be persisted at an hour precision", keys)
+	}
+	if keys[1].Kid != "uuid-2" || !keys[1].FirstUsed.Equal(now.Add(3*time.Hour)) || ring.primary().Kid != "uuid-1" {
+		t.Error("Keys used by other instances should be recorded without becoming primary", keys)
+	}
+}
+
+func TestKeyRing_Negative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	macKey, _ := stateFileMacKey(map[string]string{"smartkeyApiKey": "api-key"})
+
+	if _, err := loadKeyRing(path, macKey, nil, "uuid-1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+
+	otherKey, _ := stateFileMacKey(map[string]string{"smartkeyApiKey": "other-api-key"})
+	if _, err := readKeyRing(path, otherKey, nil); err == nil {
+		t.Error("Test case should fail as the state file is signed with another key")
+	}
+
+	ioutil.WriteFile(path, bytes.Replace(data, []byte("uuid-1"), []byte("uuid-9"), -1), 0600)
+	if _, err := readKeyRing(path, macKey, nil); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Error("Test case should fail as the state file was modified", err)
+	}
+
+	ring := &keyRing{path: path, macKey: macKey, state: keyRingState{Primary: "uuid-3", Legacy: "uuid-1", Keys: []keyRecord{{Kid: "uuid-1"}}}}
+	ring.save()
+	if _, err := readKeyRing(path, macKey, nil); err == nil {
+		t.Error("Test case should fail as the primary key is not in the key list")
+	}
+	ioutil.WriteFile(path, []byte(`{"state"`), 0600)
+	if _, err := readKeyRing(path, macKey, nil); err == nil {
+		t.Error("Test case should fail as the state file is invalid")
+	}
+
+	if _, err := stateFileMacKey(map[string]string{"stateFileHmacKey": "c2hvcnQ="}); err == nil {
+		t.Error("Test case should fail as the HMAC key is too short")
+	}
+}
+
+func TestKeyRing_Positive_HmacKeyUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	/* State file signed before stateFileHmacKey was set */
+	config := map[string]string{"smartkeyApiKey": "api-key"}
+	derivedKey, _ := stateFileMacKey(config)
+	if _, err := loadKeyRing(path, derivedKey, previousStateFileMacKey(config), "uuid-1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	config["stateFileHmacKey"] = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	macKey, _ := stateFileMacKey(config)
+	if _, err := readKeyRing(path, macKey, nil); err == nil {
+		t.Error("Test case should fail without the previous key")
+	}
+	ring, err := loadKeyRing(path, macKey, previousStateFileMacKey(config), "uuid-1", time.Now())
+	if err != nil || ring.primary().Kid != "uuid-1" {
+		t.Fatal("State file signed with the derived key should be accepted", err)
+	}
+
+	/* Signed again, the API key can now change */
+	if ring, err := readKeyRing(path, macKey, nil); err != nil || ring.resign {
+		t.Error("State file should be signed with stateFileHmacKey", err)
+	}
+	config["smartkeyApiKey"] = "new-api-key"
+	if _, err := readKeyRing(path, macKey, previousStateFileMacKey(config)); err != nil {
+		t.Error("State file should be verified after the API key changed", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+)
+
+/* Label of DEKs encrypted without key id, by the legacy key of the state file or before the state file was configured */
+const noKeyIDLabel = "(no key id)"
+
+/* Successful Decrypt calls per SmartKey key id taken from the cipher, on /debug/vars */
+var keyDecryptMetrics = expvar.NewMap("key_decrypts")
+
+/* countKeyDecrypt counts a successful Decrypt call under the SmartKey key of its cipher. Only keys of the ring, or encryptionKeyUuid without ring, are counted so callers cannot add arbitrary key ids to the metric. */
+func countKeyDecrypt(backend Backend, data []byte) {
+	smartKey, ok := smartKeyBackendOf(backend)
+	if !ok {
+		return
+	}
+	if primary, _, ok := parseDualCipher(data); ok {
+		data = primary
+	}
+	if kid, ok := smartKey.knownKid(data); ok {
+		keyDecryptMetrics.Add(kid, 1)
+	}
+}
+
+/*keyUsage lists the etcd values referencing a key. */
+type keyUsage struct {
+	Kid string
+	/* etcd keys of the resources, sorted */
+	Resources []string
+	/* revisions of these resources in the store, a resource may have several revisions in a snapshot */
+	Revisions int
+}
+
+/*keyUsageScan is the result of scanKeyUsage. */
+type keyUsageScan struct {
+	Keys []keyUsage
+	/* KMS values which could not be parsed */
+	Invalid int
+}
+
+/* scanKeyUsage groups the KMS encrypted values of store by the key id of their DEK cipher, only values of providerName when set. */
+func scanKeyUsage(ctx context.Context, store kvStore, providerName string) (*keyUsageScan, error) {
+	resources := make(map[string]map[string]bool)
+	revisions := make(map[string]int)
+	scan := &keyUsageScan{}
+
+	err := store.Walk(ctx, nil, func(position []byte, key []byte, value []byte) error {
+		envelope, isKMS, err := parseKMSEnvelope(value)
+		if !isKMS {
+			return nil
+		}
+		if err != nil {
+			scan.Invalid++
+			return nil
+		}
+		if len(providerName) > 0 && envelope.providerName != providerName {
+			return nil
+		}
+
+		encryptedDEK := envelope.encryptedDEK
+		if primary, _, ok := parseDualCipher(encryptedDEK); ok {
+			encryptedDEK = primary
+		}
+		kid, _, ok := parseKeyCipher(encryptedDEK)
+		if !ok {
+			kid = noKeyIDLabel
+		}
+		if resources[kid] == nil {
+			resources[kid] = make(map[string]bool)
+		}
+		resources[kid][string(key)] = true
+		revisions[kid]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for kid, keys := range resources {
+		usage := keyUsage{Kid: kid, Revisions: revisions[kid]}
+		for key := range keys {
+			usage.Resources = append(usage.Resources, key)
+		}
+		sort.Strings(usage.Resources)
+		scan.Keys = append(scan.Keys, usage)
+	}
+	sort.Slice(scan.Keys, func(i, j int) bool { return scan.Keys[i].Kid < scan.Keys[j].Kid })
+	return scan, nil
+}
+
+/* fetchKeyDecrypts reads the key_decrypts metric from the debug HTTP server of a running plugin. */
+func fetchKeyDecrypts(debugAddr string) (map[string]int64, error) {
+	client := &http.Client{Timeout: commandTimeout}
+	response, err := client.Get("http://" + debugAddr + "/debug/vars")
+	if err != nil {
+		return nil, errors.New("unable to reach the plugin debug server: " + err.Error())
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status from the plugin debug server: " + response.Status)
+	}
+
+	var vars struct {
+		KeyDecrypts map[string]int64 `json:"key_decrypts"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&vars); err != nil {
+		return nil, errors.New("invalid response from the plugin debug server: " + err.Error())
+	}
+	return vars.KeyDecrypts, nil
+}
+
+/* runKeyUsage handles the key-usage command: Decrypt calls per key of a running plugin, or the resources per key of an etcd snapshot. */
+func runKeyUsage(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("key-usage", flag.ContinueOnError)
+	debugAddr := flags.String("debugAddr", defaultDebugListenAddr, "debug HTTP address of the running plugin")
+	snapshot := flags.String("snapshot", "", "etcd snapshot file to scan for resources encrypted under each key")
+	prefix := flags.String("prefix", "/registry/", "etcd key prefix of the apiserver objects")
+	providerName := flags.String("providerName", "", "only scan values of this KMS provider name")
+	resources := flags.Bool("resources", false, "list the resources of each key found in the snapshot")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	if len(*snapshot) == 0 {
+		decrypts, err := fetchKeyDecrypts(*debugAddr)
+		if err != nil {
+			return err
+		}
+		var kids []string
+		for kid := range decrypts {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		fmt.Fprintln(writer, "KID\tDECRYPTS")
+		for _, kid := range kids {
+			fmt.Fprintf(writer, "%s\t%d\n", kid, decrypts[kid])
+		}
+		return writer.Flush()
+	}
+
+	store, err := newSnapshotEtcdStore(*snapshot, *prefix, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	scan, err := scanKeyUsage(context.Background(), store, *providerName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(writer, "KID\tRESOURCES\tREVISIONS")
+	for _, usage := range scan.Keys {
+		fmt.Fprintf(writer, "%s\t%d\t%d\n", usage.Kid, len(usage.Resources), usage.Revisions)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if scan.Invalid > 0 {
+		fmt.Fprintf(stdout, "%d KMS values could not be parsed\n", scan.Invalid)
+	}
+	if *resources {
+		for _, usage := range scan.Keys {
+			fmt.Fprintln(stdout, "\n"+usage.Kid+":")
+			for _, resource := range usage.Resources {
+				fmt.Fprintln(stdout, "  "+resource)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+/* newTestKeyEnvelope returns an envelope value whose DEK cipher is encryptedDEK. */
+func newTestKeyEnvelope(t *testing.T, providerName string, encryptedDEK string) string {
+	value, err := (&kmsEnvelope{providerName: providerName, encryptedDEK: []byte(encryptedDEK), data: []byte("data")}).bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(value)
+}
+
+func TestScanKeyUsage(t *testing.T) {
+	store := newMemStore()
+	store.values["/registry/secrets/default/a"] = []byte(newTestKeyEnvelope(t, "smartkey", "smartkey:uuid-1:Y2lwaGVy"))
+	store.values["/registry/secrets/default/b"] = []byte(newTestKeyEnvelope(t, "smartkey", "smartkey:uuid-2:Y2lwaGVy"))
+	store.values["/registry/secrets/default/c"] = []byte(newTestKeyEnvelope(t, "smartkey", string(formatDualCipher([]byte("smartkey:uuid-1:Y2lwaGVy"), []byte("bG9jYWw=")))))
+	store.values["/registry/secrets/default/d"] = []byte(newTestKeyEnvelope(t, "smartkey", "Y2lwaGVy"))
+	store.values["/registry/secrets/default/e"] = []byte(newTestKeyEnvelope(t, "other", "smartkey:uuid-3:Y2lwaGVy"))
+	store.values["/registry/secrets/default/f"] = []byte("k8s:enc:kms:v1:smartkey:\xff")
+	store.values["/registry/configmaps/default/g"] = []byte("plain")
+
+	scan, err := scanKeyUsage(context.Background(), store, "smartkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scan.Keys) != 3 || scan.Invalid != 1 {
+		t.Fatal("Three keys and an invalid value expected", scan)
+	}
+	if scan.Keys[0].Kid != noKeyIDLabel || scan.Keys[1].Kid != "uuid-1" || scan.Keys[2].Kid != "uuid-2" {
+		t.Error("Keys should be sorted", scan.Keys)
+	}
+	if len(scan.Keys[1].Resources) != 2 || scan.Keys[1].Resources[1] != "/registry/secrets/default/c" || scan.Keys[1].Revisions != 2 {
+		t.Error("Resources of each key expected", scan.Keys[1])
+	}
+}
+
+/* keyDecrypts returns the Decrypt count of a key in the key_decrypts metric. */
+func keyDecrypts(kid string) int64 {
+	if value, ok := keyDecryptMetrics.Get(kid).(*expvar.Int); ok {
+		return value.Value()
+	}
+	return 0
+}
+
+func TestDecrypt_KeyDecryptMetrics(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config["stateFile"] = filepath.Join(dir, "state.json")
+	serv, err := NewWithBackend("/path/to/sock/file", config, newTestSmartKeyBackend(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := keyDecrypts("uuid-1")
+	cipher, err := serv.backend.Encrypt(nil, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv.Decrypt(nil, &k8spb.DecryptRequest{Version: version, Cipher: cipher})
+	serv.Decrypt(nil, &k8spb.DecryptRequest{Version: version, Cipher: cipher})
+	if keyDecrypts("uuid-1") != before+2 {
+		t.Error("Decrypt calls should be counted per key", keyDecrypts("uuid-1")-before)
+	}
+
+	/* Failures and keys outside the ring are not counted */
+	serv.Decrypt(nil, &k8spb.DecryptRequest{Version: version, Cipher: []byte("smartkey:uuid-1:c2VjcmV0")})
+	serv.Decrypt(nil, &k8spb.DecryptRequest{Version: version, Cipher: []byte("smartkey:uuid-unknown:c2VjcmV0")})
+	if keyDecrypts("uuid-1") != before+2 || keyDecryptMetrics.Get("uuid-unknown") != nil {
+		t.Error("Only successful Decrypt calls of known keys should be counted")
+	}
+}
+
+func TestRunCommand_KeyUsage(t *testing.T) {
+	debugServer := httptest.NewServer(expvar.Handler())
+	defer debugServer.Close()
+	keyDecryptMetrics.Add("uuid-usage", 3)
+
+	var stdout bytes.Buffer
+	if err := runCommand([]string{"key-usage", "-debugAddr", strings.TrimPrefix(debugServer.URL, "http://")}, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^uuid-usage +3$`).MatchString(stdout.String()) {
+		t.Error("Decrypt counts expected, got", stdout.String())
+	}
+
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.db")
+	writeTestSnapshot(t, snapshot, [][2]string{
+		{"/registry/secrets/default/a", newTestKeyEnvelope(t, "smartkey", "smartkey:uuid-1:Y2lwaGVy")},
+		{"/registry/secrets/default/a", newTestKeyEnvelope(t, "smartkey", "smartkey:uuid-2:Y2lwaGVy")},
+	})
+
+	stdout.Reset()
+	if err := runCommand([]string{"key-usage", "-snapshot", snapshot, "-resources"}, nil, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "uuid-1") || !strings.Contains(stdout.String(), "uuid-2") ||
+		!strings.Contains(stdout.String(), "  /registry/secrets/default/a") {
+		t.Error("Resources per key expected, got", stdout.String())
+	}
+
+	if err := runCommand([]string{"key-usage", "-debugAddr", "127.0.0.1:1"}, nil, &stdout); err == nil {
+		t.Error("Test case should fail as no plugin is running")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/* Requests waiting for a backend slot when maxQueuedRequests is not configured */
+const defaultMaxQueuedRequests = 100
+
+/* limiterMetrics exposes queue depth, in flight requests, wait time and rejections of each limiter on /debug/vars */
+var limiterMetrics = expvar.NewMap("request_limiter")
+
+/*requestLimiter bounds the number of concurrent backend requests, queueing up to maxQueued requests beyond that. */
+type requestLimiter struct {
+	name      string
+	slots     chan struct{}
+	maxQueued int32
+	queued    int32
+}
+
+/* newRequestLimiter creates a limiter of maxConcurrent requests, nil when maxConcurrent is 0 (unlimited). */
+func newRequestLimiter(name string, maxConcurrent int, maxQueued int) *requestLimiter {
+	if maxConcurrent == 0 {
+		return nil
+	}
+	return &requestLimiter{name: name, slots: make(chan struct{}, maxConcurrent), maxQueued: int32(maxQueued)}
+}
+
+/* acquire waits for a slot and returns the function releasing it. It fails with ResourceExhausted when the queue is full. */
+func (l *requestLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release := func() {
+		<-l.slots
+		limiterMetrics.Add(l.name+"_in_flight", -1)
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		limiterMetrics.Add(l.name+"_in_flight", 1)
+		return release, nil
+	default:
+	}
+
+	if atomic.AddInt32(&l.queued, 1) > l.maxQueued {
+		atomic.AddInt32(&l.queued, -1)
+		limiterMetrics.Add(l.name+"_rejected", 1)
+		return nil, status.Errorf(codes.ResourceExhausted, "too many concurrent %s requests, %d running and %d queued", l.name, cap(l.slots), l.maxQueued)
+	}
+	limiterMetrics.Add(l.name+"_queued", 1)
+	defer func() {
+		atomic.AddInt32(&l.queued, -1)
+		limiterMetrics.Add(l.name+"_queued", -1)
+	}()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	start := time.Now()
+	defer func() {
+		limiterMetrics.Add(l.name+"_waits", 1)
+		limiterMetrics.AddFloat(l.name+"_wait_seconds", time.Since(start).Seconds())
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		limiterMetrics.Add(l.name+"_in_flight", 1)
+		return release, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, status.Error(codes.DeadlineExceeded, "deadline exceeded while waiting for a "+l.name+" slot")
+		}
+		return nil, status.Error(codes.Canceled, "canceled while waiting for a "+l.name+" slot")
+	}
+}
+
+/*requestLimits holds the limiter shared by all backend requests and the per method limiters. */
+type requestLimits struct {
+	all     *requestLimiter
+	encrypt *requestLimiter
+	decrypt *requestLimiter
+}
+
+/* newRequestLimits reads the optional maxConcurrentRequests, maxConcurrentEncryptRequests, maxConcurrentDecryptRequests and maxQueuedRequests config properties. Limits are disabled when not set. */
+func newRequestLimits(config map[string]string) (*requestLimits, error) {
+	maxQueued, err := parseLimit(config, "maxQueuedRequests", defaultMaxQueuedRequests)
+	if err != nil {
+		return nil, err
+	}
+	maxConcurrent, err := parseLimit(config, "maxConcurrentRequests", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxEncrypt, err := parseLimit(config, "maxConcurrentEncryptRequests", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxDecrypt, err := parseLimit(config, "maxConcurrentDecryptRequests", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &requestLimits{
+		all:     newRequestLimiter("backend", maxConcurrent, maxQueued),
+		encrypt: newRequestLimiter("encrypt", maxEncrypt, maxQueued),
+		decrypt: newRequestLimiter("decrypt", maxDecrypt, maxQueued),
+	}, nil
+}
+
+/* acquire takes a slot of the method limiter, then of the limiter shared by all methods. */
+func (l *requestLimits) acquire(ctx context.Context, method *requestLimiter) (func(), error) {
+	releaseMethod, err := method.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	releaseAll, err := l.all.acquire(ctx)
+	if err != nil {
+		releaseMethod()
+		return nil, err
+	}
+	return func() {
+		releaseAll()
+		releaseMethod()
+	}, nil
+}
+
+/* parseLimit reads a non negative integer config property. */
+func parseLimit(config map[string]string, property string, defaultValue int) (int, error) {
+	value, isPresent := config[property]
+	if !isPresent {
+		return defaultValue, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, errors.New("property '" + property + "' must be a non negative integer")
+	}
+	return limit, nil
+}
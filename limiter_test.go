@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+/* blockingBackend blocks Encrypt calls until unblock is closed, Decrypt returns immediately. */
+type blockingBackend struct {
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func newBlockingBackend() *blockingBackend {
+	return &blockingBackend{started: make(chan struct{}, 100), unblock: make(chan struct{})}
+}
+
+func (b *blockingBackend) Encrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	b.started <- struct{}{}
+	<-b.unblock
+	return plain, nil
+}
+
+func (b *blockingBackend) Decrypt(ctx context.Context, cipher []byte) ([]byte, error) {
+	return cipher, nil
+}
+
+func (b *blockingBackend) Health(ctx context.Context) error {
+	return nil
+}
+
+func (b *blockingBackend) KeyInfo(ctx context.Context) (*KeyObject, error) {
+	return &KeyObject{KeySize: 256, ObjType: "AES"}, nil
+}
+
+/* waitQueued waits until n requests are queued by limiter. */
+func waitQueued(t *testing.T, limiter *requestLimiter, n int64) {
+	for i := 0; i < 1000; i++ {
+		if limiterMetric(limiter.name+"_queued") == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Requests were not queued")
+}
+
+func TestRequestLimits_Positive_QueueAndReject(t *testing.T) {
+	backend := newBlockingBackend()
+	config := map[string]string{"maxConcurrentRequests": "2", "maxQueuedRequests": "1"}
+	serv, err := NewWithBackend("/path/to/sock/file", config, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejectedBefore := limiterMetric("backend_rejected")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := serv.Encrypt(context.Background(), &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+			errs <- err
+		}()
+	}
+	<-backend.started
+	<-backend.started
+	waitQueued(t, serv.limits.all, 1)
+
+	/* Both slots are busy and the queue is full */
+	_, err = serv.Encrypt(context.Background(), &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Error("ResourceExhausted expected when the queue is full, got", err)
+	}
+	if limiterMetric("backend_rejected") != rejectedBefore+1 {
+		t.Error("Rejection should be counted")
+	}
+
+	/* Queued request runs once a slot is released */
+	close(backend.unblock)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error("Queued requests should succeed", err)
+		}
+	}
+	if limiterMetric("backend_queued") != 0 || len(serv.limits.all.slots) != 0 {
+		t.Error("All slots should be released")
+	}
+}
+
+func TestRequestLimits_Positive_PerMethod(t *testing.T) {
+	backend := newBlockingBackend()
+	config := map[string]string{"maxConcurrentEncryptRequests": "1", "maxQueuedRequests": "0"}
+	serv, err := NewWithBackend("/path/to/sock/file", config, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		serv.Encrypt(context.Background(), &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+		close(done)
+	}()
+	<-backend.started
+
+	if _, err := serv.Encrypt(context.Background(), &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")}); status.Code(err) != codes.ResourceExhausted {
+		t.Error("Encrypt should be limited, got", err)
+	}
+	if _, err := serv.Decrypt(context.Background(), &k8spb.DecryptRequest{Version: version, Cipher: []byte("secret")}); err != nil {
+		t.Error("Decrypt should not be limited by the encrypt limit", err)
+	}
+
+	close(backend.unblock)
+	<-done
+}
+
+func TestRequestLimits_Negative_QueueTimeout(t *testing.T) {
+	backend := newBlockingBackend()
+	serv, err := NewWithBackend("/path/to/sock/file", map[string]string{"maxConcurrentRequests": "1"}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close(backend.unblock)
+
+	go serv.Encrypt(context.Background(), &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+	<-backend.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = serv.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Error("DeadlineExceeded expected while queued, got", err)
+	}
+	if limiterMetric("backend_queued") != 0 {
+		t.Error("Timed out request should leave the queue")
+	}
+}
+
+func TestRequestLimits_Negative_InvalidConfig(t *testing.T) {
+	for _, property := range []string{"maxConcurrentRequests", "maxConcurrentEncryptRequests", "maxConcurrentDecryptRequests", "maxQueuedRequests"} {
+		for _, value := range []string{"-1", "many"} {
+			if _, err := NewWithBackend("/path/to/sock/file", map[string]string{property: value}, newBlockingBackend()); err == nil {
+				t.Errorf("Test case should fail as %s is %q", property, value)
+			}
+		}
+	}
+}
+
+func limiterMetric(name string) int64 {
+	if value, ok := limiterMetrics.Get(name).(interface{ Value() int64 }); ok {
+		return value.Value()
+	}
+	return 0
+}
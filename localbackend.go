@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/net/context"
+)
+
+/*localBackend is a Backend performing AES-CBC with PKCS#7 padding and a key held in memory, producing ciphers in the same format as SmartKey. */
+type localBackend struct {
+	block   cipher.Block
+	iv      []byte
+	keySize int
+}
+
+/*newLocalBackend creates a Backend for the given AES key (128, 192 or 256 bits) and 16 byte iv. */
+func newLocalBackend(key []byte, iv []byte) (*localBackend, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("invalid local AES key: " + err.Error())
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid local AES iv: must be 16 bytes")
+	}
+	return &localBackend{block: block, iv: append([]byte(nil), iv...), keySize: len(key) * 8}, nil
+}
+
+/*Encrypt encrypts plain data with the local key. */
+func (b *localBackend) Encrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	padded := make([]byte, len(plain)+padding)
+	defer zeroBytes(padded)
+	copy(padded, plain)
+	copy(padded[len(plain):], bytes.Repeat([]byte{byte(padding)}, padding))
+
+	raw := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(b.block, b.iv).CryptBlocks(raw, padded)
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
+	base64.StdEncoding.Encode(encoded, raw)
+	return encoded, nil
+}
+
+/*Decrypt decrypts a cipher produced by Encrypt with the local key. */
+func (b *localBackend) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	raw := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(raw, data)
+	if err != nil {
+		return nil, errors.New("invalid cipher: " + err.Error())
+	}
+	raw = raw[:n]
+	if len(raw) == 0 || len(raw)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid cipher: length is not a multiple of the block size")
+	}
+
+	plain := make([]byte, len(raw))
+	cipher.NewCBCDecrypter(b.block, b.iv).CryptBlocks(plain, raw)
+
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid cipher: bad padding")
+	}
+	for _, p := range plain[len(plain)-padding:] {
+		if int(p) != padding {
+			return nil, errors.New("invalid cipher: bad padding")
+		}
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+/*Health always succeeds as the local backend has no external dependency. */
+func (b *localBackend) Health(ctx context.Context) error {
+	return nil
+}
+
+/*KeyInfo describes the local key. */
+func (b *localBackend) KeyInfo(ctx context.Context) (*KeyObject, error) {
+	return &KeyObject{KeySize: int32(b.keySize), ObjType: "AES", KeyOps: requiredKeyOps, Enabled: true}, nil
+}
+
+/*generateLocalKeyFile writes a new random AES-256 key, base64 encoded, to a file readable by its owner only. */
+func generateLocalKeyFile(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	/* Never overwrite an existing key, ciphers created with it would be lost */
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.New("unable to create key file " + path + ": " + err.Error())
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	return err
+}
+
+/*readLocalKeyFile reads an AES key created by generateLocalKeyFile. */
+func readLocalKeyFile(path string) ([]byte, error) {
+	if len(path) == 0 {
+		return nil, errors.New("local key file not specified")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("unable to read key file " + path)
+	}
+	defer zeroBytes(data)
+	encoded := bytes.TrimSpace(data)
+	key := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(key, encoded)
+	if err != nil {
+		zeroBytes(key)
+		return nil, errors.New("key file " + path + " is not base64 encoded")
+	}
+	key = key[:n]
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, errors.New("key file " + path + " does not contain a 128, 192 or 256 bit AES key")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func newTestLocalBackend(t *testing.T) *localBackend {
+	iv, _ := base64.StdEncoding.DecodeString("rFvgbU6EygpLUObqFZxITg==")
+	backend, err := newLocalBackend(bytes.Repeat([]byte{0x42}, 32), iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestLocalBackend_Positive_RoundTrip(t *testing.T) {
+	backend := newTestLocalBackend(t)
+
+	for _, plain := range [][]byte{{}, []byte("plain"), bytes.Repeat([]byte{0}, 16), {0xff, 0x00, 0x10}} {
+		cipher, err := backend.Encrypt(nil, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := backend.Decrypt(nil, cipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("Round trip failed for %v, got %v", plain, decrypted)
+		}
+	}
+}
+
+/* randomPayloads generates random binary payloads up to the apiserver's maximum object size for quick.Check */
+func randomPayloads(values []reflect.Value, r *rand.Rand) {
+	plain := make([]byte, r.Intn(maxObjectSize+1))
+	r.Read(plain)
+	values[0] = reflect.ValueOf(plain)
+}
+
+func TestLocalBackend_Property_RoundTrip(t *testing.T) {
+	backend := newTestLocalBackend(t)
+
+	roundTrip := func(plain []byte) bool {
+		cipher, err := backend.Encrypt(nil, plain)
+		if err != nil {
+			return false
+		}
+		decrypted, err := backend.Decrypt(nil, cipher)
+		return err == nil && bytes.Equal(decrypted, plain)
+	}
+
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 50, Values: randomPayloads}); err != nil {
+		t.Error(err)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLocalBackend_Positive_KeyInfo(t *testing.T) {
+	backend := newTestLocalBackend(t)
+
+	key, err := backend.KeyInfo(nil)
+	if err != nil || key.ObjType != "AES" || key.KeySize != 256 {
+		t.Error("Invalid key info")
+	}
+	if backend.Health(nil) != nil {
+		t.Error("Local backend should be healthy")
+	}
+}
+
+func TestLocalBackend_Negative_InvalidKey(t *testing.T) {
+	_, err := newLocalBackend([]byte("short"), make([]byte, 16))
+	if err == nil {
+		t.Error("Test case should fail as key size is invalid")
+	}
+
+	_, err = newLocalBackend(make([]byte, 32), make([]byte, 8))
+	if err == nil {
+		t.Error("Test case should fail as iv size is invalid")
+	}
+}
+
+func TestLocalBackend_Negative_InvalidCipher(t *testing.T) {
+	backend := newTestLocalBackend(t)
+
+	for _, cipher := range []string{"not base64!", "", base64.StdEncoding.EncodeToString([]byte("short")), base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := backend.Decrypt(nil, []byte(cipher)); err == nil {
+			t.Errorf("Test case should fail as cipher %q is invalid", cipher)
+		}
+	}
+}
+
+func TestLocalKeyFile_Positive_GenerateAndRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "local.key")
+	if err := generateLocalKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := readLocalKeyFile(keyFile)
+	if err != nil || len(key) != 32 {
+		t.Error("Unable to read generated key file")
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Key file should only be readable by its owner")
+	}
+}
+
+func TestLocalKeyFile_Negative_NoOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "local.key")
+	if err := generateLocalKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := generateLocalKeyFile(keyFile); err == nil {
+		t.Error("Test case should fail as key file already exists")
+	}
+}
+
+func TestLocalKeyFile_Negative_InvalidContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "local.key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600)
+
+	if _, err := readLocalKeyFile(keyFile); err == nil {
+		t.Error("Test case should fail as key size is invalid")
+	}
+	if _, err := readLocalKeyFile(filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("Test case should fail as key file is missing")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+)
+
+/* Initial size of the buffer reading a SmartKey response of unknown length */
+const initialResponseBufferSize = 512
+
+/* zeroBytes overwrites plain data or key material which is no longer needed. */
+func zeroBytes(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+/* readAllZeroing reads r until EOF like ioutil.ReadAll, zeroing the buffers it outgrows so the data is only left in the returned slice. */
+func readAllZeroing(r io.Reader, sizeHint int64) ([]byte, error) {
+	size := initialResponseBufferSize
+	if sizeHint > 0 && sizeHint < maxMessageSize {
+		/* One more byte so EOF is read without growing the buffer */
+		size = int(sizeHint) + 1
+	}
+	data := make([]byte, 0, size)
+	for {
+		if len(data) == cap(data) {
+			grown := make([]byte, len(data), 2*cap(data))
+			copy(grown, data)
+			zeroBytes(data)
+			data = grown
+		}
+		n, err := r.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			zeroBytes(data)
+			return nil, err
+		}
+	}
+}
+
+/* Encoding of an EncryptRequest whose Plain is nil, replaced by the plain data in encodePlainRequest */
+var nullPlainField = []byte(`"plain":null`)
+
+/*plainRequest is a SmartKey request with plain data. Request holds EncryptRequests whose Plain is nil, Plains are their plain data in the order they are encoded. */
+type plainRequest struct {
+	Request interface{}
+	Plains  [][]byte
+}
+
+/* encodePlainRequest JSON encodes a plainRequest into a buffer of the exact size, which the caller zeroes. encoding/json only encodes the request without plain data, as it would leave them in its pooled buffers; they are base64 encoded in place of its null Plain fields. */
+func encodePlainRequest(request *plainRequest) ([]byte, error) {
+	template, err := json.Marshal(request.Request)
+	if err != nil {
+		return nil, err
+	}
+	size := len(template)
+	for _, plain := range request.Plains {
+		size += base64.StdEncoding.EncodedLen(len(plain)) + len(`""`) - len("null")
+	}
+
+	data := make([]byte, 0, size)
+	for _, plain := range request.Plains {
+		/* A string cannot contain the field, its quotes would be escaped */
+		field := bytes.Index(template, nullPlainField)
+		if field < 0 {
+			zeroBytes(data)
+			return nil, errors.New("plain field missing in request")
+		}
+		data = append(data, template[:field+len(nullPlainField)-len("null")]...)
+		data = append(data, '"')
+		encodedLen := base64.StdEncoding.EncodedLen(len(plain))
+		base64.StdEncoding.Encode(data[len(data):len(data)+encodedLen], plain)
+		data = append(data[:len(data)+encodedLen], '"')
+		template = template[field+len(nullPlainField):]
+	}
+	if bytes.Contains(template, nullPlainField) {
+		zeroBytes(data)
+		return nil, errors.New("plain data missing in request")
+	}
+	return append(data, template...), nil
+}
+
+/* parseLockMemory parses the optional lockMemory config property, false by default. */
+func parseLockMemory(config map[string]string) (bool, error) {
+	switch config["lockMemory"] {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	}
+	return false, errors.New("property 'lockMemory' must be true or false")
+}
+
+/* protectMemory disables core dumps of the process and, when lockMemory is set, locks its memory so plain data and keys are never swapped. */
+func protectMemory(config map[string]string) error {
+	if err := disableCoreDumps(); err != nil {
+		log.Println("WARNING: Unable to disable core dumps:", err)
+	}
+	lock, err := parseLockMemory(config)
+	if err != nil || !lock {
+		return err
+	}
+	if err := lockMemory(); err != nil {
+		return errors.New("unable to lock memory, the process needs CAP_IPC_LOCK or a sufficient RLIMIT_MEMLOCK: " + err.Error())
+	}
+	log.Println("Process memory locked, it will not be swapped")
+	return nil
+}
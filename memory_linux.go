@@ -0,0 +1,21 @@
+package main
+
+import (
+	"syscall"
+)
+
+/* prctl option setting whether the process can be dumped or ptraced, from linux/prctl.h */
+const prSetDumpable = 4
+
+/* disableCoreDumps prevents core dumps and the ptrace attach of processes of the same user, which would expose plain data and keys. */
+func disableCoreDumps() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetDumpable, 0, 0); errno != 0 {
+		return errno
+	}
+	return syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{Cur: 0, Max: 0})
+}
+
+/* lockMemory locks the current and future pages of the process in RAM. */
+func lockMemory() error {
+	return syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+/* prctl option returning whether the process can be dumped, from linux/prctl.h */
+const prGetDumpable = 3
+
+func TestDisableCoreDumps(t *testing.T) {
+	if err := disableCoreDumps(); err != nil {
+		t.Fatal(err)
+	}
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit); err != nil || limit.Cur != 0 {
+		t.Error("Core dump size should be limited to 0, got", limit.Cur, err)
+	}
+	dumpable, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prGetDumpable, 0, 0)
+	if errno != 0 || dumpable != 0 {
+		t.Error("Process should not be dumpable, got", dumpable, errno)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+/* disableCoreDumps is only implemented on Linux. */
+func disableCoreDumps() error {
+	return errors.New("not supported on this platform")
+}
+
+/* lockMemory is only implemented on Linux. */
+func lockMemory() error {
+	return errors.New("not supported on this platform")
+}
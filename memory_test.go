@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+func TestZeroBytes(t *testing.T) {
+	data := []byte("secret")
+	zeroBytes(data)
+	if !bytes.Equal(data, make([]byte, 6)) {
+		t.Error("Data should be zeroed, got", data)
+	}
+	zeroBytes(nil)
+}
+
+func TestReadAllZeroing_Positive(t *testing.T) {
+	content := strings.Repeat("plain", 1000)
+	for _, sizeHint := range []int64{-1, 0, 10, int64(len(content))} {
+		/* One byte per read so the buffer grows */
+		data, err := readAllZeroing(iotest.OneByteReader(strings.NewReader(content)), sizeHint)
+		if err != nil || string(data) != content {
+			t.Error("Content should be read with size hint", sizeHint, err)
+		}
+	}
+}
+
+func TestReadAllZeroing_Negative(t *testing.T) {
+	reader := io.MultiReader(strings.NewReader("plain"), iotest.ErrReader(errors.New("reset")))
+	if data, err := readAllZeroing(reader, -1); err == nil || data != nil {
+		t.Error("Test case should fail as the reader fails")
+	}
+}
+
+func TestParseLockMemory(t *testing.T) {
+	for value, expected := range map[string]bool{"": false, "false": false, "true": true} {
+		lock, err := parseLockMemory(map[string]string{"lockMemory": value})
+		if err != nil || lock != expected {
+			t.Error("lockMemory", value, "should be", expected, err)
+		}
+	}
+	if _, err := parseLockMemory(map[string]string{"lockMemory": "yes"}); err == nil {
+		t.Error("Test case should fail as lockMemory is not a boolean")
+	}
+}
+
+func TestEncodePlainRequest(t *testing.T) {
+	/* SmartKey receives plain data base64 encoded, as encoding/json encodes a byte slice */
+	request := EncryptRequest{Alg: "AES", Mode: "CBC", Iv: "iv"}
+	data, err := encodePlainRequest(&plainRequest{Request: &request, Plains: [][]byte{[]byte("secret")}})
+	expected, _ := json.Marshal(EncryptRequest{Alg: "AES", Mode: "CBC", Iv: "iv", Plain: []byte("secret")})
+	if err != nil || !bytes.Equal(data, expected) || cap(data) != len(data) {
+		t.Error("Request should be encoded like encoding/json in a buffer of the exact size, got", string(data), err)
+	}
+
+	batch := []BatchEncryptRequest{{Kid: "uuid-1", Request: request}, {Kid: "uuid-1", Request: request}}
+	data, err = encodePlainRequest(&plainRequest{Request: batch, Plains: [][]byte{[]byte("a"), []byte("secret")}})
+	var decoded []BatchEncryptRequest
+	if err != nil || json.Unmarshal(data, &decoded) != nil || len(decoded) != 2 || string(decoded[0].Request.Plain) != "a" || string(decoded[1].Request.Plain) != "secret" {
+		t.Error("Each plain should be encoded in order, got", string(data), err)
+	}
+
+	if _, err := encodePlainRequest(&plainRequest{Request: &request}); err == nil {
+		t.Error("Test case should fail as the plain is missing")
+	}
+	if _, err := encodePlainRequest(&plainRequest{Request: &request, Plains: [][]byte{[]byte("a"), []byte("b")}}); err == nil {
+		t.Error("Test case should fail as there are more plains than fields")
+	}
+
+	var response DecryptResponse
+	if err := json.Unmarshal([]byte(`{"kid": "1", "plain": "c2VjcmV0", "iv": "iv"}`), &response); err != nil || string(response.Plain) != "secret" {
+		t.Error("Plain should be base64 decoded, got", response.Plain, err)
+	}
+}
+
+func TestEncrypt_Positive_ZeroesPlain(t *testing.T) {
+	serv, err := NewWithBackend("/path/to/sock/file", make(map[string]string), newTestLocalBackend(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := []byte("secret")
+	encrypted, err := serv.Encrypt(nil, &k8spb.EncryptRequest{Version: version, Plain: plain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, make([]byte, 6)) {
+		t.Error("Plain data of the request should be zeroed once encrypted, got", plain)
+	}
+	decrypted, err := serv.Decrypt(nil, &k8spb.DecryptRequest{Version: version, Cipher: encrypted.Cipher})
+	if err != nil || string(decrypted.Plain) != "secret" {
+		t.Error("Zeroing should not change the cipher", err)
+	}
+}
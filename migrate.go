@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+/* Prefix of values encrypted by the apiserver KMS v1 envelope transformer, followed by the provider name and ':' */
+const kmsEnvelopePrefix = "k8s:enc:kms:v1:"
+
+/* Number of entries between two progress reports of a migration */
+const migrationProgressInterval = 100
+
+/* errConflict is returned by kvStore.Put when the value was changed since it was read. */
+var errConflict = errors.New("value changed since it was read")
+
+/*kvStore is an etcd keyspace, live or in a snapshot, holding apiserver objects. */
+type kvStore interface {
+	/* Walk calls fn with the position, key and value of each entry after the given position, in order. */
+	Walk(ctx context.Context, after []byte, fn func(position []byte, key []byte, value []byte) error) error
+	/* Put replaces the value at position with newValue, returning errConflict if it no longer holds oldValue. */
+	Put(ctx context.Context, position []byte, key []byte, oldValue []byte, newValue []byte) error
+	/* Close releases the store. */
+	Close() error
+}
+
+/*kmsEnvelope is a value stored by the apiserver KMS v1 envelope transformer. */
+type kmsEnvelope struct {
+	/* provider name from the EncryptionConfiguration */
+	providerName string
+	/* DEK encrypted by the KMS plugin */
+	encryptedDEK []byte
+	/* data encrypted with the DEK */
+	data []byte
+}
+
+/* parseKMSEnvelope parses "k8s:enc:kms:v1:<name>:" + uint16 DEK length + encrypted DEK + data. It returns false for values not encrypted by KMS. */
+func parseKMSEnvelope(value []byte) (*kmsEnvelope, bool, error) {
+	if !bytes.HasPrefix(value, []byte(kmsEnvelopePrefix)) {
+		return nil, false, nil
+	}
+	rest := value[len(kmsEnvelopePrefix):]
+	separator := bytes.IndexByte(rest, ':')
+	if separator < 0 {
+		return nil, true, errors.New("invalid KMS envelope: provider name not terminated")
+	}
+	providerName := string(rest[:separator])
+	rest = rest[separator+1:]
+
+	if len(rest) < 2 {
+		return nil, true, errors.New("invalid KMS envelope: DEK length missing")
+	}
+	length := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < length {
+		return nil, true, errors.New("invalid KMS envelope: DEK truncated")
+	}
+
+	return &kmsEnvelope{providerName: providerName, encryptedDEK: rest[:length], data: rest[length:]}, true, nil
+}
+
+/* bytes serializes the envelope in the apiserver format. */
+func (e *kmsEnvelope) bytes() ([]byte, error) {
+	if len(e.encryptedDEK) > 0xffff {
+		return nil, errors.New("encrypted DEK too long for a KMS envelope")
+	}
+	value := make([]byte, 0, len(kmsEnvelopePrefix)+len(e.providerName)+3+len(e.encryptedDEK)+len(e.data))
+	value = append(value, kmsEnvelopePrefix...)
+	value = append(value, e.providerName...)
+	value = append(value, ':')
+	value = append(value, byte(len(e.encryptedDEK)>>8), byte(len(e.encryptedDEK)))
+	value = append(value, e.encryptedDEK...)
+	return append(value, e.data...), nil
+}
+
+/* validDEK reports whether data decrypted from an envelope looks like an AES DEK, so a cipher decrypted with the wrong key is not re-encrypted. */
+func validDEK(dek []byte) bool {
+	return len(dek) == 16 || len(dek) == 24 || len(dek) == 32
+}
+
+/*migrationOptions configures a migration. */
+type migrationOptions struct {
+	/* report what would be migrated without writing */
+	dryRun bool
+	/* only migrate values of this KMS provider when set */
+	providerName string
+	/* file recording the progress, so an interrupted migration resumes where it stopped */
+	stateFile string
+	/* progress reports destination, may be nil */
+	progress io.Writer
+}
+
+/*migrationStats counts the entries processed by a migration. */
+type migrationStats struct {
+	Scanned         int `json:"scanned"`
+	Encrypted       int `json:"encrypted"`
+	Migrated        int `json:"migrated"`
+	AlreadyMigrated int `json:"alreadyMigrated"`
+	Conflicts       int `json:"conflicts"`
+	Failed          int `json:"failed"`
+}
+
+func (s migrationStats) String() string {
+	return fmt.Sprintf("scanned %d, KMS encrypted %d, migrated %d, already migrated %d, conflicts %d, failed %d",
+		s.Scanned, s.Encrypted, s.Migrated, s.AlreadyMigrated, s.Conflicts, s.Failed)
+}
+
+/*migrationState is persisted in the state file. */
+type migrationState struct {
+	Position []byte         `json:"position"`
+	Stats    migrationStats `json:"stats"`
+}
+
+/* migrate re-encrypts the DEK of every KMS envelope in store from fromBackend to toBackend. The data encrypted with the DEK is left unchanged. */
+func migrate(ctx context.Context, store kvStore, fromBackend Backend, toBackend Backend, options migrationOptions) (migrationStats, error) {
+	var state migrationState
+	if len(options.stateFile) > 0 {
+		if err := loadMigrationState(options.stateFile, &state); err != nil {
+			return state.Stats, err
+		}
+		if len(state.Position) > 0 {
+			progressf(options.progress, "resuming after %q, %s\n", state.Position, state.Stats)
+		}
+	}
+
+	err := store.Walk(ctx, state.Position, func(position []byte, key []byte, value []byte) error {
+		state.Stats.Scanned++
+		state.Position = position
+
+		migrated, err := migrateValue(ctx, store, fromBackend, toBackend, options, &state.Stats, position, key, value)
+		if err != nil {
+			progressf(options.progress, "failed %s: %v\n", key, err)
+		}
+
+		/* Record each write immediately, otherwise every migrationProgressInterval entries */
+		if migrated || state.Stats.Scanned%migrationProgressInterval == 0 {
+			if len(options.stateFile) > 0 && !options.dryRun {
+				if err := saveMigrationState(options.stateFile, &state); err != nil {
+					return err
+				}
+			}
+		}
+		if state.Stats.Scanned%migrationProgressInterval == 0 {
+			progressf(options.progress, "%s\n", state.Stats)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return state.Stats, err
+	}
+
+	if len(options.stateFile) > 0 && !options.dryRun {
+		if err := saveMigrationState(options.stateFile, &state); err != nil {
+			return state.Stats, err
+		}
+	}
+	progressf(options.progress, "done: %s\n", state.Stats)
+	return state.Stats, nil
+}
+
+/* migrateValue migrates a single entry and updates stats, it returns true when the store was written. */
+func migrateValue(ctx context.Context, store kvStore, fromBackend Backend, toBackend Backend, options migrationOptions, stats *migrationStats, position []byte, key []byte, value []byte) (bool, error) {
+	envelope, isKMS, err := parseKMSEnvelope(value)
+	if !isKMS {
+		return false, nil
+	}
+	stats.Encrypted++
+	if err != nil {
+		stats.Failed++
+		return false, err
+	}
+	if len(options.providerName) > 0 && envelope.providerName != options.providerName {
+		return false, nil
+	}
+
+	dek, err := fromBackend.Decrypt(ctx, envelope.encryptedDEK)
+	if err != nil || !validDEK(dek) {
+		/* Already migrated by an interrupted run, or written by the apiserver with the new key */
+		newDEK, newErr := toBackend.Decrypt(ctx, envelope.encryptedDEK)
+		zeroBytes(newDEK)
+		if newErr == nil && validDEK(newDEK) {
+			stats.AlreadyMigrated++
+			return false, nil
+		}
+		stats.Failed++
+		if err == nil {
+			err = errors.New("decrypted DEK is invalid")
+		}
+		return false, errors.New("unable to decrypt DEK with the old key: " + err.Error())
+	}
+
+	defer zeroBytes(dek)
+
+	if options.dryRun {
+		stats.Migrated++
+		progressf(options.progress, "would migrate %s\n", key)
+		return false, nil
+	}
+
+	encryptedDEK, err := toBackend.Encrypt(ctx, dek)
+	if err != nil {
+		stats.Failed++
+		return false, errors.New("unable to encrypt DEK with the new key: " + err.Error())
+	}
+	envelope.encryptedDEK = encryptedDEK
+	newValue, err := envelope.bytes()
+	if err != nil {
+		stats.Failed++
+		return false, err
+	}
+
+	err = store.Put(ctx, position, key, value, newValue)
+	if err == errConflict {
+		/* The apiserver rewrote the object meanwhile, with the key it is currently configured with */
+		stats.Conflicts++
+		return false, nil
+	}
+	if err != nil {
+		stats.Failed++
+		return false, err
+	}
+	stats.Migrated++
+	return true, nil
+}
+
+func progressf(progress io.Writer, format string, args ...interface{}) {
+	if progress != nil {
+		fmt.Fprintf(progress, format, args...)
+	}
+}
+
+/* loadMigrationState reads the state file, a missing file is a new migration. */
+func loadMigrationState(stateFile string, state *migrationState) error {
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("unable to read state file " + stateFile + ": " + err.Error())
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return errors.New("unable to parse state file " + stateFile + ": " + err.Error())
+	}
+	return nil
+}
+
+/* saveMigrationState atomically replaces the state file. */
+func saveMigrationState(stateFile string, state *migrationState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(stateFile, data)
+}
+
+/* writeFileAtomic replaces a file with data through a synced temporary file, readers see the old or the new content only. The file is readable by its owner only. */
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.New("unable to write state file " + path + ": " + err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+/* memStore is an in-memory kvStore, failing Put calls after failAfter writes when set. */
+type memStore struct {
+	values    map[string][]byte
+	writes    int
+	failAfter int
+}
+
+func newMemStore() *memStore {
+	return &memStore{values: make(map[string][]byte)}
+}
+
+func (s *memStore) Walk(ctx context.Context, after []byte, fn func(position []byte, key []byte, value []byte) error) error {
+	var keys []string
+	for key := range s.values {
+		if key > string(after) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn([]byte(key), []byte(key), s.values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Put(ctx context.Context, position []byte, key []byte, oldValue []byte, newValue []byte) error {
+	if s.failAfter > 0 && s.writes >= s.failAfter {
+		return errors.New("store unavailable")
+	}
+	if !bytes.Equal(s.values[string(key)], oldValue) {
+		return errConflict
+	}
+	s.writes++
+	s.values[string(key)] = newValue
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+func newTestBackendWithRandomKey(t *testing.T) Backend {
+	key := make([]byte, 32)
+	rand.Read(key)
+	backend, err := newLocalBackend(key, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+/* newTestEnvelope encrypts a random DEK with backend and returns the envelope value. */
+func newTestEnvelope(t *testing.T, backend Backend, providerName string, data string) []byte {
+	dek := make([]byte, 32)
+	rand.Read(dek)
+	encryptedDEK, err := backend.Encrypt(nil, dek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := (&kmsEnvelope{providerName: providerName, encryptedDEK: encryptedDEK, data: []byte(data)}).bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+/* checkEnvelope checks value is an envelope whose DEK is encrypted by backend and whose data is unchanged. */
+func checkEnvelope(t *testing.T, backend Backend, value []byte, data string) {
+	envelope, isKMS, err := parseKMSEnvelope(value)
+	if !isKMS || err != nil {
+		t.Fatal("KMS envelope expected", err)
+	}
+	dek, err := backend.Decrypt(nil, envelope.encryptedDEK)
+	if err != nil || !validDEK(dek) {
+		t.Error("DEK should be encrypted with the expected key", err)
+	}
+	if string(envelope.data) != data {
+		t.Error("Data encrypted with the DEK should not change")
+	}
+}
+
+func TestParseKMSEnvelope(t *testing.T) {
+	value := []byte("k8s:enc:kms:v1:smartkey-test:\x00\x03DEKdata")
+
+	envelope, isKMS, err := parseKMSEnvelope(value)
+	if !isKMS || err != nil {
+		t.Fatal("KMS envelope expected", err)
+	}
+	if envelope.providerName != "smartkey-test" || string(envelope.encryptedDEK) != "DEK" || string(envelope.data) != "data" {
+		t.Error("Invalid envelope", envelope)
+	}
+
+	serialized, err := envelope.bytes()
+	if err != nil || !bytes.Equal(serialized, value) {
+		t.Error("Serialized envelope should match the parsed value")
+	}
+
+	if _, isKMS, _ := parseKMSEnvelope([]byte("k8s:enc:aescbc:v1:key1:data")); isKMS {
+		t.Error("Only KMS values should be parsed")
+	}
+	for _, invalid := range []string{"k8s:enc:kms:v1:name", "k8s:enc:kms:v1:name:\x00", "k8s:enc:kms:v1:name:\x00\x10DEK"} {
+		if _, isKMS, err := parseKMSEnvelope([]byte(invalid)); !isKMS || err == nil {
+			t.Errorf("Test case should fail as envelope %q is invalid", invalid)
+		}
+	}
+}
+
+func TestMigrate_Positive(t *testing.T) {
+	oldBackend := newTestBackendWithRandomKey(t)
+	newBackend := newTestBackendWithRandomKey(t)
+
+	store := newMemStore()
+	store.values["/registry/secrets/default/a"] = newTestEnvelope(t, oldBackend, "smartkey", "data-a")
+	store.values["/registry/secrets/default/b"] = newTestEnvelope(t, newBackend, "smartkey", "data-b")
+	store.values["/registry/configmaps/default/c"] = []byte("plain configmap")
+
+	var progress bytes.Buffer
+	stats, err := migrate(context.Background(), store, oldBackend, newBackend, migrationOptions{progress: &progress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned != 3 || stats.Encrypted != 2 || stats.Migrated != 1 || stats.AlreadyMigrated != 1 || stats.Failed != 0 {
+		t.Error("Unexpected stats", stats)
+	}
+	checkEnvelope(t, newBackend, store.values["/registry/secrets/default/a"], "data-a")
+	checkEnvelope(t, newBackend, store.values["/registry/secrets/default/b"], "data-b")
+	if string(store.values["/registry/configmaps/default/c"]) != "plain configmap" {
+		t.Error("Values not encrypted by KMS should not change")
+	}
+	if !bytes.Contains(progress.Bytes(), []byte("done")) {
+		t.Error("Progress report expected")
+	}
+}
+
+func TestMigrate_Positive_DryRun(t *testing.T) {
+	oldBackend := newTestBackendWithRandomKey(t)
+	newBackend := newTestBackendWithRandomKey(t)
+
+	store := newMemStore()
+	value := newTestEnvelope(t, oldBackend, "smartkey", "data")
+	store.values["/registry/secrets/default/a"] = value
+
+	stats, err := migrate(context.Background(), store, oldBackend, newBackend, migrationOptions{dryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Migrated != 1 || store.writes != 0 || !bytes.Equal(store.values["/registry/secrets/default/a"], value) {
+		t.Error("Dry run should not write", stats)
+	}
+}
+
+func TestMigrate_Positive_ProviderName(t *testing.T) {
+	oldBackend := newTestBackendWithRandomKey(t)
+	newBackend := newTestBackendWithRandomKey(t)
+
+	store := newMemStore()
+	store.values["/registry/secrets/default/a"] = newTestEnvelope(t, oldBackend, "smartkey", "data-a")
+	store.values["/registry/secrets/default/b"] = newTestEnvelope(t, oldBackend, "other", "data-b")
+
+	stats, err := migrate(context.Background(), store, oldBackend, newBackend, migrationOptions{providerName: "smartkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Migrated != 1 {
+		t.Error("Only values of the provider should be migrated", stats)
+	}
+	checkEnvelope(t, oldBackend, store.values["/registry/secrets/default/b"], "data-b")
+}
+
+func TestMigrate_Positive_Resume(t *testing.T) {
+	oldBackend := newTestBackendWithRandomKey(t)
+	newBackend := newTestBackendWithRandomKey(t)
+
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "migration.state")
+
+	store := newMemStore()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		store.values["/registry/secrets/default/"+name] = newTestEnvelope(t, oldBackend, "smartkey", "data-"+name)
+	}
+
+	/* First run is interrupted after 2 writes */
+	store.failAfter = 2
+	stats, _ := migrate(context.Background(), store, oldBackend, newBackend, migrationOptions{stateFile: stateFile})
+	if stats.Migrated != 2 || stats.Failed != 2 {
+		t.Error("Unexpected stats for the interrupted run", stats)
+	}
+
+	/* Resume after the last recorded write, failed values are not retried */
+	store.failAfter = 0
+	stats, err = migrate(context.Background(), store, oldBackend, newBackend, migrationOptions{stateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned != 4 {
+		t.Error("Resumed run should continue from the recorded position", stats)
+	}
+
+	/* A new run migrates what is left */
+	os.Remove(stateFile)
+	stats, err = migrate(context.Background(), store, oldBackend, newBackend, migrationOptions{stateFile: stateFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Migrated != 2 || stats.AlreadyMigrated != 2 || stats.Failed != 0 {
+		t.Error("Unexpected stats for the new run", stats)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		checkEnvelope(t, newBackend, store.values["/registry/secrets/default/"+name], "data-"+name)
+	}
+}
+
+func TestMigrate_Negative_UnknownKey(t *testing.T) {
+	oldBackend := newTestBackendWithRandomKey(t)
+	newBackend := newTestBackendWithRandomKey(t)
+
+	store := newMemStore()
+	store.values["/registry/secrets/default/a"] = newTestEnvelope(t, newTestBackendWithRandomKey(t), "smartkey", "data")
+
+	stats, err := migrate(context.Background(), store, oldBackend, newBackend, migrationOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Failed != 1 || store.writes != 0 {
+		t.Error("Value encrypted with an unknown key should fail", stats)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/* peerAuthMetrics counts the requests allowed and rejected by the peer policy on /debug/vars */
+var peerAuthMetrics = expvar.NewMap("peer_auth")
+
+/*peerIdentity is the process at the other end of a unix socket connection, read when the connection is accepted. */
+type peerIdentity struct {
+	pid int32
+	uid uint32
+	/* primary and supplementary groups */
+	gids []uint32
+	/* path of /proc/<pid>/exe, empty when it cannot be read or the pid may have been reused */
+	executable string
+}
+
+func (p *peerIdentity) String() string {
+	return fmt.Sprintf("uid %d gids %v pid %d executable %q", p.uid, p.gids, p.pid, p.executable)
+}
+
+/*peerAuthInfo is the gRPC AuthInfo of a connection, err is set when the peer credentials could not be read. */
+type peerAuthInfo struct {
+	identity *peerIdentity
+	err      error
+}
+
+func (peerAuthInfo) AuthType() string {
+	return "peercred"
+}
+
+/*peerCredentials are gRPC transport credentials reading SO_PEERCRED of unix socket connections, the connection itself is not changed. */
+type peerCredentials struct{}
+
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn, peerAuthInfo{err: errors.New("not a unix socket connection")}, nil
+	}
+	identity, err := readPeerIdentity(unixConn)
+	return conn, peerAuthInfo{identity: identity, err: err}, nil
+}
+
+func (peerCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("peer credentials are only checked by the server")
+}
+
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (peerCredentials) OverrideServerName(serverName string) error {
+	return nil
+}
+
+/*peerPolicy allows the processes which may call the plugin. A peer must have an allowed uid or gid, and an allowed executable when allowedPeerExecutables is set. */
+type peerPolicy struct {
+	uids        map[uint32]bool
+	gids        map[uint32]bool
+	executables map[string]bool
+}
+
+/* newPeerPolicy parses the allowedPeerUids, allowedPeerGids and allowedPeerExecutables config properties, it returns nil when none is set and every peer is allowed. */
+func newPeerPolicy(config map[string]string) (*peerPolicy, error) {
+	uids, err := parseIDList(config, "allowedPeerUids")
+	if err != nil {
+		return nil, err
+	}
+	gids, err := parseIDList(config, "allowedPeerGids")
+	if err != nil {
+		return nil, err
+	}
+	executables := make(map[string]bool)
+	for _, path := range strings.Split(config["allowedPeerExecutables"], ",") {
+		if path = strings.TrimSpace(path); len(path) == 0 {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			return nil, errors.New("property 'allowedPeerExecutables' must be a comma separated list of absolute paths")
+		}
+		executables[filepath.Clean(path)] = true
+	}
+	if len(uids) == 0 && len(gids) == 0 && len(executables) == 0 {
+		return nil, nil
+	}
+	if len(uids) == 0 && len(gids) == 0 {
+		/* Any user can run an allowed executable, with a preloaded library or a debugger attached */
+		return nil, errors.New("property 'allowedPeerExecutables' needs 'allowedPeerUids' or 'allowedPeerGids'")
+	}
+	return &peerPolicy{uids: uids, gids: gids, executables: executables}, nil
+}
+
+/* parseIDList parses a comma separated list of user or group ids. */
+func parseIDList(config map[string]string, property string) (map[uint32]bool, error) {
+	ids := make(map[uint32]bool)
+	for _, value := range strings.Split(config[property], ",") {
+		if value = strings.TrimSpace(value); len(value) == 0 {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, errors.New("property '" + property + "' must be a comma separated list of numeric ids")
+		}
+		ids[uint32(id)] = true
+	}
+	return ids, nil
+}
+
+/* allows checks a peer against the policy, returning the reason of a rejection. */
+func (p *peerPolicy) allows(identity *peerIdentity) error {
+	allowed := p.uids[identity.uid]
+	for _, gid := range identity.gids {
+		allowed = allowed || p.gids[gid]
+	}
+	if !allowed {
+		return errors.New("uid and gids not allowed")
+	}
+	if len(p.executables) > 0 && !p.executables[identity.executable] {
+		return errors.New("executable not allowed")
+	}
+	return nil
+}
+
+/* authorize is a gRPC interceptor rejecting requests of peers not allowed by the policy with PermissionDenied. */
+func (p *peerPolicy) authorize(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	err := errors.New("peer credentials missing")
+	var identity *peerIdentity
+	if caller, ok := peer.FromContext(ctx); ok {
+		if authInfo, ok := caller.AuthInfo.(peerAuthInfo); ok {
+			identity, err = authInfo.identity, authInfo.err
+		}
+	}
+	if err == nil {
+		err = p.allows(identity)
+	}
+	if err != nil {
+		peerAuthMetrics.Add("rejected", 1)
+		if identity != nil {
+			log.Println("AUDIT: rejected", info.FullMethod, "from", identity.String()+":", err)
+		} else {
+			log.Println("AUDIT: rejected", info.FullMethod, "from unknown peer:", err)
+		}
+		return nil, status.Error(codes.PermissionDenied, "caller is not allowed to use the KMS plugin")
+	}
+	peerAuthMetrics.Add("allowed", 1)
+	return handler(ctx, request)
+}
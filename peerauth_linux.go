@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	/* Syscalls missing from the syscall package, numbered alike on every architecture */
+	sysPidfdSendSignal = 424
+	sysPidfdOpen       = 434
+	/* Socket option returning a pidfd of the peer, from Linux 6.5, value of asm-generic/socket.h */
+	soPeerPidfd = 77
+)
+
+/* readPeerIdentity reads SO_PEERCRED of a connection, then the groups and executable of the peer process from /proc. */
+func readPeerIdentity(conn *net.UnixConn) (*peerIdentity, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var ucredErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if ucredErr != nil {
+		return nil, errors.New("unable to read SO_PEERCRED: " + ucredErr.Error())
+	}
+
+	identity := &peerIdentity{pid: ucred.Pid, uid: ucred.Uid, gids: []uint32{ucred.Gid}}
+	/* The pid is 0 when the peer is in a pid namespace not visible to the plugin */
+	if ucred.Pid > 0 {
+		gids, executable := readPeerProcess(rawConn, ucred.Pid)
+		identity.gids = append(identity.gids, gids...)
+		identity.executable = executable
+	}
+	return identity, nil
+}
+
+/* readPeerProcess reads the supplementary groups and executable of the peer from /proc. They are only returned when a pidfd of the peer shows it still runs after /proc was read, so the pid was not reused by another process. */
+func readPeerProcess(rawConn syscall.RawConn, pid int32) ([]uint32, string) {
+	pidfd, err := peerPidfd(rawConn, pid)
+	if err != nil {
+		return nil, ""
+	}
+	defer syscall.Close(pidfd)
+
+	gids := processGroups(pid)
+	executable := processExecutable(pid)
+	if !processRunning(pidfd) {
+		return nil, ""
+	}
+	return gids, executable
+}
+
+/* peerPidfd returns a pidfd of the peer taken by the kernel when it connected (SO_PEERPIDFD). Older kernels open it with pidfd_open when the connection is accepted, which does not detect a peer exiting and its pid reused before. */
+func peerPidfd(rawConn syscall.RawConn, pid int32) (int, error) {
+	pidfd := -1
+	var pidfdErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		pidfd, pidfdErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, soPeerPidfd)
+	}); err != nil {
+		return -1, err
+	}
+	if pidfdErr != syscall.ENOPROTOOPT {
+		return pidfd, pidfdErr
+	}
+	fd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+/* processRunning sends no signal to the process of a pidfd, only checking it has not exited. */
+func processRunning(pidfd int) bool {
+	_, _, errno := syscall.Syscall6(sysPidfdSendSignal, uintptr(pidfd), 0, 0, 0, 0, 0)
+	/* EPERM: the process runs but the plugin may not signal it */
+	return errno == 0 || errno == syscall.EPERM
+}
+
+/* processExecutable returns the path of the executable of a process, empty when it cannot be read or the file was deleted or replaced since the process started. */
+func processExecutable(pid int32) string {
+	path, err := os.Readlink("/proc/" + strconv.Itoa(int(pid)) + "/exe")
+	if err != nil || strings.HasSuffix(path, " (deleted)") {
+		return ""
+	}
+	return path
+}
+
+/* processGroups returns the supplementary groups of a process from /proc/<pid>/status. */
+func processGroups(pid int32) []uint32 {
+	status, err := ioutil.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/status")
+	if err != nil {
+		return nil
+	}
+	var gids []uint32
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			if gid, err := strconv.ParseUint(field, 10, 32); err == nil {
+				gids = append(gids, uint32(gid))
+			}
+		}
+	}
+	return gids
+}
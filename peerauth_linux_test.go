@@ -0,0 +1,110 @@
+package main
+
+import (
+	"expvar"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+/* encryptWithPeerPolicy calls Encrypt through the unix socket of a plugin configured with config. */
+func encryptWithPeerPolicy(t *testing.T, config map[string]string) error {
+	client, stop := startTestPlugin(t, config, newTestLocalBackend(t))
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+	return err
+}
+
+/* rejectedPeers returns the rejected counter of the peer_auth metric. */
+func rejectedPeers() int64 {
+	if rejected, ok := peerAuthMetrics.Get("rejected").(*expvar.Int); ok {
+		return rejected.Value()
+	}
+	return 0
+}
+
+func TestPeerPolicy_Positive_AllowedPeer(t *testing.T) {
+	uid := strconv.Itoa(os.Getuid())
+	if err := encryptWithPeerPolicy(t, map[string]string{"allowedPeerUids": uid}); err != nil {
+		t.Error("Peer of an allowed uid should be served", err)
+	}
+	if err := encryptWithPeerPolicy(t, map[string]string{"allowedPeerGids": strconv.Itoa(os.Getgid())}); err != nil {
+		t.Error("Peer of an allowed gid should be served", err)
+	}
+
+	/* The test process connects to itself */
+	executable := processExecutable(int32(os.Getpid()))
+	if len(executable) == 0 {
+		t.Fatal("Unable to read the executable of the test process")
+	}
+	if err := encryptWithPeerPolicy(t, map[string]string{"allowedPeerUids": uid, "allowedPeerExecutables": "/usr/local/bin/kube-apiserver," + executable}); err != nil {
+		t.Error("Allowed executable should be served", err)
+	}
+}
+
+func TestPeerPolicy_Negative_RejectedPeer(t *testing.T) {
+	otherUID := strconv.Itoa(os.Getuid() + 1)
+	rejected := rejectedPeers()
+
+	for _, config := range []map[string]string{
+		{"allowedPeerUids": otherUID},
+		{"allowedPeerUids": strconv.Itoa(os.Getuid()), "allowedPeerExecutables": "/usr/local/bin/kube-apiserver"},
+	} {
+		if err := encryptWithPeerPolicy(t, config); status.Code(err) != codes.PermissionDenied {
+			t.Error("Peer should be rejected with PermissionDenied, got", err, "with", config)
+		}
+	}
+	if count := rejectedPeers() - rejected; count != 2 {
+		t.Error("Rejections should be counted, got", count)
+	}
+}
+
+func TestProcessGroups(t *testing.T) {
+	groups, err := os.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gids := processGroups(int32(os.Getpid()))
+	if len(gids) != len(groups) {
+		t.Error("Supplementary groups should be read from /proc, got", gids, "expected", groups)
+	}
+	if processGroups(-1) != nil || processExecutable(-1) != "" {
+		t.Error("Unknown processes should have no groups and no executable")
+	}
+}
+
+func TestProcessRunning(t *testing.T) {
+	sleep := exec.Command("sleep", "60")
+	if err := sleep.Start(); err != nil {
+		t.Skip("Unable to start a process:", err)
+	}
+	pidfd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(sleep.Process.Pid), 0, 0)
+	if errno != 0 {
+		sleep.Process.Kill()
+		sleep.Wait()
+		t.Skip("pidfd_open is not supported:", errno)
+	}
+	defer syscall.Close(int(pidfd))
+
+	if !processRunning(int(pidfd)) {
+		t.Error("Started process should be running")
+	}
+	/* Its pid may now be reused */
+	sleep.Process.Kill()
+	sleep.Wait()
+	if processRunning(int(pidfd)) {
+		t.Error("Exited process should not be running")
+	}
+}
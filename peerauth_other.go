@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+/* readPeerIdentity is only implemented on Linux, peers are then rejected when a peer policy is configured. */
+func readPeerIdentity(conn *net.UnixConn) (*peerIdentity, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
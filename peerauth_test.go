@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewPeerPolicy_Positive(t *testing.T) {
+	if policy, err := newPeerPolicy(map[string]string{}); err != nil || policy != nil {
+		t.Error("Every peer should be allowed without policy", err)
+	}
+
+	policy, err := newPeerPolicy(map[string]string{
+		"allowedPeerUids":        "0, 1000",
+		"allowedPeerGids":        "10",
+		"allowedPeerExecutables": "/usr/local/bin/kube-apiserver, /usr/bin/../sbin/kmsctl",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.uids[0] || !policy.uids[1000] || !policy.gids[10] || len(policy.uids) != 2 {
+		t.Error("Ids should be parsed, got", policy.uids, policy.gids)
+	}
+	if !policy.executables["/usr/local/bin/kube-apiserver"] || !policy.executables["/usr/sbin/kmsctl"] {
+		t.Error("Executable paths should be cleaned, got", policy.executables)
+	}
+}
+
+func TestNewPeerPolicy_Negative(t *testing.T) {
+	for _, config := range []map[string]string{{"allowedPeerUids": "root"}, {"allowedPeerGids": "-1"}, {"allowedPeerUids": "0,1,x"}} {
+		if _, err := newPeerPolicy(config); err == nil {
+			t.Error("Test case should fail as ids are invalid", config)
+		}
+	}
+	if _, err := newPeerPolicy(map[string]string{"allowedPeerUids": "0", "allowedPeerExecutables": "kube-apiserver"}); err == nil {
+		t.Error("Test case should fail as the executable path is relative")
+	}
+	if _, err := newPeerPolicy(map[string]string{"allowedPeerExecutables": "/usr/local/bin/kube-apiserver"}); err == nil {
+		t.Error("Test case should fail as executables are allowed to any user")
+	}
+}
+
+func TestPeerPolicy_Allows(t *testing.T) {
+	apiserver := &peerIdentity{pid: 42, uid: 0, gids: []uint32{0}, executable: "/usr/local/bin/kube-apiserver"}
+	impostor := &peerIdentity{pid: 43, uid: 1000, gids: []uint32{1000, 10}, executable: "/usr/local/bin/kube-apiserver"}
+	other := &peerIdentity{pid: 44, uid: 0, gids: []uint32{0}, executable: "/bin/sh"}
+	/* executable unknown, eg. the pid was reused */
+	unknown := &peerIdentity{pid: 45, uid: 0, gids: []uint32{0}}
+
+	byUID, _ := newPeerPolicy(map[string]string{"allowedPeerUids": "0"})
+	if byUID.allows(apiserver) != nil || byUID.allows(other) != nil || byUID.allows(impostor) == nil {
+		t.Error("Only peers of uid 0 should be allowed")
+	}
+
+	/* Supplementary groups are allowed as well */
+	byGID, _ := newPeerPolicy(map[string]string{"allowedPeerGids": "10"})
+	if byGID.allows(impostor) != nil || byGID.allows(apiserver) == nil {
+		t.Error("Only peers in group 10 should be allowed")
+	}
+
+	/* Any user can run kube-apiserver, ids and executables are both required */
+	both, _ := newPeerPolicy(map[string]string{"allowedPeerUids": "0", "allowedPeerExecutables": "/usr/local/bin/kube-apiserver"})
+	if both.allows(apiserver) != nil || both.allows(impostor) == nil || both.allows(other) == nil || both.allows(unknown) == nil {
+		t.Error("Only kube-apiserver processes of uid 0 should be allowed")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+const (
+	/* Pause after a 429 response without Retry-After header */
+	defaultRetryAfter = time.Second
+	/* Longest pause honoured from a Retry-After header */
+	maxRetryAfter = time.Minute
+	/* Retries of a request throttled with 429 before its error is returned */
+	maxThrottledRetries = 5
+	/* Rate increase after each successful request, until the configured rate is restored */
+	rateRecoveryFactor = 1.1
+	/* Lowest rate reached by throttling, as a fraction of the configured rate */
+	minRateFraction = 0.1
+)
+
+/* SmartKey operations with a configurable rate limit, and their config property */
+var rateLimitProperties = map[string]string{
+	"encrypt": "smartkeyEncryptRateLimit",
+	"decrypt": "smartkeyDecryptRateLimit",
+}
+
+/* rateLimiterMetrics exposes the current rate, waits and 429 responses of each operation on /debug/vars */
+var rateLimiterMetrics = expvar.NewMap("smartkey_rate_limiter")
+
+/*smartKeyRateLimiter is a token bucket per SmartKey operation. A 429 response pauses every operation for the Retry-After delay, since the account quota is shared, and halves the rate of the throttled operation once per pause. */
+type smartKeyRateLimiter struct {
+	limiters   map[string]*rate.Limiter
+	configured map[string]rate.Limit
+
+	mutex       sync.Mutex
+	pausedUntil time.Time
+}
+
+/* newSmartKeyRateLimiter reads the optional smartkeyRateLimit (requests per second for every operation), smartkeyEncryptRateLimit, smartkeyDecryptRateLimit and smartkeyRateLimitBurst config properties. Operations are not limited when no rate is set. */
+func newSmartKeyRateLimiter(config map[string]string) (*smartKeyRateLimiter, error) {
+	defaultLimit, err := parseRateLimit(config, "smartkeyRateLimit", rate.Inf)
+	if err != nil {
+		return nil, err
+	}
+	burst := 0
+	if value, isPresent := config["smartkeyRateLimitBurst"]; isPresent {
+		burst, err = strconv.Atoi(value)
+		if err != nil || burst < 1 {
+			return nil, errors.New("property 'smartkeyRateLimitBurst' must be a positive integer")
+		}
+	}
+
+	l := &smartKeyRateLimiter{limiters: make(map[string]*rate.Limiter), configured: make(map[string]rate.Limit)}
+	for operation, property := range rateLimitProperties {
+		limit, err := parseRateLimit(config, property, defaultLimit)
+		if err != nil {
+			return nil, err
+		}
+		operationBurst := burst
+		if operationBurst == 0 {
+			/* One second worth of requests by default */
+			operationBurst = int(math.Ceil(float64(limit)))
+			if limit == rate.Inf || operationBurst < 1 {
+				operationBurst = 1
+			}
+		}
+		l.limiters[operation] = rate.NewLimiter(limit, operationBurst)
+		l.configured[operation] = limit
+	}
+	return l, nil
+}
+
+/* call runs fn once the operation is allowed by the rate limit, retrying it while SmartKey answers 429 Too Many Requests. */
+func (l *smartKeyRateLimiter) call(ctx context.Context, operation string, fn func() error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for attempt := 0; ; attempt++ {
+		if err := l.wait(ctx, operation); err != nil {
+			return err
+		}
+
+		err := fn()
+		var smartKeyErr *SmartKeyError
+		if !errors.As(err, &smartKeyErr) || smartKeyErr.StatusCode != http.StatusTooManyRequests {
+			if err == nil {
+				l.recover(operation)
+			}
+			return err
+		}
+
+		rateLimiterMetrics.Add(operation+"_throttled", 1)
+		if attempt >= maxThrottledRetries {
+			return err
+		}
+		l.throttle(operation, smartKeyErr.RetryAfter)
+	}
+}
+
+/* wait blocks until the pause requested by SmartKey is over and a token of the operation is available. */
+func (l *smartKeyRateLimiter) wait(ctx context.Context, operation string) error {
+	start := time.Now()
+	defer func() {
+		rateLimiterMetrics.AddFloat(operation+"_wait_seconds", time.Since(start).Seconds())
+	}()
+
+	l.mutex.Lock()
+	pause := time.Until(l.pausedUntil)
+	l.mutex.Unlock()
+	if pause > 0 {
+		timer := time.NewTimer(pause)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return errors.New("SmartKey rate limited: " + ctx.Err().Error())
+		}
+	}
+
+	limiter, ok := l.limiters[operation]
+	if !ok {
+		return nil
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return errors.New("SmartKey rate limited: " + err.Error())
+	}
+	return nil
+}
+
+/* throttle pauses every operation for retryAfter and halves the rate of the throttled operation, down to minRateFraction of its configured rate. The rate is only halved by a 429 received once the previous pause is over, concurrent requests throttled by the same burst halve it once. */
+func (l *smartKeyRateLimiter) throttle(operation string, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	paused := now.Before(l.pausedUntil)
+	if until := now.Add(retryAfter); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	if limiter, ok := l.limiters[operation]; ok && limiter.Limit() != rate.Inf && !paused {
+		limit := limiter.Limit() / 2
+		if minLimit := l.configured[operation] * minRateFraction; limit < minLimit {
+			limit = minLimit
+		}
+		limiter.SetLimit(limit)
+		rateLimiterMetrics.Set(operation+"_limit", expvarFloat(float64(limit)))
+	}
+	l.mutex.Unlock()
+	log.Println("SmartKey returned 429 Too Many Requests for", operation, "- pausing requests for", retryAfter)
+}
+
+/* recover increases the rate of an operation slowed down by throttle, up to its configured rate. */
+func (l *smartKeyRateLimiter) recover(operation string) {
+	limiter, ok := l.limiters[operation]
+	if !ok || limiter.Limit() >= l.configured[operation] {
+		return
+	}
+	limit := limiter.Limit() * rateRecoveryFactor
+	if limit > l.configured[operation] {
+		limit = l.configured[operation]
+	}
+	limiter.SetLimit(limit)
+	rateLimiterMetrics.Set(operation+"_limit", expvarFloat(float64(limit)))
+}
+
+/* parseRateLimit reads a positive requests per second config property. */
+func parseRateLimit(config map[string]string, property string, defaultValue rate.Limit) (rate.Limit, error) {
+	value, isPresent := config[property]
+	if !isPresent {
+		return defaultValue, nil
+	}
+	limit, err := strconv.ParseFloat(value, 64)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("property '" + property + "' must be a positive number of requests per second")
+	}
+	return rate.Limit(limit), nil
+}
+
+func expvarFloat(value float64) *expvar.Float {
+	v := new(expvar.Float)
+	v.Set(value)
+	return v
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+func rateLimiterMetric(name string) int64 {
+	if value, ok := rateLimiterMetrics.Get(name).(interface{ Value() int64 }); ok {
+		return value.Value()
+	}
+	return 0
+}
+
+func TestSmartKeyRateLimiter_Positive_TokenBucket(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	config["smartkeyEncryptRateLimit"] = "20"
+	config["smartkeyRateLimitBurst"] = "1"
+	backend := newTestSmartKeyBackend(t, config)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := backend.Encrypt(nil, []byte("secret")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Error("5 requests at 20 per second should take at least 200ms, took", elapsed)
+	}
+
+	/* Decrypt has no limit configured */
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		backend.Decrypt(nil, []byte("c2VjcmV0"))
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Error("Decrypt should not be limited, took", elapsed)
+	}
+}
+
+func TestSmartKeyRateLimiter_Positive_RetryAfter(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	backend := newTestSmartKeyBackend(t, config)
+	throttledBefore := rateLimiterMetric("encrypt_throttled")
+
+	smartkey.InjectFailure(smartkeytest.Failure{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second, Times: 1})
+	start := time.Now()
+	cipher, err := backend.Encrypt(nil, []byte("secret"))
+	if err != nil {
+		t.Fatal("Throttled request should be retried", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Error("Retry should wait for Retry-After, took", elapsed)
+	}
+	if smartkey.RequestCount("encrypt") != 2 || rateLimiterMetric("encrypt_throttled") != throttledBefore+1 {
+		t.Error("One throttled request and one retry expected")
+	}
+
+	plain, err := backend.Decrypt(nil, cipher)
+	if err != nil || string(plain) != "secret" {
+		t.Error("Decryption failed after throttling", err)
+	}
+}
+
+func TestSmartKeyRateLimiter_Negative_Deadline(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	backend := newTestSmartKeyBackend(t, config)
+
+	smartkey.InjectFailure(smartkeytest.Failure{StatusCode: http.StatusTooManyRequests, RetryAfter: 30 * time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := backend.Encrypt(ctx, []byte("secret")); err == nil {
+		t.Error("Test case should fail as SmartKey keeps throttling")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("Throttled request should give up at the deadline, took", elapsed)
+	}
+}
+
+func TestSmartKeyRateLimiter_Positive_AdaptiveRate(t *testing.T) {
+	limiter, err := newSmartKeyRateLimiter(map[string]string{"smartkeyRateLimit": "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.throttle("encrypt", time.Millisecond)
+	if limiter.limiters["encrypt"].Limit() != 5 || limiter.limiters["decrypt"].Limit() != 10 {
+		t.Error("Throttled operation should be slowed down")
+	}
+	/* Throttled once the pause is over, down to a tenth of the configured rate */
+	for i := 0; i < 5; i++ {
+		time.Sleep(2 * time.Millisecond)
+		limiter.throttle("encrypt", time.Millisecond)
+	}
+	if limiter.limiters["encrypt"].Limit() != 1 {
+		t.Error("Rate should not go below a tenth of the configured rate, got", limiter.limiters["encrypt"].Limit())
+	}
+	for i := 0; i < 30; i++ {
+		limiter.recover("encrypt")
+	}
+	if limiter.limiters["encrypt"].Limit() != 10 {
+		t.Error("Rate should be restored to the configured rate, got", limiter.limiters["encrypt"].Limit())
+	}
+
+	unlimited, _ := newSmartKeyRateLimiter(map[string]string{})
+	unlimited.throttle("encrypt", time.Millisecond)
+	if unlimited.limiters["encrypt"].Limit() != rate.Inf {
+		t.Error("Operations without limit should stay unlimited")
+	}
+}
+
+func TestSmartKeyRateLimiter_Positive_ConcurrentThrottles(t *testing.T) {
+	limiter, err := newSmartKeyRateLimiter(map[string]string{"smartkeyRateLimit": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* Requests throttled by the same burst of 429 responses */
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.throttle("encrypt", time.Second)
+		}()
+	}
+	wg.Wait()
+	if limiter.limiters["encrypt"].Limit() != 50 {
+		t.Error("Rate should be halved once by concurrent 429 responses, got", limiter.limiters["encrypt"].Limit())
+	}
+}
+
+func TestSmartKeyRateLimiter_Negative_InvalidConfig(t *testing.T) {
+	for property, value := range map[string]string{
+		"smartkeyRateLimit":        "0",
+		"smartkeyEncryptRateLimit": "fast",
+		"smartkeyDecryptRateLimit": "-1",
+		"smartkeyRateLimitBurst":   "0",
+	} {
+		if _, err := newSmartKeyBackend(map[string]string{property: value}); err == nil {
+			t.Errorf("Test case should fail as %s is %q", property, value)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	/* Name prefix of the keys created by rotation when keyRotationNamePrefix is not configured */
+	defaultKeyRotationNamePrefix = "kubernetes-kms"
+	/* Longest interval between two checks whether the primary key is due for rotation */
+	maxKeyRotationCheckInterval = time.Hour
+)
+
+/*keyRotator promotes a new SmartKey key to primary at the start of each rotation interval. Intervals are aligned on a fixed origin and the key of an interval has a name derived from its start, so every plugin instance rotates to the same key. */
+type keyRotator struct {
+	backend    *smartKeyBackend
+	interval   time.Duration
+	namePrefix string
+	now        func() time.Time
+}
+
+/* newKeyRotator reads the optional keyRotationInterval (eg. "2160h" for 90 days) and keyRotationNamePrefix config properties. It returns nil when rotation is not configured. */
+func newKeyRotator(backend *smartKeyBackend, config map[string]string) (*keyRotator, error) {
+	if _, isPresent := config["keyRotationInterval"]; !isPresent {
+		return nil, nil
+	}
+	interval, err := parseDurationProperty(config, "keyRotationInterval", 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, isPresent := config["stateFile"]; !isPresent {
+		return nil, errors.New("property 'stateFile' is required by 'keyRotationInterval', it records the keys needed to decrypt existing data")
+	}
+	namePrefix, isPresent := config["keyRotationNamePrefix"]
+	if !isPresent {
+		namePrefix = defaultKeyRotationNamePrefix
+	}
+	return &keyRotator{backend: backend, interval: interval, namePrefix: namePrefix, now: time.Now}, nil
+}
+
+/* run rotates the primary key whenever it is due, until stop is closed. */
+func (r *keyRotator) run(stop <-chan struct{}) {
+	checkInterval := r.interval
+	if checkInterval > maxKeyRotationCheckInterval {
+		checkInterval = maxKeyRotationCheckInterval
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := r.rotateIfDue(); err != nil {
+				log.Println("WARNING: Key rotation failed, the current key stays primary:", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+/* rotateIfDue rotates the primary key when it became primary before the start of the current interval, it returns the new primary key or nil. */
+func (r *keyRotator) rotateIfDue() (*keyRecord, error) {
+	primary := r.backend.keys.primary()
+	if !primary.Created.Before(r.intervalStart(r.now())) {
+		return nil, nil
+	}
+	return r.rotate()
+}
+
+/* intervalStart returns the start of the rotation interval of a time, the same on every instance. */
+func (r *keyRotator) intervalStart(now time.Time) time.Time {
+	return now.UTC().Truncate(r.interval)
+}
+
+/* rotate promotes the key of the current interval to primary. The first instance to rotate creates it with the size of the primary key, other instances find it by name. The previous keys stay in the state file to decrypt existing data. */
+func (r *keyRotator) rotate() (*keyRecord, error) {
+	ctx := context.Background()
+	config := r.backend.config
+	current, err := getKeyByID(ctx, config, r.backend.primaryKid())
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.now()
+	name := r.namePrefix + "-" + r.intervalStart(now).Format(smartKeyDateFormat)
+	key, err := findKeyByName(ctx, config, name)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		key, err = createKey(ctx, config, name, current.KeySize)
+		if err != nil {
+			/* Another instance created the key meanwhile, or the key was created but the response was lost */
+			if existing, findErr := findKeyByName(ctx, config, name); findErr == nil && existing != nil {
+				key, err = existing, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if key.Kid == current.Kid {
+		return nil, nil
+	}
+	if err := checkKeyCapabilities(key, now); err != nil {
+		return nil, errors.New("created key " + key.Kid + " is unusable: " + err.Error())
+	}
+
+	record := keyRecord{Kid: key.Kid, Name: name, Created: now}
+	if err := r.backend.keys.promote(record); err != nil {
+		return nil, errors.New("unable to record created key " + key.Kid + ": " + err.Error())
+	}
+	log.Println("Key rotation: key", key.Kid, "("+name+") is now primary, previous key", current.Kid, "is kept for decryption")
+	return &record, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+)
+
+func TestKeyRotation_Positive(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	/* Legacy cipher, written before the key ring was enabled */
+	legacy, err := newTestSmartKeyBackend(t, config).Encrypt(nil, []byte("legacy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config["stateFile"] = filepath.Join(dir, "state.json")
+	config["keyRotationInterval"] = "2160h"
+	backend := newTestSmartKeyBackend(t, config)
+	rotator, err := newKeyRotator(backend, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	beforeRotation, err := backend.Encrypt(nil, []byte("before"))
+	if err != nil || !strings.HasPrefix(string(beforeRotation), "smartkey:uuid-1:") {
+		t.Fatal("Cipher should carry the configured key id", string(beforeRotation), err)
+	}
+
+	/* The primary key is not due yet */
+	if record, err := rotator.rotateIfDue(); record != nil || err != nil {
+		t.Error("Key should not be rotated before the interval", record, err)
+	}
+
+	rotator.now = func() time.Time { return time.Now().Add(91 * 24 * time.Hour) }
+	record, err := rotator.rotateIfDue()
+	if err != nil || record == nil {
+		t.Fatal("Key should be rotated after the interval", err)
+	}
+	if record.Kid == "uuid-1" || !strings.HasPrefix(record.Name, "kubernetes-kms-") || smartkey.RequestCount("create") != 1 {
+		t.Error("A new key should be created", record)
+	}
+
+	afterRotation, err := backend.Encrypt(nil, []byte("after"))
+	if err != nil || !strings.HasPrefix(string(afterRotation), "smartkey:"+record.Kid+":") {
+		t.Fatal("New data should be encrypted with the new key", string(afterRotation), err)
+	}
+	info, err := backend.KeyInfo(nil)
+	if err != nil || info.Kid != record.Kid || info.KeySize != 256 {
+		t.Error("Key info should describe the new primary key", info, err)
+	}
+
+	/* Previous ciphers still decrypt */
+	for cipher, plain := range map[string]string{string(legacy): "legacy", string(beforeRotation): "before", string(afterRotation): "after"} {
+		decrypted, err := backend.Decrypt(nil, []byte(cipher))
+		if err != nil || string(decrypted) != plain {
+			t.Errorf("%q should decrypt after rotation: %v", plain, err)
+		}
+	}
+
+	/* A restarted plugin keeps the rotated key */
+	restarted := newTestSmartKeyBackend(t, config)
+	if restarted.primaryKid() != record.Kid || len(restarted.keys.keys()) != 2 {
+		t.Error("Rotated key should be persisted", restarted.keys.keys())
+	}
+	restartedRotator, err := newKeyRotator(restarted, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := restartedRotator.rotateIfDue(); record != nil {
+		t.Error("Freshly rotated key should not be rotated again")
+	}
+}
+
+func TestKeyRotation_Positive_Batching(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config["stateFile"] = filepath.Join(dir, "state.json")
+	config["keyRotationInterval"] = "1h"
+	config["smartkeyBatchWindow"] = "20ms"
+	backend := newTestSmartKeyBackend(t, config)
+	rotator, _ := newKeyRotator(backend, config)
+
+	legacy, _ := encrypt(config, []byte("legacy"))
+	beforeRotation, err := backend.Encrypt(context.Background(), []byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotator.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	afterRotation, err := backend.Encrypt(context.Background(), []byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* One batch decrypting with three keys */
+	var wg sync.WaitGroup
+	for cipher, plain := range map[string]string{string(legacy): "legacy", string(beforeRotation): "before", string(afterRotation): "after"} {
+		wg.Add(1)
+		go func(cipher string, plain string) {
+			defer wg.Done()
+			decrypted, err := backend.Decrypt(context.Background(), []byte(cipher))
+			if err != nil || string(decrypted) != plain {
+				t.Errorf("%q should decrypt in a batch: %v", plain, err)
+			}
+		}(cipher, plain)
+	}
+	wg.Wait()
+}
+
+func TestKeyRotation_Positive_SeveralInstances(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config["keyRotationInterval"] = "2160h"
+	later := func() time.Time { return time.Now().Add(91 * 24 * time.Hour) }
+	var backends []*smartKeyBackend
+	var kids []string
+	for _, node := range []string{"a", "b"} {
+		nodeConfig := make(map[string]string)
+		for name, value := range config {
+			nodeConfig[name] = value
+		}
+		nodeConfig["stateFile"] = filepath.Join(dir, node+".json")
+		backend := newTestSmartKeyBackend(t, nodeConfig)
+		rotator, _ := newKeyRotator(backend, nodeConfig)
+		rotator.now = later
+		record, err := rotator.rotateIfDue()
+		if err != nil || record == nil {
+			t.Fatal("Key should be rotated on node", node, err)
+		}
+		backends = append(backends, backend)
+		kids = append(kids, record.Kid)
+	}
+	if kids[0] != kids[1] || smartkey.RequestCount("create") != 1 {
+		t.Error("Every node should rotate to the same key, created once", kids, smartkey.RequestCount("create"))
+	}
+
+	/* Each node decrypts the ciphers of the other */
+	cipher, err := backends[0].Encrypt(nil, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := backends[1].Decrypt(nil, cipher); err != nil || string(plain) != "secret" {
+		t.Error("Cipher of another node should decrypt", err)
+	}
+}
+
+func TestKeyRotation_Negative(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if rotator, err := newKeyRotator(nil, config); rotator != nil || err != nil {
+		t.Error("Rotation should be disabled by default")
+	}
+	if _, err := newKeyRotator(nil, map[string]string{"keyRotationInterval": "90d"}); err == nil {
+		t.Error("Test case should fail as the interval is invalid")
+	}
+	if _, err := newKeyRotator(nil, map[string]string{"keyRotationInterval": "2160h"}); err == nil {
+		t.Error("Test case should fail as the state file is missing")
+	}
+
+	/* A failed creation keeps the primary key */
+	config["stateFile"] = filepath.Join(dir, "state.json")
+	config["keyRotationInterval"] = "1h"
+	backend := newTestSmartKeyBackend(t, config)
+	rotator, _ := newKeyRotator(backend, config)
+	smartkey.InjectFailure(smartkeytest.Failure{StatusCode: 500, Times: 1})
+	if _, err := rotator.rotate(); err == nil {
+		t.Error("Test case should fail as SmartKey fails")
+	}
+	if backend.primaryKid() != "uuid-1" {
+		t.Error("Primary key should not change when rotation fails")
+	}
+}
+
+func TestValidateKeys_SmartKey(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config["stateFile"] = filepath.Join(dir, "state.json")
+
+	/* Without state file encryptionKeyUuid is fully validated */
+	smartkey.UpdateKey("uuid-1", func(key *smartkeytest.Key) { key.KeyOps = []string{"DECRYPT"} })
+	if err := validateKeys(config); err == nil || !strings.Contains(err.Error(), "ENCRYPT") {
+		t.Error("Key without ENCRYPT should be rejected before the state file exists, got", err)
+	}
+
+	/* After rotation, the previous key only needs to decrypt and may be deactivated */
+	smartkey.AddKey("uuid-2", 256)
+	macKey, _ := stateFileMacKey(config)
+	ring, err := loadKeyRing(config["stateFile"], macKey, nil, "uuid-1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.promote(keyRecord{Kid: "uuid-2", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	smartkey.UpdateKey("uuid-1", func(key *smartkeytest.Key) { key.DeactivationDate = "20240515T000000Z" })
+	if err := validateKeys(config); err != nil {
+		t.Error("Deactivated previous key should be accepted for decryption", err)
+	}
+
+	smartkey.UpdateKey("uuid-1", func(key *smartkeytest.Key) { key.Enabled = false })
+	if err := validateKeys(config); err == nil || !strings.Contains(err.Error(), "uuid-1") || !strings.Contains(err.Error(), "disabled") {
+		t.Error("Disabled previous key should be rejected, got", err)
+	}
+	smartkey.UpdateKey("uuid-1", func(key *smartkeytest.Key) { key.Enabled = true })
+
+	/* The primary of the ring is fully validated */
+	smartkey.UpdateKey("uuid-2", func(key *smartkeytest.Key) { key.DeactivationDate = "20240515T000000Z" })
+	if err := validateKeys(config); err == nil || !strings.Contains(err.Error(), "uuid-2") || !strings.Contains(err.Error(), "deactivated") {
+		t.Error("Deactivated primary key should be rejected, got", err)
+	}
+}
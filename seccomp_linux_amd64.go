@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	goruntime "runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	/* Syscalls missing from the syscall package */
+	sysSeccomp   = 317
+	sysGetrandom = 318
+	sysStatx     = 332
+	/* seccomp constants, from linux/seccomp.h and linux/audit.h */
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetLog          = 0x7ffc0000
+	seccompRetAllow        = 0x7fff0000
+	auditArchX8664         = 0xc000003e
+	/* Bit set in the syscall numbers of the x32 ABI */
+	x32SyscallBit = 0x40000000
+	/* prctl option setting no_new_privs, required to install a filter without CAP_SYS_ADMIN */
+	prSetNoNewPrivs = 38
+)
+
+/* allowedSyscalls are the syscalls used by the Go runtime and the plugin: files, unix and TCP sockets, memory locking and timers. */
+var allowedSyscalls = []uintptr{
+	/* files */
+	syscall.SYS_READ, syscall.SYS_WRITE, syscall.SYS_OPEN, syscall.SYS_OPENAT, syscall.SYS_CLOSE,
+	syscall.SYS_STAT, syscall.SYS_FSTAT, syscall.SYS_LSTAT, syscall.SYS_NEWFSTATAT, sysStatx,
+	syscall.SYS_LSEEK, syscall.SYS_PREAD64, syscall.SYS_PWRITE64, syscall.SYS_READV, syscall.SYS_WRITEV,
+	syscall.SYS_ACCESS, syscall.SYS_FACCESSAT, syscall.SYS_FCNTL, syscall.SYS_IOCTL, syscall.SYS_FSYNC, syscall.SYS_FDATASYNC,
+	syscall.SYS_FTRUNCATE, syscall.SYS_GETDENTS64, syscall.SYS_GETCWD, syscall.SYS_RENAME, syscall.SYS_RENAMEAT,
+	syscall.SYS_MKDIR, syscall.SYS_MKDIRAT, syscall.SYS_UNLINK, syscall.SYS_UNLINKAT, syscall.SYS_READLINK, syscall.SYS_READLINKAT,
+	syscall.SYS_CHMOD, syscall.SYS_FCHMOD, syscall.SYS_FCHMODAT, syscall.SYS_UMASK,
+	syscall.SYS_PIPE, syscall.SYS_PIPE2, syscall.SYS_DUP, syscall.SYS_DUP2, syscall.SYS_DUP3, syscall.SYS_EVENTFD2,
+	/* sockets and polling */
+	syscall.SYS_SOCKET, syscall.SYS_SOCKETPAIR, syscall.SYS_CONNECT, syscall.SYS_ACCEPT, syscall.SYS_ACCEPT4,
+	syscall.SYS_BIND, syscall.SYS_LISTEN, syscall.SYS_SHUTDOWN, syscall.SYS_GETSOCKNAME, syscall.SYS_GETPEERNAME,
+	syscall.SYS_GETSOCKOPT, syscall.SYS_SETSOCKOPT, syscall.SYS_SENDTO, syscall.SYS_RECVFROM, syscall.SYS_SENDMSG, syscall.SYS_RECVMSG,
+	syscall.SYS_EPOLL_CREATE, syscall.SYS_EPOLL_CREATE1, syscall.SYS_EPOLL_CTL, syscall.SYS_EPOLL_WAIT, syscall.SYS_EPOLL_PWAIT,
+	syscall.SYS_POLL, syscall.SYS_PPOLL, syscall.SYS_SELECT, syscall.SYS_PSELECT6,
+	/* memory */
+	syscall.SYS_MMAP, syscall.SYS_MUNMAP, syscall.SYS_MPROTECT, syscall.SYS_MREMAP, syscall.SYS_MADVISE, syscall.SYS_BRK,
+	syscall.SYS_MLOCK, syscall.SYS_MUNLOCK, syscall.SYS_MLOCKALL,
+	/* threads, signals and time */
+	syscall.SYS_CLONE, syscall.SYS_EXIT, syscall.SYS_EXIT_GROUP, syscall.SYS_FUTEX, syscall.SYS_SET_ROBUST_LIST, syscall.SYS_SET_TID_ADDRESS,
+	syscall.SYS_ARCH_PRCTL, syscall.SYS_PRCTL, syscall.SYS_SCHED_YIELD, syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_RT_SIGACTION, syscall.SYS_RT_SIGPROCMASK, syscall.SYS_RT_SIGRETURN, syscall.SYS_SIGALTSTACK, syscall.SYS_TGKILL, syscall.SYS_TKILL,
+	syscall.SYS_NANOSLEEP, syscall.SYS_CLOCK_GETTIME, syscall.SYS_CLOCK_GETRES, syscall.SYS_CLOCK_NANOSLEEP, syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_SETITIMER, syscall.SYS_TIMER_CREATE, syscall.SYS_TIMER_SETTIME, syscall.SYS_TIMER_DELETE, syscall.SYS_RESTART_SYSCALL,
+	/* process information */
+	syscall.SYS_GETPID, syscall.SYS_GETTID, syscall.SYS_GETPPID, syscall.SYS_GETUID, syscall.SYS_GETEUID, syscall.SYS_GETGID, syscall.SYS_GETEGID,
+	syscall.SYS_UNAME, syscall.SYS_GETRLIMIT, syscall.SYS_PRLIMIT64, syscall.SYS_GETRUSAGE, syscall.SYS_SYSINFO, sysGetrandom,
+	sysPidfdOpen, sysPidfdSendSignal,
+}
+
+/* seccompProgram returns a BPF program allowing allowedSyscalls of the x86_64 ABI and answering other syscalls with EPERM, or logging them when enforce is false. */
+func seccompProgram(enforce bool) []syscall.SockFilter {
+	defaultAction := uint32(seccompRetLog)
+	if enforce {
+		defaultAction = seccompRetErrno | uint32(syscall.EPERM)
+	}
+	count := len(allowedSyscalls)
+
+	program := []syscall.SockFilter{
+		/* Kill processes switching to another ABI, syscall numbers would not match */
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 4},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: auditArchX8664},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetKillProcess},
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 0},
+		{Code: syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K, Jt: uint8(count), K: x32SyscallBit},
+	}
+	for i, nr := range allowedSyscalls {
+		program = append(program, syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: uint8(count - i), K: uint32(nr)})
+	}
+	return append(program,
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: defaultAction},
+		syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow})
+}
+
+/* installSeccompFilter sets no_new_privs and installs the seccomp program on every thread of the process, it cannot be removed. */
+func installSeccompFilter(enforce bool) error {
+	program := seccompProgram(enforce)
+	fprog := syscall.SockFprog{Len: uint16(len(program)), Filter: &program[0]}
+
+	/* no_new_privs is synchronised to the other threads with the filter */
+	goruntime.LockOSThread()
+	defer goruntime.UnlockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errors.New("unable to set no_new_privs: " + errno.Error())
+	}
+	thread, _, errno := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return errno
+	}
+	if thread != 0 {
+		return errors.New("thread " + strconv.Itoa(int(thread)) + " cannot be synchronised")
+	}
+	return nil
+}
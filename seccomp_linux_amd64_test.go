@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	k8spb "smartkey-kubernetes-kms/v1beta1"
+)
+
+func TestSeccompProgram(t *testing.T) {
+	for _, enforce := range []bool{true, false} {
+		program := seccompProgram(enforce)
+		if len(program) != len(allowedSyscalls)+7 {
+			t.Fatal("Program should check the ABI and every allowed syscall, got", len(program), "instructions")
+		}
+		if program[1].K != auditArchX8664 || program[2].K != seccompRetKillProcess {
+			t.Error("Program should kill processes of another ABI")
+		}
+		/* Every allowed syscall jumps to the last instruction */
+		for i := range allowedSyscalls {
+			index := 5 + i
+			if index+int(program[index].Jt)+1 != len(program)-1 {
+				t.Error("Syscall", allowedSyscalls[i], "does not jump to allow")
+			}
+		}
+		if program[len(program)-1].K != seccompRetAllow {
+			t.Error("Last instruction should allow the syscall")
+		}
+		defaultAction := program[len(program)-2].K
+		if enforce && defaultAction != seccompRetErrno|uint32(syscall.EPERM) || !enforce && defaultAction != seccompRetLog {
+			t.Error("Unexpected default action", defaultAction, "with enforce", enforce)
+		}
+	}
+}
+
+func TestInstallSeccompFilter_Enforce(t *testing.T) {
+	if os.Getenv("SMARTKEY_TEST_SECCOMP") == "" {
+		runTestSubprocess(t, "TestInstallSeccompFilter_Enforce", "SMARTKEY_TEST_SECCOMP")
+		return
+	}
+
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	if err := installSeccompFilter(true); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The plugin keeps working under the filter: socket, gRPC and SmartKey calls */
+	client, stop := startTestPlugin(t, config, newTestSmartKeyBackend(t, config))
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	encrypted, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: encrypted.Cipher})
+	if err != nil || string(decrypted.Plain) != "secret" {
+		t.Fatal("Round trip failed under the seccomp filter", err)
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PTRACE, syscall.PTRACE_TRACEME, 0, 0); errno != syscall.EPERM {
+		t.Error("Syscalls outside the allow list should fail with EPERM, got", errno)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux || !amd64
+// +build !linux !amd64
+
+package main
+
+import (
+	"errors"
+)
+
+/* installSeccompFilter is only implemented on linux/amd64, syscall numbers depend on the architecture. */
+func installSeccompFilter(enforce bool) error {
+	return errors.New("not supported on this platform")
+}
@@ -4,17 +4,24 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/net/trace"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	k8spb "smartkey-kubernetes-kms/v1beta1"
 )
@@ -24,15 +31,33 @@ const (
 	netProtocol     = "unix"
 	version         = "v1beta1"
 	runtime         = "Equinix SmartKey"
-	runtimeVersion  = "0.1.0"
 	maxRetryTimeout = 60
 	retryIncrement  = 5
+
+	/* Largest object stored by the apiserver, its request body limit is 3 MiB */
+	maxObjectSize = 3 * 1024 * 1024
+	/* Largest gRPC message, room for a base64 encoded cipher of maxObjectSize */
+	maxMessageSize = 2 * maxObjectSize
+
+	/* Listen address of the debug HTTP server serving /debug/vars, /version and /readyz */
+	defaultDebugListenAddr = "127.0.0.1:7901"
+
+	/* Timeout of a backend call shared by coalesced Decrypt requests, it is cancelled earlier when every request gave up */
+	sharedDecryptTimeout = 30 * time.Second
 )
 
+/* Decrypt calls which shared the backend call of a concurrent identical request, on /debug/vars */
+var coalescedDecrypts = expvar.NewInt("decrypt_coalesced")
+
+/* KMS API versions accepted in requests */
+var supportedVersions = []string{version}
+
 /*CommandArgs ...*/
 type CommandArgs struct {
-	socketFile string
-	configFile string
+	socketFile           string
+	configFile           string
+	insecureLocalBackend bool
+	debugListenAddr      string
 }
 
 /*KeyManagementServiceServer is a gRPC server. */
@@ -42,24 +67,61 @@ type KeyManagementServiceServer struct {
 	providerKeyName    *string
 	providerKeyVersion *string
 	net.Listener
-	config map[string]string
+	config  map[string]string
+	backend Backend
+	limits  *requestLimits
+	/* decrypts groups concurrent Decrypt calls of the same cipher into one backend call */
+	decrypts singleflight.Group
+	/* sharedDecrypts are the contexts of the calls of decrypts, by cipher */
+	sharedDecryptsMutex sync.Mutex
+	sharedDecrypts      map[string]*sharedDecrypt
+	/* peers allows the processes connecting to the socket, nil when every process is allowed */
+	peers *peerPolicy
 }
 
-/*New creates instance of KeyManagementServiceServer and initialize the member variables. */
+/*New creates instance of KeyManagementServiceServer backed by SmartKey and initialize the member variables. */
 func New(pathToUnixSocketFile string, config map[string]string) (*KeyManagementServiceServer, error) {
+	backend, err := newSmartKeyBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithBackend(pathToUnixSocketFile, config, backend)
+}
+
+/*NewWithBackend creates instance of KeyManagementServiceServer using the given backend for cryptographic operations. */
+func NewWithBackend(pathToUnixSocketFile string, config map[string]string, backend Backend) (*KeyManagementServiceServer, error) {
+	if backend == nil {
+		return nil, errors.New("backend not specified")
+	}
+	limits, err := newRequestLimits(config)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := newPeerPolicy(config)
+	if err != nil {
+		return nil, err
+	}
 	keyManagementServiceServer := new(KeyManagementServiceServer)
 	keyManagementServiceServer.pathToUnixSocket = pathToUnixSocketFile
 	keyManagementServiceServer.config = config
+	keyManagementServiceServer.backend = backend
+	keyManagementServiceServer.limits = limits
+	keyManagementServiceServer.peers = peers
 
 	return keyManagementServiceServer, nil
 }
 
-/* This is a function to parse command line parameters. */
-func parseCmd() (CommandArgs, error) {
-	socketFile := flag.String("socketFile", "", "socket file that gRpc server listens to")
-	configFile := flag.String("config", "", "config file location")
-	flag.Parse()
+/* This is a function to parse command line parameters of the serve command. */
+func parseCmd(args []string) (CommandArgs, error) {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	socketFile := flags.String("socketFile", "", "socket file that gRpc server listens to")
+	configFile := flags.String("config", "", "config file location")
+	insecureLocalBackend := flags.Bool("insecureLocalBackend", false, "allow the insecure local key file backend, for development only")
+	debugListenAddr := flags.String("debug-listen-addr", defaultDebugListenAddr, "HTTP listen address.")
 	var cmdArgs CommandArgs
+	if err := flags.Parse(args); err != nil {
+		return cmdArgs, err
+	}
 
 	if len(*socketFile) == 0 {
 		return cmdArgs, errors.New("socketFile parameter not specified")
@@ -70,8 +132,10 @@ func parseCmd() (CommandArgs, error) {
 	}
 
 	cmdArgs = CommandArgs{
-		socketFile: *socketFile,
-		configFile: *configFile,
+		socketFile:           *socketFile,
+		configFile:           *configFile,
+		insecureLocalBackend: *insecureLocalBackend,
+		debugListenAddr:      *debugListenAddr,
 	}
 	return cmdArgs, nil
 }
@@ -94,13 +158,24 @@ func parseConfigFile(configFilePath string) (map[string]string, error) {
 	_, isIvPresent := config["iv"]
 	_, issocketFilePresent := config["socketFile"]
 	_, issmartkeyURLPresent := config["smartkeyURL"]
+	_, isLocalKeyFilePresent := config["localKeyFile"]
+	_, isRecoveryMode := config["escrowFile"]
+
+	backendName := config["backend"]
+	if backendName == "" {
+		backendName = smartKeyBackendName
+	}
+	if backendName != smartKeyBackendName && backendName != localBackendName {
+		return nil, errors.New("property 'backend' is invalid in config file " + configFilePath)
+	}
+	isSmartKey := backendName == smartKeyBackendName
 
 	/* check mandatory fields are define in config file */
-	if isAPIKeyPresent == false {
+	if isSmartKey && isAPIKeyPresent == false {
 		return nil, errors.New("property 'smartkeyApiKey' missing in config file " + configFilePath)
 	}
 
-	if isEnckeyUUIDPresent == false {
+	if isSmartKey && isEnckeyUUIDPresent == false {
 		return nil, errors.New("property 'encryptionKeyUuid' missing in config file " + configFilePath)
 	}
 
@@ -112,20 +187,38 @@ func parseConfigFile(configFilePath string) (map[string]string, error) {
 		return nil, errors.New("property 'socketFile' missing in config file " + configFilePath)
 	}
 
-	if issmartkeyURLPresent == false {
+	if isSmartKey && issmartkeyURLPresent == false {
 		return nil, errors.New("property 'smartkeyURL' missing in config file " + configFilePath)
 	}
+
+	if !isSmartKey && isLocalKeyFilePresent == false {
+		return nil, errors.New("property 'localKeyFile' missing in config file " + configFilePath)
+	}
 	/* end of check mandatory fields are define in config file */
 
 	/* validate Api key and AES key */
-	_, err = auth(config)
-	if err != nil {
-		return nil, errors.New("property 'smartkeyApiKey' is invalid in config file " + configFilePath)
-	}
+	if isSmartKey {
+		if _, err := newEndpointPool(config); err != nil {
+			return nil, errors.New(err.Error() + " in config file " + configFilePath)
+		}
 
-	_, err = validateKey(config)
-	if err != nil {
-		return nil, errors.New("property 'encryptionKeyUuid' is invalid in config file " + configFilePath)
+		_, err = auth(context.Background(), config)
+		if err != nil && isRecoveryMode {
+			/* Recovery mode serves escrowed DEKs while SmartKey is unavailable */
+			log.Println("WARNING: SmartKey is unavailable in recovery mode:", err)
+		} else if err != nil {
+			return nil, errors.New("property 'smartkeyApiKey' is invalid in config file " + configFilePath + ": " + err.Error())
+		} else {
+			err = validateKeys(config)
+			if err != nil {
+				return nil, errors.New("property 'encryptionKeyUuid' is invalid in config file " + configFilePath + ": " + err.Error())
+			}
+		}
+	} else {
+		_, err = readLocalKeyFile(config["localKeyFile"])
+		if err != nil {
+			return nil, errors.New("property 'localKeyFile' is invalid in config file " + configFilePath + ": " + err.Error())
+		}
 	}
 
 	decodeIv, decodeIvErr := base64.StdEncoding.DecodeString(config["iv"])
@@ -138,58 +231,139 @@ func parseConfigFile(configFilePath string) (map[string]string, error) {
 
 	/* end of Api key and AES key */
 
+	if _, err := newRequestLimits(config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if _, err := newPeerPolicy(config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if _, err := newSmartKeyRateLimiter(config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if _, _, err := parseBatchConfig(config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if _, err := newKeyMonitor(nil, config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if _, err := newKeyRotator(nil, config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if secondaryConfigFile, isPresent := config["secondaryConfigFile"]; isPresent {
+		if _, err := parseSecondaryConfigFile(secondaryConfigFile); err != nil {
+			return nil, errors.New("property 'secondaryConfigFile' is invalid in config file " + configFilePath + ": " + err.Error())
+		}
+	}
+	if _, isPresent := config["escrowPrivateKeyFile"]; isPresent != isRecoveryMode {
+		return nil, errors.New("properties 'escrowFile' and 'escrowPrivateKeyFile' must be set together in config file " + configFilePath)
+	}
+	if isRecoveryMode {
+		if _, err := readRSAPrivateKey(config["escrowPrivateKeyFile"]); err != nil {
+			return nil, errors.New("property 'escrowPrivateKeyFile' is invalid in config file " + configFilePath + ": " + err.Error())
+		}
+	}
+	if _, err := parseSeccompMode(config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if _, err := parseLockMemory(config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if _, err := parseTrustedKeyIDs(config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if _, err := stateFileMacKey(config); err != nil {
+		return nil, errors.New(err.Error() + " in config file " + configFilePath)
+	}
+	if !isSmartKey && (len(config["stateFile"]) > 0 || len(config["keyRotationInterval"]) > 0) {
+		return nil, errors.New("properties 'stateFile' and 'keyRotationInterval' require the smartkey backend in config file " + configFilePath)
+	}
+
 	return config, nil
 }
 
 /* This is the main function. */
 func main() {
+	if err := runCommand(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+/* runServe handles the serve command which runs the gRPC server until SIGTERM. */
+func runServe(args []string) error {
 	/* Parse command line arguments */
-	cmdArgs, commandErr := parseCmd()
+	cmdArgs, commandErr := parseCmd(args)
 	if commandErr != nil {
-		log.Fatal(commandErr)
+		return commandErr
 	}
 
 	configProperties, fileErr := parseConfigFile(cmdArgs.configFile)
 	if fileErr != nil {
-		log.Fatal(fileErr)
+		return fileErr
 	}
 
-	var (
-		debugListenAddr = flag.String("debug-listen-addr", "127.0.0.1:7901", "HTTP listen address.")
-	)
-
 	sigChan := make(chan os.Signal, 1)
 	/* Register signal handler for SIGTERM */
 	signal.Notify(sigChan, syscall.SIGTERM)
 
 	log.Println("KeyManagementServiceServer service starting...")
 
-	smartkeyServer, err := New(configProperties["socketFile"], configProperties)
-	if err != nil {
-		log.Fatalf("Failed to start, error: %v", err)
+	/* Before keys are loaded, so they are never swapped or dumped */
+	if err := protectMemory(configProperties); err != nil {
+		return errors.New("Failed to start, error: " + err.Error())
 	}
 
-	if err := smartkeyServer.cleanSockFile(); err != nil {
-		log.Fatalf("Failed to clean sockfile, error: %v", err)
+	backend, err := newBackend(configProperties, cmdArgs.insecureLocalBackend)
+	if err != nil {
+		return errors.New("Failed to start, error: " + err.Error())
 	}
 
-	listener, err := net.Listen(netProtocol, smartkeyServer.pathToUnixSocket)
+	smartkeyServer, err := NewWithBackend(configProperties["socketFile"], configProperties, backend)
 	if err != nil {
-		log.Fatalf("Failed to start listener, error: %v", err)
+		return errors.New("Failed to start, error: " + err.Error())
+	}
+	if smartkeyServer.peers == nil {
+		log.Println("WARNING: every process able to connect to the socket can call the plugin, set allowedPeerUids or allowedPeerGids")
+	}
 
-		/* Clean the socket file if it exists */
-		if err := smartkeyServer.cleanSockFile(); err != nil {
-			log.Fatalf("Failed to clean sockfile, error: %v", err)
+	if smartKey, ok := smartKeyBackendOf(backend); ok {
+		endpoints, err := smartKeyEndpoints(configProperties)
+		if err != nil {
+			return errors.New("Failed to start, error: " + err.Error())
+		}
+		go endpoints.run(nil)
+
+		rotator, err := newKeyRotator(smartKey, configProperties)
+		if err != nil {
+			return errors.New("Failed to start, error: " + err.Error())
+		}
+		if rotator != nil {
+			if _, err := rotator.rotateIfDue(); err != nil {
+				log.Println("WARNING: Key rotation failed, the current key stays primary:", err)
+			}
+			go rotator.run(nil)
 		}
 	}
-	smartkeyServer.Listener = listener
 
-	server := grpc.NewServer()
-	k8spb.RegisterKeyManagementServiceServer(server, smartkeyServer)
-	smartkeyServer.Server = server
+	monitor, err := newKeyMonitor(backend, configProperties)
+	if err != nil {
+		return errors.New("Failed to start, error: " + err.Error())
+	}
+	monitor.check()
+	go monitor.run(nil)
+	http.HandleFunc("/readyz", monitor.serveReadiness)
+
+	if err := smartkeyServer.startServer(); err != nil {
+		return errors.New("Failed to start listener, error: " + err.Error())
+	}
+	server := smartkeyServer.Server
+
+	if err := hardenProcess(configProperties); err != nil {
+		return errors.New("Failed to start, error: " + err.Error())
+	}
 
-	go server.Serve(listener)
 	trace.AuthRequest = func(req *http.Request) (any, sensitive bool) { return true, true }
+	http.HandleFunc("/version", serveVersion)
+	log.Println(runtime, runtimeVersion, "commit", gitCommit, "built", buildDate)
 	log.Println("KeyManagementServiceServer service started successfully.")
 
 	go func() {
@@ -203,32 +377,164 @@ func main() {
 			}
 		}
 	}()
-	log.Fatal(http.ListenAndServe(*debugListenAddr, nil))
+	return http.ListenAndServe(cmdArgs.debugListenAddr, nil)
+}
+
+/*startServer listens on the unix socket and serves gRPC requests in the background. */
+func (s *KeyManagementServiceServer) startServer() error {
+	if err := s.cleanSockFile(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen(netProtocol, s.pathToUnixSocket)
+	if err != nil {
+		/* Clean the socket file if it exists */
+		s.cleanSockFile()
+		return err
+	}
+	s.Listener = listener
+
+	options := []grpc.ServerOption{grpc.MaxRecvMsgSize(maxMessageSize), grpc.MaxSendMsgSize(maxMessageSize)}
+	if s.peers != nil {
+		options = append(options, grpc.Creds(peerCredentials{}), grpc.UnaryInterceptor(s.peers.authorize))
+	}
+	server := grpc.NewServer(options...)
+	k8spb.RegisterKeyManagementServiceServer(server, s)
+	s.Server = server
+
+	go server.Serve(listener)
+	return nil
+}
+
+/*checkVersion returns a FailedPrecondition error when the API version declared in a request is not supported. */
+func checkVersion(requestVersion string) error {
+	for _, supportedVersion := range supportedVersions {
+		if requestVersion == supportedVersion {
+			return nil
+		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "unsupported KMS API version %q, supported versions: %s",
+		requestVersion, strings.Join(supportedVersions, ", "))
 }
 
 /*Version returns version informatino for the gRPC server. */
 func (s *KeyManagementServiceServer) Version(ctx context.Context, request *k8spb.VersionRequest) (*k8spb.VersionResponse, error) {
 	log.Println(version)
+	if err := checkVersion(request.GetVersion()); err != nil {
+		log.Println("Rejected VersionRequest:", err)
+		return nil, err
+	}
 
-	return &k8spb.VersionResponse{Version: version, RuntimeName: "vault", RuntimeVersion: runtimeVersion}, nil
+	return &k8spb.VersionResponse{Version: version, RuntimeName: runtime, RuntimeVersion: runtimeVersion}, nil
 }
 
 /*Encrypt function returns encrypted data. */
 func (s *KeyManagementServiceServer) Encrypt(ctx context.Context, request *k8spb.EncryptRequest) (*k8spb.EncryptResponse, error) {
 
 	log.Println("Processing EncryptRequest: ")
+	if err := checkVersion(request.GetVersion()); err != nil {
+		log.Println("Rejected EncryptRequest:", err)
+		return nil, err
+	}
 
-	response, err := encrypt(s.config, string(request.Plain))
-	return &k8spb.EncryptResponse{Cipher: []byte(response)}, err
+	release, err := s.limits.acquire(ctx, s.limits.encrypt)
+	if err != nil {
+		log.Println("Rejected EncryptRequest:", err)
+		return nil, err
+	}
+	defer release()
+
+	response, err := s.backend.Encrypt(ctx, request.Plain)
+	if err == nil {
+		/* A batch cancelled with ctx may still read the plain data, it is only zeroed once encrypted */
+		zeroBytes(request.Plain)
+	}
+	return &k8spb.EncryptResponse{Cipher: response}, err
 }
 
 /*Decrypt function returns decrypted data. */
 func (s *KeyManagementServiceServer) Decrypt(ctx context.Context, request *k8spb.DecryptRequest) (*k8spb.DecryptResponse, error) {
 
 	log.Println("Processing DecryptRequest: ")
+	if err := checkVersion(request.GetVersion()); err != nil {
+		log.Println("Rejected DecryptRequest:", err)
+		return nil, err
+	}
 
-	response, err := decrypt(s.config, string(request.Cipher))
-	return &k8spb.DecryptResponse{Plain: []byte(response)}, err
+	/* Watch caches of several apiservers decrypt the same objects at the same time, only the first caller reaches the backend. The shared call must not fail when that caller gives up, each caller only waits for it until its own context is done. */
+	results := s.joinDecrypt(string(request.Cipher), func(sharedCtx context.Context) (interface{}, error) {
+		release, err := s.limits.acquire(sharedCtx, s.limits.decrypt)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return s.backend.Decrypt(sharedCtx, request.Cipher)
+	})
+	defer s.leaveDecrypt(string(request.Cipher))
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var result singleflight.Result
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		err := status.FromContextError(ctx.Err()).Err()
+		log.Println("DecryptRequest failed:", err)
+		return nil, err
+	}
+	if result.Shared {
+		coalescedDecrypts.Add(1)
+	}
+	if result.Err != nil {
+		log.Println("DecryptRequest failed:", result.Err)
+		return nil, result.Err
+	}
+	countKeyDecrypt(s.backend, request.Cipher)
+	plain := result.Val.([]byte)
+	if result.Shared {
+		/* Every caller gets its own copy, the response of one caller may be zeroed or changed while others use it */
+		plain = append([]byte(nil), plain...)
+	}
+	return &k8spb.DecryptResponse{Plain: plain}, nil
+}
+
+/*sharedDecrypt is the context of a backend call shared by coalesced Decrypt requests, cancelled when the last of its waiters leaves. */
+type sharedDecrypt struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+/* joinDecrypt waits for the shared call decrypting cipher, starting it with fn when there is none. Every joinDecrypt is followed by leaveDecrypt. */
+func (s *KeyManagementServiceServer) joinDecrypt(cipher string, fn func(sharedCtx context.Context) (interface{}, error)) <-chan singleflight.Result {
+	s.sharedDecryptsMutex.Lock()
+	defer s.sharedDecryptsMutex.Unlock()
+	if s.sharedDecrypts == nil {
+		s.sharedDecrypts = make(map[string]*sharedDecrypt)
+	}
+	shared, ok := s.sharedDecrypts[cipher]
+	if !ok {
+		shared = &sharedDecrypt{}
+		shared.ctx, shared.cancel = context.WithTimeout(context.Background(), sharedDecryptTimeout)
+		s.sharedDecrypts[cipher] = shared
+	}
+	shared.waiters++
+	return s.decrypts.DoChan(cipher, func() (interface{}, error) {
+		return fn(shared.ctx)
+	})
+}
+
+/* leaveDecrypt stops waiting for the shared call decrypting cipher. The last waiter cancels it, so its request limiter slot and SmartKey call are released, and later requests start a new call. */
+func (s *KeyManagementServiceServer) leaveDecrypt(cipher string) {
+	s.sharedDecryptsMutex.Lock()
+	defer s.sharedDecryptsMutex.Unlock()
+	shared := s.sharedDecrypts[cipher]
+	if shared.waiters--; shared.waiters > 0 {
+		return
+	}
+	shared.cancel()
+	delete(s.sharedDecrypts, cipher)
+	s.decrypts.Forget(cipher)
 }
 
 /*cleanSockFile function cleans the unix socker created for the gRPC server. */
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"github.com/jarcoal/httpmock"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/quick"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"smartkey-kubernetes-kms/smartkeytest"
+	k8spb "smartkey-kubernetes-kms/v1beta1"
 )
 
 func TestNew(t *testing.T) {
@@ -20,12 +33,12 @@ func TestVersion(t *testing.T) {
 	config := make(map[string]string)
 	serv, err := New("/path/to/sock/file", config)
 
-	val, err := serv.Version(nil, nil)
+	val, err := serv.Version(nil, &k8spb.VersionRequest{Version: "v1beta1"})
 
 	if err != nil {
 		t.Error(err)
 	}
-	if val.Version != "v1beta1" || val.RuntimeName != "vault" || val.RuntimeVersion != "0.1.0" {
+	if val.Version != "v1beta1" || val.RuntimeName != "Equinix SmartKey" || val.RuntimeVersion != runtimeVersion {
 		t.Error("Invalid version info")
 	}
 }
@@ -53,7 +66,7 @@ func TestParseConfigFile_Positive_ValidFile(t *testing.T) {
 		httpmock.NewStringResponder(200, `{"expires_in": 0,"access_token": "","entity_id": ""}`))
 
 	httpmock.RegisterResponder("GET", "www.smartkey.io/crypto/v1/keys/uuid-1",
-		httpmock.NewStringResponder(200, `{"key_size": 256, "obj_type": "AES"}`))
+		httpmock.NewStringResponder(200, `{"key_size": 256, "obj_type": "AES", "key_ops": ["ENCRYPT", "DECRYPT"], "enabled": true}`))
 
 	configData := []byte("{\"" +
 		"smartkeyApiKey\": \"your-api-key\"," +
@@ -177,7 +190,7 @@ func TestParseConfigFile_Negative_ApiKeyInvalid(t *testing.T) {
 		httpmock.NewStringResponder(400, `{"expires_in": 0,"access_token": "","entity_id": ""}`))
 
 	httpmock.RegisterResponder("GET", "www.smartkey.io/crypto/v1/keys/uuid-1",
-		httpmock.NewStringResponder(200, `{"key_size": 256, "obj_type": "AES"}`))
+		httpmock.NewStringResponder(200, `{"key_size": 256, "obj_type": "AES", "key_ops": ["ENCRYPT", "DECRYPT"], "enabled": true}`))
 
 	configData := []byte("{\"" +
 		"smartkeyApiKey\": \"your-api-key\"," +
@@ -233,7 +246,7 @@ func TestParseConfigFile_Negative_IvInvalid(t *testing.T) {
 		httpmock.NewStringResponder(200, `{"expires_in": 0,"access_token": "","entity_id": ""}`))
 
 	httpmock.RegisterResponder("GET", "www.smartkey.io/crypto/v1/keys/uuid-1",
-		httpmock.NewStringResponder(200, `{"key_size": 256, "obj_type": "AES"}`))
+		httpmock.NewStringResponder(200, `{"key_size": 256, "obj_type": "AES", "key_ops": ["ENCRYPT", "DECRYPT"], "enabled": true}`))
 
 	configData := []byte("{\"" +
 		"smartkeyApiKey\": \"your-api-key\"," +
@@ -252,3 +265,330 @@ func TestParseConfigFile_Negative_IvInvalid(t *testing.T) {
 		t.Error("Test case should fail as [encryptionKeyUuid] is invalid")
 	}
 }
+
+func TestEncryptDecrypt_LocalBackend(t *testing.T) {
+	serv, err := NewWithBackend("/path/to/sock/file", make(map[string]string), newTestLocalBackend(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := serv.Encrypt(nil, &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := serv.Decrypt(nil, &k8spb.DecryptRequest{Version: version, Cipher: encrypted.Cipher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted.Plain) != "secret" {
+		t.Error("Decrypted data does not match plain data")
+	}
+}
+
+func TestNewWithBackend_Negative_NoBackend(t *testing.T) {
+	_, err := NewWithBackend("/path/to/sock/file", make(map[string]string), nil)
+
+	if err == nil {
+		t.Error("Test case should fail as backend is missing")
+	}
+}
+
+func TestParseConfigFile_Positive_LocalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartkey-kms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "local.key")
+	if err := generateLocalKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	configData := []byte("{\"" +
+		"backend\": \"local\"," +
+		"\"localKeyFile\": \"" + keyFile + "\"," +
+		"\"iv\": \"rFvgbU6EygpLUObqFZxITg==\"," +
+		"\"socketFile\": \"unix-sockfile-path\"" +
+		"}")
+	ioutil.WriteFile("smartkey-grpc_tmp.conf", configData, 0644)
+
+	_, err = parseConfigFile("smartkey-grpc_tmp.conf")
+
+	os.Remove("smartkey-grpc_tmp.conf")
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseConfigFile_Negative_LocalKeyFileMissing(t *testing.T) {
+	configData := []byte("{\"" +
+		"backend\": \"local\"," +
+		"\"iv\": \"rFvgbU6EygpLUObqFZxITg==\"," +
+		"\"socketFile\": \"unix-sockfile-path\"" +
+		"}")
+	ioutil.WriteFile("smartkey-grpc_tmp.conf", configData, 0644)
+
+	_, err := parseConfigFile("smartkey-grpc_tmp.conf")
+
+	os.Remove("smartkey-grpc_tmp.conf")
+
+	if err == nil {
+		t.Error("Test case should fail as [localKeyFile] is missing")
+	}
+}
+
+func TestEncryptDecrypt_Property_BinaryRoundTrip(t *testing.T) {
+	serv, err := NewWithBackend("/path/to/sock/file", make(map[string]string), newTestLocalBackend(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip := func(plain []byte) bool {
+		/* Encrypt zeroes the plain data of the request */
+		encrypted, err := serv.Encrypt(nil, &k8spb.EncryptRequest{Version: version, Plain: append([]byte(nil), plain...)})
+		if err != nil {
+			return false
+		}
+		decrypted, err := serv.Decrypt(nil, &k8spb.DecryptRequest{Version: version, Cipher: encrypted.Cipher})
+		return err == nil && bytes.Equal(decrypted.Plain, plain)
+	}
+
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 20, Values: randomPayloads}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVersionCheck_Negative_UnsupportedVersion(t *testing.T) {
+	serv, err := NewWithBackend("/path/to/sock/file", make(map[string]string), newTestLocalBackend(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, requestVersion := range []string{"", "v1", "v2beta1"} {
+		_, err = serv.Version(nil, &k8spb.VersionRequest{Version: requestVersion})
+		if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "v1beta1") {
+			t.Errorf("Version should be rejected for %q, got %v", requestVersion, err)
+		}
+
+		_, err = serv.Encrypt(nil, &k8spb.EncryptRequest{Version: requestVersion, Plain: []byte("secret")})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("Encrypt should be rejected for %q, got %v", requestVersion, err)
+		}
+
+		_, err = serv.Decrypt(nil, &k8spb.DecryptRequest{Version: requestVersion, Cipher: []byte("c2VjcmV0")})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("Decrypt should be rejected for %q, got %v", requestVersion, err)
+		}
+	}
+
+	if _, err := serv.Version(nil, nil); status.Code(err) != codes.FailedPrecondition {
+		t.Error("Request without version should be rejected")
+	}
+}
+
+func TestDecrypt_Positive_Coalesced(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+
+	client, stop := startTestPlugin(t, config, newTestSmartKeyBackend(t, config))
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	encrypted, err := client.Encrypt(ctx, &k8spb.EncryptRequest{Version: version, Plain: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coalescedBefore := coalescedDecrypts.Value()
+	decryptsBefore := keyDecrypts("uuid-1")
+
+	/* Slow SmartKey, so every request arrives while the first one is in flight */
+	smartkey.InjectFailure(smartkeytest.Failure{Latency: 500 * time.Millisecond})
+	const callers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decrypted, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: encrypted.Cipher})
+			if err != nil || string(decrypted.Plain) != "secret" {
+				t.Error("Coalesced decryption failed", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := smartkey.RequestCount("decrypt"); count != 1 {
+		t.Error("Concurrent identical requests should call SmartKey once, called", count)
+	}
+	if coalescedDecrypts.Value()-coalescedBefore != callers {
+		t.Error("Coalesced requests should be counted, got", coalescedDecrypts.Value()-coalescedBefore)
+	}
+	if count := keyDecrypts("uuid-1") - decryptsBefore; count != callers {
+		t.Error("Each coalesced request should be counted for its key, got", count)
+	}
+
+	/* Later requests call the backend again */
+	smartkey.ClearFailure()
+	if _, err := client.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: encrypted.Cipher}); err != nil {
+		t.Fatal(err)
+	}
+	if smartkey.RequestCount("decrypt") != 2 {
+		t.Error("Results should not be cached after the call completes")
+	}
+}
+
+func TestDecrypt_Negative_CoalescedError(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+
+	serv, err := NewWithBackend("/path/to/sock/file", config, newTestSmartKeyBackend(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	smartkey.InjectFailure(smartkeytest.Failure{Latency: 300 * time.Millisecond, StatusCode: 500})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := serv.Decrypt(context.Background(), &k8spb.DecryptRequest{Version: version, Cipher: []byte("c2VjcmV0")}); err == nil {
+				t.Error("Every caller should receive the backend error")
+			}
+		}()
+	}
+	wg.Wait()
+	if count := smartkey.RequestCount("decrypt"); count != 1 {
+		t.Error("Concurrent failing requests should call SmartKey once, called", count)
+	}
+}
+
+func TestDecrypt_Positive_CoalescedCallerDeadlines(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+
+	serv, err := NewWithBackend("/path/to/sock/file", config, newTestSmartKeyBackend(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := serv.backend.Encrypt(context.Background(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* The first caller gives up while SmartKey answers, the second caller still gets the shared result */
+	smartkey.InjectFailure(smartkeytest.Failure{Latency: 500 * time.Millisecond, Times: 1})
+	impatient, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		start := time.Now()
+		_, err := serv.Decrypt(impatient, &k8spb.DecryptRequest{Version: version, Cipher: cipher})
+		if status.Code(err) != codes.DeadlineExceeded || time.Since(start) > 400*time.Millisecond {
+			t.Error("Caller should stop waiting at its own deadline, got", err, time.Since(start))
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	first, err := serv.Decrypt(context.Background(), &k8spb.DecryptRequest{Version: version, Cipher: cipher})
+	wg.Wait()
+	if err != nil || string(first.Plain) != "secret" {
+		t.Fatal("Shared call should not be cancelled by the first caller", err)
+	}
+	if count := smartkey.RequestCount("decrypt"); count != 1 {
+		t.Error("Requests should share one SmartKey call, called", count)
+	}
+
+	/* Shared callers get their own copy of the plain data */
+	smartkey.InjectFailure(smartkeytest.Failure{Latency: 200 * time.Millisecond, Times: 1})
+	plains := make([][]byte, 2)
+	for i := range plains {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if response, err := serv.Decrypt(context.Background(), &k8spb.DecryptRequest{Version: version, Cipher: cipher}); err == nil {
+				plains[i] = response.Plain
+			}
+		}(i)
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+	if smartkey.RequestCount("decrypt") != 2 || len(plains[0]) == 0 || len(plains[1]) == 0 || &plains[0][0] == &plains[1][0] {
+		t.Error("Coalesced callers should not share the plain data buffer")
+	}
+}
+
+func TestDecrypt_Negative_CoalescedCallersGone(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+	config["maxConcurrentDecryptRequests"] = "1"
+
+	serv, err := NewWithBackend("/path/to/sock/file", config, newTestSmartKeyBackend(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := serv.backend.Encrypt(context.Background(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* Every caller gives up while SmartKey answers */
+	smartkey.InjectFailure(smartkeytest.Failure{Latency: 5 * time.Second, Times: 1})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if _, err := serv.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: cipher}); status.Code(err) != codes.DeadlineExceeded {
+				t.Error("Caller should stop at its deadline, got", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	/* The shared call is cancelled and releases its slot long before SmartKey answers */
+	deadline := time.Now().Add(time.Second)
+	for len(serv.limits.decrypt.slots) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(serv.limits.decrypt.slots) != 0 {
+		t.Fatal("Decrypt slot should be released once every caller gave up")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if response, err := serv.Decrypt(ctx, &k8spb.DecryptRequest{Version: version, Cipher: cipher}); err != nil || string(response.Plain) != "secret" {
+		t.Error("Later request should start a new call", err)
+	}
+}
+
+func TestDecrypt_Positive_DistinctCiphersNotCoalesced(t *testing.T) {
+	backend := newTestLocalBackend(t)
+	serv, err := NewWithBackend("/path/to/sock/file", make(map[string]string), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, plain := range []string{"a", "b", "c", "d"} {
+		cipher, err := backend.Encrypt(nil, []byte(plain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(plain string, cipher []byte) {
+			defer wg.Done()
+			decrypted, err := serv.Decrypt(context.Background(), &k8spb.DecryptRequest{Version: version, Cipher: cipher})
+			if err != nil || string(decrypted.Plain) != plain {
+				t.Error("Each cipher should be decrypted separately", err)
+			}
+		}(plain, cipher)
+	}
+	wg.Wait()
+}
@@ -5,38 +5,145 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
+/*EncryptRequest request to SmartKey for encrypt API Call, Plain is left nil and sent in a plainRequest so it is only encoded in a buffer which is zeroed*/
+type EncryptRequest struct {
+	Alg   string `json:"alg"`
+	Mode  string `json:"mode"`
+	Iv    string `json:"iv"`
+	Plain []byte `json:"plain"`
+}
+
 /*EncryptResponse response from SmartKey for encrypt API Call*/
 type EncryptResponse struct {
-	Kid    string
-	Cipher string
-	Iv     string
+	Kid    string `json:"kid"`
+	Cipher string `json:"cipher"`
+	Iv     string `json:"iv"`
+}
+
+/*DecryptRequest request to SmartKey for decrypt API Call*/
+type DecryptRequest struct {
+	Alg    string `json:"alg"`
+	Mode   string `json:"mode"`
+	Iv     string `json:"iv"`
+	Cipher string `json:"cipher"`
 }
 
-/*DecryptResponse response from SmartKey for decrypt API Call*/
+/*DecryptResponse response from SmartKey for decrypt API Call, Plain is base64 decoded by encoding/json*/
 type DecryptResponse struct {
-	Kid   string
-	Plain string
-	Iv    string
+	Kid   string `json:"kid"`
+	Plain []byte `json:"plain"`
+	Iv    string `json:"iv"`
+}
+
+/*BatchEncryptRequest item of a request to SmartKey for batch encrypt API Call*/
+type BatchEncryptRequest struct {
+	Kid     string         `json:"kid"`
+	Request EncryptRequest `json:"request"`
+}
+
+/*BatchDecryptRequest item of a request to SmartKey for batch decrypt API Call*/
+type BatchDecryptRequest struct {
+	Kid     string         `json:"kid"`
+	Request DecryptRequest `json:"request"`
 }
 
-/*KeyObject response from SmartKey for decrypt API Call*/
+/*BatchResponse item of a response from SmartKey for batch API Calls, Body holds the response of a successful operation*/
+type BatchResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+	Error  string          `json:"error"`
+}
+
+/*AuthResponse response from SmartKey for auth API Call*/
+type AuthResponse struct {
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	AccessToken string `json:"access_token"`
+	EntityID    string `json:"entity_id"`
+}
+
+/*KeyObject response from SmartKey for get security object API Call*/
 type KeyObject struct {
 	// For objects which are not elliptic curves, this is the size in bits (not bytes) of the object. This field is not returned for elliptic curves.
 	KeySize int32  `json:"key_size,omitempty"`
 	ObjType string `json:"obj_type"`
+	Kid     string `json:"kid,omitempty"`
+	Name    string `json:"name,omitempty"`
+	// Operations permitted with the key, eg. ENCRYPT, DECRYPT, WRAPKEY, UNWRAPKEY.
+	KeyOps  []string `json:"key_ops,omitempty"`
+	Enabled bool     `json:"enabled"`
+	// Date after which the key can no longer encrypt, in the SmartKey format 20060102T150405Z.
+	DeactivationDate string `json:"deactivation_date,omitempty"`
 }
 
-/* This function calls actual SmartKey REST APIs on a SmartKey API endpoint. */
-func execute(apikey string, url string, data []byte) ([]byte, error) {
+/*CreateKeyRequest request to SmartKey for create security object API Call*/
+type CreateKeyRequest struct {
+	Name    string   `json:"name"`
+	ObjType string   `json:"obj_type"`
+	KeySize int32    `json:"key_size"`
+	KeyOps  []string `json:"key_ops"`
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+/*SmartKeyError is returned when SmartKey answers a request with an error status. */
+type SmartKeyError struct {
+	StatusCode int
+	Message    string
+	/* RetryAfter is the delay requested by the Retry-After header, 0 when absent. */
+	RetryAfter time.Duration
+}
+
+func (e *SmartKeyError) Error() string {
+	if len(e.Message) == 0 {
+		return "SmartKey returned status " + strconv.Itoa(e.StatusCode)
+	}
+	return "SmartKey returned status " + strconv.Itoa(e.StatusCode) + ": " + e.Message
+}
+
+/*unreachableError is returned when SmartKey could not be reached, the request can be sent to another endpoint. */
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return "unable to call SmartKey: " + e.err.Error()
+}
+
+/* Maximum size of a SmartKey error message kept in errors */
+const maxErrorMessageLength = 512
+
+/* This function calls actual SmartKey REST APIs on a SmartKey API endpoint, request and response are JSON encoded when not nil. The encoded bodies, which may hold plain data, are zeroed once sent or decoded. */
+func execute(ctx context.Context, apikey string, method string, url string, request interface{}, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		var data []byte
+		var err error
+		if plain, ok := request.(*plainRequest); ok {
+			data, err = encodePlainRequest(plain)
+		} else {
+			data, err = json.Marshal(request)
+		}
+		if err != nil {
+			return errors.New("unable to encode SmartKey request: " + err.Error())
+		}
+		defer zeroBytes(data)
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		log.Fatal("Error reading request. ", err)
+		return errors.New("unable to create SmartKey request: " + err.Error())
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -46,125 +153,420 @@ func execute(apikey string, url string, data []byte) ([]byte, error) {
 
 	/* Call SmartKey API to perform operation */
 	resp, err := client.Do(req)
-
 	if err != nil {
-		log.Fatal(req)
-		log.Fatal("Error reading response. ", err)
+		return &unreachableError{err: err}
 	}
-
 	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		/* SmartKey describes errors in the response body */
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorMessageLength))
+		return &SmartKeyError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message)), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	if response == nil {
+		return nil
+	}
+	data, err := readAllZeroing(resp.Body, resp.ContentLength)
+	if err != nil && ctx.Err() != nil {
+		/* The endpoint stalled while sending the response */
+		return &unreachableError{err: err}
+	}
+	if err != nil {
+		return errors.New("invalid SmartKey response: " + err.Error())
+	}
+	defer zeroBytes(data)
+	if err := json.Unmarshal(data, response); err != nil {
+		return errors.New("invalid SmartKey response: " + err.Error())
+	}
+	return nil
 }
 
-/* This is a method for calling encryption operation. */
-func encrypt(config map[string]string, input string) (string, error) {
-	/* Convert plain text to base64 */
-	var base64Input = base64.StdEncoding.EncodeToString([]byte(input))
-	encryptURL := config["smartkeyURL"] + "/crypto/v1/keys/" + config["encryptionKeyUuid"] + "/encrypt"
-	log.Println("encrypt: map:", config)
-	log.Println("encrypt: encryptURL:", encryptURL)
+/* callSmartKey calls the SmartKey REST API path on the endpoints of smartkeyURL until ctx is done, failing over to another endpoint when one is unavailable or does not answer within smartkeyRequestTimeout. */
+func callSmartKey(ctx context.Context, config map[string]string, method string, path string, request interface{}, response interface{}) error {
+	return callSmartKeyEndpoints(ctx, config, true, method, path, request, response)
+}
 
-	/* Call SmartKey encrypt */
-	var body, err = execute(config["smartkeyApiKey"], encryptURL, []byte(`{
-		"alg":   "AES",
-		"mode":  "CBC",
-		"iv":    "`+config["iv"]+`",
-		"plain": "`+base64Input+`"
-	}`))
+/* callSmartKeyOnce calls the SmartKey REST API path on the selected endpoint only, for calls which are not idempotent: a call which failed or timed out may still have been performed, repeating it on another endpoint could perform it twice. */
+func callSmartKeyOnce(ctx context.Context, config map[string]string, method string, path string, request interface{}, response interface{}) error {
+	return callSmartKeyEndpoints(ctx, config, false, method, path, request, response)
+}
 
+/* callSmartKeyEndpoints calls the SmartKey REST API path through the endpoint pool of config. */
+func callSmartKeyEndpoints(ctx context.Context, config map[string]string, failover bool, method string, path string, request interface{}, response interface{}) error {
+	endpoints, err := smartKeyEndpoints(config)
 	if err != nil {
-		log.Print("Error reading body. ", err)
-		return "", err
+		return err
 	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return endpoints.do(ctx, failover, func(ctx context.Context, baseURL string) error {
+		return execute(ctx, config["smartkeyApiKey"], method, baseURL+path, request, response)
+	})
+}
 
+/* parseRetryAfter parses a Retry-After header in seconds or as an HTTP date, it returns 0 when absent or invalid. */
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
+
+/* This is a method for calling encryption operation, the returned cipher is base64 encoded. */
+func encrypt(config map[string]string, plain []byte) ([]byte, error) {
+	return encryptWithKey(context.Background(), config, config["encryptionKeyUuid"], plain)
+}
+
+/* This is a method for calling encryption operation with the key kid. */
+func encryptWithKey(ctx context.Context, config map[string]string, kid string, plain []byte) ([]byte, error) {
+	encryptPath := "/crypto/v1/keys/" + kid + "/encrypt"
+	log.Println("encrypt: encryptPath:", encryptPath)
+
+	request := EncryptRequest{
+		Alg:  "AES",
+		Mode: "CBC",
+		Iv:   config["iv"],
+	}
+
+	/* Call SmartKey encrypt */
 	var response EncryptResponse
-	json.Unmarshal([]byte(body), &response)
+	if err := callSmartKey(ctx, config, "POST", encryptPath, &plainRequest{Request: &request, Plains: [][]byte{plain}}, &response); err != nil {
+		log.Print("Error calling encrypt. ", err)
+		return nil, err
+	}
+	if err := checkEncryptResponse(&response); err != nil {
+		return nil, err
+	}
 
-	return response.Cipher, nil
+	return []byte(response.Cipher), nil
 }
 
-/* This is a method for calling decryption operation. */
-func decrypt(config map[string]string, cipher string) (string, error) {
-	decryptURL := config["smartkeyURL"] + "/crypto/v1/keys/" + config["encryptionKeyUuid"] + "/decrypt"
-	log.Println("decrypt: map:", config)
-	log.Println("decrypt: encryptURL:", decryptURL)
+/* checkEncryptResponse checks the cipher returned by SmartKey is base64 encoded. */
+func checkEncryptResponse(response *EncryptResponse) error {
+	if len(response.Cipher) == 0 {
+		return errors.New("invalid SmartKey response: cipher missing")
+	}
+	if _, err := base64.StdEncoding.DecodeString(response.Cipher); err != nil {
+		return errors.New("invalid SmartKey response: cipher is not base64 encoded")
+	}
+	return nil
+}
 
-	/* Call SmartKey decrypt */
-	var body, err = execute(config["smartkeyApiKey"], decryptURL, []byte(`{
-		"alg":   "AES",
-		"mode":  "CBC",
-		"iv":    "`+config["iv"]+`",
-		"cipher": "`+cipher+`"
-	}`))
+/* This is a method for calling decryption operation on a base64 encoded cipher returned by encrypt. */
+func decrypt(config map[string]string, cipher []byte) ([]byte, error) {
+	return decryptWithKey(context.Background(), config, config["encryptionKeyUuid"], cipher)
+}
 
-	if err != nil {
-		log.Print("Error reading body. ", err)
-		return "", err
+/* This is a method for calling decryption operation with the key kid. */
+func decryptWithKey(ctx context.Context, config map[string]string, kid string, cipher []byte) ([]byte, error) {
+	decryptPath := "/crypto/v1/keys/" + kid + "/decrypt"
+	log.Println("decrypt: decryptPath:", decryptPath)
+
+	if err := checkCipher(cipher); err != nil {
+		return nil, err
 	}
 
+	request := DecryptRequest{
+		Alg:    "AES",
+		Mode:   "CBC",
+		Iv:     config["iv"],
+		Cipher: string(cipher),
+	}
+
+	/* Call SmartKey decrypt */
 	var response DecryptResponse
-	json.Unmarshal([]byte(body), &response)
+	if err := callSmartKey(ctx, config, "POST", decryptPath, &request, &response); err != nil {
+		log.Print("Error calling decrypt. ", err)
+		return nil, err
+	}
 
-	var base64Input, _ = base64.StdEncoding.DecodeString(response.Plain)
+	return decodeDecryptResponse(&response)
+}
 
-	return string(base64Input), nil
+/* checkCipher rejects invalid ciphers before calling SmartKey, JSON encoding would silently replace bytes which are not UTF-8. */
+func checkCipher(cipher []byte) error {
+	if _, err := base64.StdEncoding.DecodeString(string(cipher)); err != nil || len(cipher) == 0 {
+		return errors.New("invalid cipher: not base64 encoded")
+	}
+	return nil
 }
 
-/* This is a method for calling authentication operation. */
-func auth(config map[string]string) (string, error) {
-	/* Convert plain text to base64 */
-	authURL := config["smartkeyURL"] + "/sys/v1/session/auth"
+/* decodeDecryptResponse returns the plain data of a SmartKey decrypt response, encoding/json rejects a plain which is not base64 encoded. */
+func decodeDecryptResponse(response *DecryptResponse) ([]byte, error) {
+	return response.Plain, nil
+}
 
-	/* Call SmartKey auth */
-	req, err := http.NewRequest("POST", authURL, nil)
+/* This is a method for encrypting several plains with the key kid in one call to the SmartKey batch encrypt API. It returns a cipher or an error for each plain, the error is set when the whole batch failed. */
+func batchEncrypt(ctx context.Context, config map[string]string, kid string, plains [][]byte) ([][]byte, []error, error) {
+	batchPath := "/crypto/v1/keys/batch/encrypt"
+	log.Println("batchEncrypt: batchPath:", batchPath, "items:", len(plains))
+
+	request := make([]BatchEncryptRequest, len(plains))
+	for i := range plains {
+		request[i] = BatchEncryptRequest{
+			Kid: kid,
+			Request: EncryptRequest{
+				Alg:  "AES",
+				Mode: "CBC",
+				Iv:   config["iv"],
+			},
+		}
+	}
+
+	responses, err := executeBatch(ctx, config, batchPath, &plainRequest{Request: request, Plains: plains}, len(plains))
 	if err != nil {
-		return "", err
+		log.Print("Error calling batch encrypt. ", err)
+		return nil, nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Basic "+config["smartkeyApiKey"])
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	ciphers := make([][]byte, len(plains))
+	errs := make([]error, len(plains))
+	for i, response := range responses {
+		if response.Status < 200 || response.Status > 299 {
+			errs[i] = &SmartKeyError{StatusCode: response.Status, Message: truncateMessage(response.Error)}
+			continue
+		}
+		var encryptResponse EncryptResponse
+		if err := json.Unmarshal(response.Body, &encryptResponse); err != nil {
+			errs[i] = errors.New("invalid SmartKey response: " + err.Error())
+			continue
+		}
+		if errs[i] = checkEncryptResponse(&encryptResponse); errs[i] == nil {
+			ciphers[i] = []byte(encryptResponse.Cipher)
+		}
+	}
+	return ciphers, errs, nil
+}
 
-	if err != nil || resp.StatusCode != 200 {
-		return "", errors.New("authentication failed")
+/* This is a method for decrypting several ciphers, each with the key of the same index in kids, in one call to the SmartKey batch decrypt API. It returns a plain or an error for each cipher, the error is set when the whole batch failed. */
+func batchDecrypt(ctx context.Context, config map[string]string, kids []string, ciphers [][]byte) ([][]byte, []error, error) {
+	batchPath := "/crypto/v1/keys/batch/decrypt"
+	log.Println("batchDecrypt: batchPath:", batchPath, "items:", len(ciphers))
+
+	plains := make([][]byte, len(ciphers))
+	errs := make([]error, len(ciphers))
+
+	/* Invalid ciphers are not sent, indexes maps the request items to the ciphers */
+	var request []BatchDecryptRequest
+	var indexes []int
+	for i, cipher := range ciphers {
+		if errs[i] = checkCipher(cipher); errs[i] != nil {
+			continue
+		}
+		request = append(request, BatchDecryptRequest{
+			Kid: kids[i],
+			Request: DecryptRequest{
+				Alg:    "AES",
+				Mode:   "CBC",
+				Iv:     config["iv"],
+				Cipher: string(cipher),
+			},
+		})
+		indexes = append(indexes, i)
+	}
+	if len(request) == 0 {
+		return plains, errs, nil
 	}
 
-	defer resp.Body.Close()
+	responses, err := executeBatch(ctx, config, batchPath, request, len(request))
+	if err != nil {
+		log.Print("Error calling batch decrypt. ", err)
+		return nil, nil, err
+	}
 
-	return "", nil
+	for j, response := range responses {
+		i := indexes[j]
+		if response.Status < 200 || response.Status > 299 {
+			errs[i] = &SmartKeyError{StatusCode: response.Status, Message: truncateMessage(response.Error)}
+			continue
+		}
+		var decryptResponse DecryptResponse
+		err := json.Unmarshal(response.Body, &decryptResponse)
+		/* The body holds the base64 encoded plain */
+		zeroBytes(response.Body)
+		if err != nil {
+			errs[i] = errors.New("invalid SmartKey response: " + err.Error())
+			continue
+		}
+		plains[i], errs[i] = decodeDecryptResponse(&decryptResponse)
+	}
+	return plains, errs, nil
 }
 
-/* This is a method for validating security object based on key uuid */
-func validateKey(config map[string]string) (string, error) {
-	/* Convert plain text to base64 */
-	authURL := config["smartkeyURL"] + "/crypto/v1/keys/" + config["encryptionKeyUuid"]
+/* executeBatch calls a SmartKey batch API and checks it answered every item. */
+func executeBatch(ctx context.Context, config map[string]string, batchPath string, request interface{}, items int) ([]BatchResponse, error) {
+	var responses []BatchResponse
+	if err := callSmartKey(ctx, config, "POST", batchPath, request, &responses); err != nil {
+		return nil, err
+	}
+	if len(responses) != items {
+		return nil, errors.New("invalid SmartKey response: " + strconv.Itoa(len(responses)) + " results for " + strconv.Itoa(items) + " batch items")
+	}
+	return responses, nil
+}
 
+func truncateMessage(message string) string {
+	message = strings.TrimSpace(message)
+	if len(message) > maxErrorMessageLength {
+		return message[:maxErrorMessageLength]
+	}
+	return message
+}
+
+/* This is a method for calling authentication operation, it returns the session access token. */
+func auth(ctx context.Context, config map[string]string) (string, error) {
+	/* Call SmartKey auth */
+	var response AuthResponse
+	if err := callSmartKey(ctx, config, "POST", "/sys/v1/session/auth", nil, &response); err != nil {
+		return "", errors.New("authentication failed: " + err.Error())
+	}
+
+	return response.AccessToken, nil
+}
+
+/* This is a method for fetching security object based on key uuid */
+func getKey(config map[string]string) (*KeyObject, error) {
+	return getKeyByID(context.Background(), config, config["encryptionKeyUuid"])
+}
+
+/* This is a method for fetching the security object kid */
+func getKeyByID(ctx context.Context, config map[string]string, kid string) (*KeyObject, error) {
 	/* Call SmartKey get security object */
-	req, err := http.NewRequest("GET", authURL, nil)
-	if err != nil {
-		return "", err
+	var keyResponse KeyObject
+	if err := callSmartKey(ctx, config, "GET", "/crypto/v1/keys/"+kid, nil, &keyResponse); err != nil {
+		return nil, errors.New("unable to fetch encryption key: " + err.Error())
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Basic "+config["smartkeyApiKey"])
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	return &keyResponse, nil
+}
 
-	if err != nil {
-		return "", errors.New("encryption key validation failed")
+/* This is a method for fetching the security object of the given name, it returns nil when there is none */
+func findKeyByName(ctx context.Context, config map[string]string, name string) (*KeyObject, error) {
+	/* Call SmartKey list security objects */
+	var keys []KeyObject
+	if err := callSmartKey(ctx, config, "GET", "/crypto/v1/keys?name="+url.QueryEscape(name), nil, &keys); err != nil {
+		return nil, errors.New("unable to look up key " + name + ": " + err.Error())
+	}
+	for i := range keys {
+		if keys[i].Name == name {
+			return &keys[i], nil
+		}
 	}
+	return nil, nil
+}
 
-	defer resp.Body.Close()
+/* Operations the plugin performs with the encryption key */
+var requiredKeyOps = []string{"ENCRYPT", "DECRYPT"}
+
+/* Format of dates returned by SmartKey */
+const smartKeyDateFormat = "20060102T150405Z"
+
+/* This is a method for creating an AES key permitting the operations of the plugin */
+func createKey(ctx context.Context, config map[string]string, name string, keySize int32) (*KeyObject, error) {
+	request := CreateKeyRequest{
+		Name:    name,
+		ObjType: "AES",
+		KeySize: keySize,
+		KeyOps:  requiredKeyOps,
+	}
 
+	/* Call SmartKey create security object, a new key would be created by each endpoint */
 	var keyResponse KeyObject
-	if err := json.NewDecoder(resp.Body).Decode(&keyResponse); err != nil {
-		return "", errors.New("encryption key validation failed")
+	if err := callSmartKeyOnce(ctx, config, "POST", "/crypto/v1/keys", &request, &keyResponse); err != nil {
+		return nil, errors.New("unable to create key " + name + ": " + err.Error())
 	}
+	if len(keyResponse.Kid) == 0 {
+		return nil, errors.New("invalid SmartKey response: kid missing")
+	}
+
+	return &keyResponse, nil
+}
 
-	if keyResponse.ObjType != "AES" || keyResponse.KeySize != 256 {
-		return "", errors.New("encryption key validation failed")
+/* This is a method for validating security object based on key uuid */
+func validateKey(config map[string]string) (string, error) {
+	keyResponse, err := getKey(config)
+	if err != nil {
+		return "", errors.New("encryption key validation failed: " + err.Error())
+	}
+
+	if err := checkKeyCapabilities(keyResponse, time.Now()); err != nil {
+		return "", errors.New("encryption key " + config["encryptionKeyUuid"] + " validation failed: " + err.Error())
 	}
 
 	return "", nil
 }
+
+/* checkDecryptCapabilities reports every reason a previous key cannot decrypt existing data, previous keys no longer encrypt so ENCRYPT and the deactivation date are not required. */
+func checkDecryptCapabilities(key *KeyObject) error {
+	var problems []string
+	if key.ObjType != "AES" {
+		problems = append(problems, "key type is "+key.ObjType+", an AES key is required")
+	}
+	if !key.Enabled {
+		problems = append(problems, "key is disabled, enable it in SmartKey")
+	}
+	if !hasKeyOp(key, "DECRYPT") {
+		problems = append(problems, "key does not permit DECRYPT, add it to the permitted operations of the key in SmartKey")
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+/* checkKeyCapabilities reports every reason the key cannot be used by the plugin at the given time. */
+func checkKeyCapabilities(key *KeyObject, now time.Time) error {
+	var problems []string
+	if key.ObjType != "AES" {
+		problems = append(problems, "key type is "+key.ObjType+", an AES key is required")
+	} else if key.KeySize != 128 && key.KeySize != 192 && key.KeySize != 256 {
+		problems = append(problems, "key size is "+strconv.Itoa(int(key.KeySize))+" bits, AES keys of 128, 192 or 256 bits are supported")
+	}
+	if !key.Enabled {
+		problems = append(problems, "key is disabled, enable it in SmartKey")
+	}
+	for _, op := range requiredKeyOps {
+		if !hasKeyOp(key, op) {
+			problems = append(problems, "key does not permit "+op+", add it to the permitted operations of the key in SmartKey")
+		}
+	}
+	if len(key.DeactivationDate) > 0 {
+		deactivation, err := parseSmartKeyDate(key.DeactivationDate)
+		if err != nil {
+			problems = append(problems, "key deactivation date "+key.DeactivationDate+" is invalid")
+		} else if !deactivation.After(now) {
+			problems = append(problems, "key was deactivated on "+deactivation.Format(time.RFC3339)+", configure an active key")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func hasKeyOp(key *KeyObject, op string) bool {
+	for _, keyOp := range key.KeyOps {
+		if keyOp == op {
+			return true
+		}
+	}
+	return false
+}
+
+/* parseSmartKeyDate parses a date in the SmartKey format, or RFC 3339. */
+func parseSmartKeyDate(value string) (time.Time, error) {
+	if date, err := time.Parse(smartKeyDateFormat, value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
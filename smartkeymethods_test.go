@@ -1,9 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jarcoal/httpmock"
+	"golang.org/x/net/context"
+
+	"smartkey-kubernetes-kms/smartkeytest"
 )
 
 func TestEncrypt(t *testing.T) {
@@ -11,14 +18,14 @@ func TestEncrypt(t *testing.T) {
 	defer httpmock.DeactivateAndReset()
 
 	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/encrypt",
-		httpmock.NewStringResponder(200, `{"kid": "1", "cipher": "cipher", "iv":"iv"}`))
+		httpmock.NewStringResponder(200, `{"kid": "1", "cipher": "Y2lwaGVy", "iv":"iv"}`))
 
 	config := make(map[string]string)
 	config["smartkeyURL"] = "https://www.smartkey.io"
 	config["encryptionKeyUuid"] = "uuid1"
 	config["smartkeyApiKey"] = "api_key"
 
-	resp, err := encrypt(config, "plain")
+	resp, err := encrypt(config, []byte("plain"))
 
 	if err != nil || len(resp) <= 0 {
 		t.Error("Encryption test case failed")
@@ -30,16 +37,267 @@ func TestDecrypt(t *testing.T) {
 	defer httpmock.DeactivateAndReset()
 
 	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/decrypt",
-		httpmock.NewStringResponder(200, `{"kid": "1", "plain": "plain", "iv":"iv"}`))
+		httpmock.NewStringResponder(200, `{"kid": "1", "plain": "cGxhaW4=", "iv":"iv"}`))
 
 	config := make(map[string]string)
 	config["smartkeyURL"] = "https://www.smartkey.io"
 	config["encryptionKeyUuid"] = "uuid1"
 	config["smartkeyApiKey"] = "api_key"
 
-	resp, err := decrypt(config, "cipher")
-	if err != nil || len(resp) <= 0 {
+	resp, err := decrypt(config, []byte("Y2lwaGVy"))
+	if err != nil || string(resp) != "plain" {
 		t.Error("Decryption test case failed")
 	}
 
 }
+
+func TestEncrypt_Positive_RequestIsValidJSON(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var request EncryptRequest
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/encrypt",
+		func(req *http.Request) (*http.Response, error) {
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return httpmock.NewStringResponse(400, "invalid JSON"), nil
+			}
+			return httpmock.NewStringResponse(200, `{"kid": "1", "cipher": "Y2lwaGVy", "iv":"iv"}`), nil
+		})
+
+	config := make(map[string]string)
+	config["smartkeyURL"] = "https://www.smartkey.io"
+	config["encryptionKeyUuid"] = "uuid1"
+	config["smartkeyApiKey"] = "api_key"
+	config["iv"] = `iv", "mode": "injected`
+
+	_, err := encrypt(config, []byte(`"quoted" plain`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Iv != config["iv"] || request.Mode != "CBC" || request.Alg != "AES" {
+		t.Error("Request body does not match config", request)
+	}
+}
+
+func TestEncrypt_Negative_ErrorStatus(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/encrypt",
+		httpmock.NewStringResponder(400, `Operation ENCRYPT is not allowed`))
+
+	config := make(map[string]string)
+	config["smartkeyURL"] = "https://www.smartkey.io"
+	config["encryptionKeyUuid"] = "uuid1"
+	config["smartkeyApiKey"] = "api_key"
+
+	_, err := encrypt(config, []byte("plain"))
+
+	smartKeyErr, ok := err.(*SmartKeyError)
+	if !ok || smartKeyErr.StatusCode != 400 || !strings.Contains(err.Error(), "Operation ENCRYPT is not allowed") {
+		t.Error("SmartKey error message should be returned, got", err)
+	}
+}
+
+func TestEncrypt_Negative_MalformedResponse(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	config := make(map[string]string)
+	config["smartkeyURL"] = "https://www.smartkey.io"
+	config["encryptionKeyUuid"] = "uuid1"
+	config["smartkeyApiKey"] = "api_key"
+
+	for _, body := range []string{`{"cipher": `, `{"kid": "1"}`, `[]`} {
+		httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/encrypt",
+			httpmock.NewStringResponder(200, body))
+
+		if _, err := encrypt(config, []byte("plain")); err == nil {
+			t.Errorf("Test case should fail as response %q is invalid", body)
+		}
+	}
+}
+
+func TestDecrypt_Negative_MalformedResponse(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/decrypt",
+		httpmock.NewStringResponder(200, `<html>`))
+
+	config := make(map[string]string)
+	config["smartkeyURL"] = "https://www.smartkey.io"
+	config["encryptionKeyUuid"] = "uuid1"
+	config["smartkeyApiKey"] = "api_key"
+
+	if _, err := decrypt(config, []byte("Y2lwaGVy")); err == nil {
+		t.Error("Test case should fail as response is not JSON")
+	}
+}
+
+func TestDecrypt_Negative_InvalidBase64(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	config := make(map[string]string)
+	config["smartkeyURL"] = "https://www.smartkey.io"
+	config["encryptionKeyUuid"] = "uuid1"
+	config["smartkeyApiKey"] = "api_key"
+
+	/* Invalid cipher must be rejected before calling SmartKey */
+	for _, cipher := range [][]byte{nil, []byte("cipher"), {0xff, 0xfe, 0x00, 0x01}} {
+		if _, err := decrypt(config, cipher); err == nil {
+			t.Errorf("Test case should fail as cipher %v is invalid", cipher)
+		}
+	}
+	if httpmock.GetTotalCallCount() != 0 {
+		t.Error("SmartKey should not be called for an invalid cipher")
+	}
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/uuid1/decrypt",
+		httpmock.NewStringResponder(200, `{"kid": "1", "plain": "not base64!", "iv":"iv"}`))
+
+	if _, err := decrypt(config, []byte("Y2lwaGVy")); err == nil {
+		t.Error("Test case should fail as plain in response is not base64 encoded")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if parseRetryAfter("3") != 3*time.Second {
+		t.Error("Retry-After in seconds should be parsed")
+	}
+	if delay := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); delay < 58*time.Second || delay > time.Minute {
+		t.Error("Retry-After HTTP date should be parsed, got", delay)
+	}
+	for _, invalid := range []string{"", "soon", "-1"} {
+		if parseRetryAfter(invalid) != 0 {
+			t.Errorf("Retry-After %q should be ignored", invalid)
+		}
+	}
+}
+
+func TestExecute_Negative_TooManyRequests(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	response := httpmock.NewStringResponse(429, "quota exceeded")
+	response.Header.Set("Retry-After", "2")
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/sys/v1/session/auth", httpmock.ResponderFromResponse(response))
+
+	err := execute(context.Background(), "api_key", "POST", "https://www.smartkey.io/sys/v1/session/auth", nil, nil)
+	smartKeyErr, ok := err.(*SmartKeyError)
+	if !ok || smartKeyErr.StatusCode != 429 || smartKeyErr.RetryAfter != 2*time.Second {
+		t.Error("SmartKeyError with Retry-After expected, got", err)
+	}
+}
+
+func TestBatchEncrypt_Positive_ItemErrors(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/batch/encrypt",
+		httpmock.NewStringResponder(200, `[{"status": 200, "body": {"kid": "1", "cipher": "Y2lwaGVy", "iv": "iv"}}, {"status": 400, "error": "sobject is disabled"}]`))
+
+	ciphers, errs, err := batchEncrypt(context.Background(), newTestSmartKeyConfig(), "uuid1", [][]byte{[]byte("a"), []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ciphers[0]) != "Y2lwaGVy" || errs[0] != nil {
+		t.Error("First item should succeed", errs[0])
+	}
+	if smartKeyErr, ok := errs[1].(*SmartKeyError); !ok || smartKeyErr.StatusCode != 400 || smartKeyErr.Message != "sobject is disabled" {
+		t.Error("Second item error expected, got", errs[1])
+	}
+}
+
+func TestBatchDecrypt_Negative(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/batch/decrypt",
+		httpmock.NewStringResponder(200, `[{"status": 200, "body": {"kid": "1", "plain": "cGxhaW4=", "iv": "iv"}}]`))
+
+	/* Invalid ciphers are not sent */
+	plains, errs, err := batchDecrypt(context.Background(), newTestSmartKeyConfig(), []string{"uuid1", "uuid1"}, [][]byte{[]byte("not base64"), []byte("Y2lwaGVy")})
+	if err != nil || errs[0] == nil || errs[1] != nil || string(plains[1]) != "plain" {
+		t.Error("Only the invalid cipher should fail", errs, err)
+	}
+
+	/* A result missing for an item fails the batch */
+	if _, _, err := batchDecrypt(context.Background(), newTestSmartKeyConfig(), []string{"uuid1", "uuid1"}, [][]byte{[]byte("Y2lwaGVy"), []byte("Y2lwaGVy")}); err == nil {
+		t.Error("Test case should fail as results are missing")
+	}
+
+	httpmock.RegisterResponder("POST", "https://www.smartkey.io/crypto/v1/keys/batch/decrypt",
+		httpmock.NewStringResponder(503, "unavailable"))
+	if _, _, err := batchDecrypt(context.Background(), newTestSmartKeyConfig(), []string{"uuid1"}, [][]byte{[]byte("Y2lwaGVy")}); err == nil {
+		t.Error("Test case should fail as the batch is rejected")
+	}
+}
+
+func TestCheckKeyCapabilities(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	valid := func() *KeyObject {
+		return &KeyObject{ObjType: "AES", KeySize: 256, Enabled: true, KeyOps: []string{"ENCRYPT", "DECRYPT", "WRAPKEY"}, DeactivationDate: "20250101T000000Z"}
+	}
+
+	for _, size := range []int32{128, 192, 256} {
+		key := valid()
+		key.KeySize = size
+		if err := checkKeyCapabilities(key, now); err != nil {
+			t.Errorf("AES %d key should be accepted: %v", size, err)
+		}
+	}
+	noDeactivation := valid()
+	noDeactivation.DeactivationDate = ""
+	if err := checkKeyCapabilities(noDeactivation, now); err != nil {
+		t.Error("Key without deactivation date should be accepted", err)
+	}
+
+	for expected, update := range map[string]func(key *KeyObject){
+		"an AES key is required":   func(key *KeyObject) { key.ObjType = "RSA" },
+		"512 bits":                 func(key *KeyObject) { key.KeySize = 512 },
+		"key is disabled":          func(key *KeyObject) { key.Enabled = false },
+		"does not permit DECRYPT":  func(key *KeyObject) { key.KeyOps = []string{"ENCRYPT"} },
+		"does not permit ENCRYPT":  func(key *KeyObject) { key.KeyOps = nil },
+		"deactivated on 2024-05-1": func(key *KeyObject) { key.DeactivationDate = "20240515T000000Z" },
+		"date soon is invalid":     func(key *KeyObject) { key.DeactivationDate = "soon" },
+	} {
+		key := valid()
+		update(key)
+		if err := checkKeyCapabilities(key, now); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Error containing %q expected, got %v", expected, err)
+		}
+	}
+
+	/* Every problem is reported */
+	err := checkKeyCapabilities(&KeyObject{ObjType: "AES", KeySize: 256}, now)
+	if err == nil || strings.Count(err.Error(), ";") != 2 {
+		t.Error("All problems should be reported, got", err)
+	}
+}
+
+func TestValidateKey_SmartKey(t *testing.T) {
+	smartkey, config := newTestSmartKey(t)
+	defer smartkey.Close()
+
+	if _, err := validateKey(config); err != nil {
+		t.Error("Valid key should be accepted", err)
+	}
+
+	smartkey.AddKey("uuid-128", 128)
+	config["encryptionKeyUuid"] = "uuid-128"
+	if _, err := validateKey(config); err != nil {
+		t.Error("AES 128 key should be accepted", err)
+	}
+
+	smartkey.UpdateKey("uuid-128", func(key *smartkeytest.Key) {
+		key.Enabled = false
+		key.KeyOps = []string{"ENCRYPT"}
+	})
+	_, err := validateKey(config)
+	if err == nil || !strings.Contains(err.Error(), "uuid-128") || !strings.Contains(err.Error(), "disabled") || !strings.Contains(err.Error(), "DECRYPT") {
+		t.Error("Disabled key without DECRYPT should be rejected with details, got", err)
+	}
+}
@@ -0,0 +1,606 @@
+/*
+Package smartkeytest provides a fake SmartKey server performing real AES operations,
+for integration tests of the KMS plugin without access to SmartKey.
+*/
+package smartkeytest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*Key is a security object stored in the fake server. */
+type Key struct {
+	Kid     string   `json:"kid"`
+	Name    string   `json:"name"`
+	ObjType string   `json:"obj_type"`
+	KeySize int      `json:"key_size"`
+	KeyOps  []string `json:"key_ops"`
+	Enabled bool     `json:"enabled"`
+	/* DeactivationDate in the SmartKey format 20060102T150405Z, empty when the key never expires */
+	DeactivationDate string `json:"deactivation_date,omitempty"`
+
+	material []byte
+}
+
+/*Failure describes a fault injected in the responses of the fake server. */
+type Failure struct {
+	/* Latency is added before handling each request. */
+	Latency time.Duration
+	/* StatusCode, when set, is returned with an error body instead of handling the request. */
+	StatusCode int
+	/* RetryAfter, when set with StatusCode, is returned in a Retry-After header rounded up to seconds. */
+	RetryAfter time.Duration
+	/* Malformed returns a 200 response with a body which is not valid JSON. */
+	Malformed bool
+	/* Times is the number of requests affected, 0 means every request until ClearFailure. */
+	Times int
+}
+
+/*Server is a fake SmartKey REST API. */
+type Server struct {
+	/* URL of the server when started with NewServer */
+	URL string
+
+	mu         sync.Mutex
+	apiKey     string
+	keys       map[string]*Key
+	failure    *Failure
+	requests   map[string]int
+	httpServer *httptest.Server
+}
+
+/*New creates a fake SmartKey accepting the given API key. It implements http.Handler and is not started. */
+func New(apiKey string) *Server {
+	return &Server{
+		apiKey:   apiKey,
+		keys:     make(map[string]*Key),
+		requests: make(map[string]int),
+	}
+}
+
+/*NewServer creates and starts a fake SmartKey on a local address, available in URL. */
+func NewServer(apiKey string) *Server {
+	s := New(apiKey)
+	s.httpServer = httptest.NewServer(s)
+	s.URL = s.httpServer.URL
+	return s
+}
+
+/*Close stops a server started with NewServer. */
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+/*AddKey creates an enabled AES key of the given size in bits with random material, allowing all operations. */
+func (s *Server) AddKey(kid string, keySize int) (*Key, error) {
+	material := make([]byte, keySize/8)
+	if _, err := rand.Read(material); err != nil {
+		return nil, err
+	}
+	return s.ImportKey(kid, material)
+}
+
+/*ImportKey creates an enabled AES key with the given material, allowing all operations. */
+func (s *Server) ImportKey(kid string, material []byte) (*Key, error) {
+	if _, err := aes.NewCipher(material); err != nil {
+		return nil, err
+	}
+
+	key := &Key{
+		Kid:      kid,
+		Name:     kid,
+		ObjType:  "AES",
+		KeySize:  len(material) * 8,
+		KeyOps:   []string{"ENCRYPT", "DECRYPT", "WRAPKEY", "UNWRAPKEY", "EXPORT"},
+		Enabled:  true,
+		material: append([]byte(nil), material...),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[kid] = key
+	return key, nil
+}
+
+/*UpdateKey calls update on the key with the given kid while holding the server lock. */
+func (s *Server) UpdateKey(kid string, update func(key *Key)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[kid]
+	if !ok {
+		return errors.New("key " + kid + " not found")
+	}
+	update(key)
+	return nil
+}
+
+/*InjectFailure makes the following requests fail as described. */
+func (s *Server) InjectFailure(failure Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failure = &failure
+}
+
+/*ClearFailure stops injecting failures. */
+func (s *Server) ClearFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failure = nil
+}
+
+/*RequestCount returns the number of requests received for an operation (health, auth, create, get, encrypt, decrypt, wrapkey, unwrapkey, batchencrypt, batchdecrypt). */
+func (s *Server) RequestCount(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[operation]
+}
+
+/*ServeHTTP dispatches SmartKey API requests. */
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operation, kid := route(r)
+	if len(operation) == 0 {
+		writeError(w, http.StatusNotFound, "unknown API "+r.Method+" "+r.URL.Path)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests[operation]++
+	failure := s.nextFailure()
+	s.mu.Unlock()
+
+	if failure != nil {
+		time.Sleep(failure.Latency)
+		if failure.StatusCode != 0 {
+			if failure.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int((failure.RetryAfter+time.Second-1)/time.Second)))
+			}
+			writeError(w, failure.StatusCode, "injected failure")
+			return
+		}
+		if failure.Malformed {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"malformed":`))
+			return
+		}
+	}
+
+	/* Health checks do not need authentication */
+	if operation == "health" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Basic "+s.apiKey {
+		writeError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+
+	if operation == "auth" {
+		writeJSON(w, map[string]interface{}{
+			"token_type":   "Bearer",
+			"expires_in":   600,
+			"access_token": randomID(),
+			"entity_id":    randomID(),
+		})
+		return
+	}
+
+	if operation == "create" {
+		s.handleCreate(w, r)
+		return
+	}
+	if operation == "list" {
+		s.handleList(w, r)
+		return
+	}
+	if operation == "batchencrypt" || operation == "batchdecrypt" {
+		s.handleBatch(w, r, strings.TrimPrefix(operation, "batch"))
+		return
+	}
+
+	s.mu.Lock()
+	key, ok := s.keys[kid]
+	var snapshot Key
+	if ok {
+		snapshot = *key
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "sobject does not exist")
+		return
+	}
+
+	switch operation {
+	case "get":
+		writeJSON(w, snapshot)
+	case "encrypt":
+		s.handleEncrypt(w, r, &snapshot)
+	case "decrypt":
+		s.handleDecrypt(w, r, &snapshot)
+	case "wrapkey":
+		s.handleWrapKey(w, r, &snapshot)
+	case "unwrapkey":
+		s.handleUnwrapKey(w, r, &snapshot)
+	}
+}
+
+/* nextFailure returns the failure to apply to the current request, must be called with the lock held. */
+func (s *Server) nextFailure() *Failure {
+	if s.failure == nil {
+		return nil
+	}
+	failure := *s.failure
+	if s.failure.Times > 0 {
+		s.failure.Times--
+		if s.failure.Times == 0 {
+			s.failure = nil
+		}
+	}
+	return &failure
+}
+
+/* route returns the operation name and key id of a request, or an empty operation for unknown APIs. */
+func route(r *http.Request) (string, string) {
+	if r.URL.Path == "/sys/v1/session/auth" && r.Method == http.MethodPost {
+		return "auth", ""
+	}
+	if r.URL.Path == "/sys/v1/health" && r.Method == http.MethodGet {
+		return "health", ""
+	}
+	if r.URL.Path == "/crypto/v1/keys" && r.Method == http.MethodPost {
+		return "create", ""
+	}
+	if r.URL.Path == "/crypto/v1/keys" && r.Method == http.MethodGet {
+		return "list", ""
+	}
+	if !strings.HasPrefix(r.URL.Path, "/crypto/v1/keys/") {
+		return "", ""
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/crypto/v1/keys/"), "/")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		return "get", parts[0]
+	case len(parts) == 2 && r.Method == http.MethodPost && parts[0] == "batch":
+		switch parts[1] {
+		case "encrypt", "decrypt":
+			return "batch" + parts[1], ""
+		}
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		switch parts[1] {
+		case "encrypt", "decrypt", "wrapkey", "unwrapkey":
+			return parts[1], parts[0]
+		}
+	}
+	return "", ""
+}
+
+/*cryptRequest is the body of encrypt, decrypt, wrapkey and unwrapkey requests. */
+type cryptRequest struct {
+	Alg        string `json:"alg"`
+	Mode       string `json:"mode"`
+	Iv         string `json:"iv"`
+	Plain      string `json:"plain"`
+	Cipher     string `json:"cipher"`
+	Kid        string `json:"kid"`
+	WrappedKey string `json:"wrapped_key"`
+	ObjType    string `json:"obj_type"`
+	Name       string `json:"name"`
+}
+
+func (s *Server) handleEncrypt(w http.ResponseWriter, r *http.Request, key *Key) {
+	request, iv, ok := decodeCryptRequest(w, r, key, "ENCRYPT", true)
+	if !ok {
+		return
+	}
+	plain, err := base64.StdEncoding.DecodeString(request.Plain)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "plain is not base64 encoded")
+		return
+	}
+
+	writeJSON(w, map[string]string{
+		"kid":    key.Kid,
+		"cipher": base64.StdEncoding.EncodeToString(encryptCBC(key.material, iv, plain)),
+		"iv":     base64.StdEncoding.EncodeToString(iv),
+	})
+}
+
+func (s *Server) handleDecrypt(w http.ResponseWriter, r *http.Request, key *Key) {
+	request, iv, ok := decodeCryptRequest(w, r, key, "DECRYPT", false)
+	if !ok {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(request.Cipher)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "cipher is not base64 encoded")
+		return
+	}
+	plain, err := decryptCBC(key.material, iv, data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, map[string]string{
+		"kid":   key.Kid,
+		"plain": base64.StdEncoding.EncodeToString(plain),
+	})
+}
+
+func (s *Server) handleWrapKey(w http.ResponseWriter, r *http.Request, key *Key) {
+	request, iv, ok := decodeCryptRequest(w, r, key, "WRAPKEY", true)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	subject, found := s.keys[request.Kid]
+	var material []byte
+	if found {
+		material = subject.material
+	}
+	s.mu.Unlock()
+
+	if !found {
+		writeError(w, http.StatusNotFound, "key to wrap does not exist")
+		return
+	}
+
+	writeJSON(w, map[string]string{
+		"wrapped_key": base64.StdEncoding.EncodeToString(encryptCBC(key.material, iv, material)),
+		"iv":          base64.StdEncoding.EncodeToString(iv),
+	})
+}
+
+func (s *Server) handleUnwrapKey(w http.ResponseWriter, r *http.Request, key *Key) {
+	request, iv, ok := decodeCryptRequest(w, r, key, "UNWRAPKEY", false)
+	if !ok {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(request.WrappedKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "wrapped_key is not base64 encoded")
+		return
+	}
+	material, err := decryptCBC(key.material, iv, data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	unwrapped, err := s.ImportKey(randomID(), material)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(request.Name) > 0 {
+		s.UpdateKey(unwrapped.Kid, func(k *Key) { k.Name = request.Name })
+		unwrapped.Name = request.Name
+	}
+	writeJSON(w, unwrapped)
+}
+
+/* handleCreate creates an AES key with a random kid. */
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name    string   `json:"name"`
+		ObjType string   `json:"obj_type"`
+		KeySize int      `json:"key_size"`
+		KeyOps  []string `json:"key_ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if request.ObjType != "AES" {
+		writeError(w, http.StatusBadRequest, "only AES keys are supported")
+		return
+	}
+
+	material := make([]byte, request.KeySize/8)
+	if _, err := rand.Read(material); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err := aes.NewCipher(material); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	key := &Key{
+		Kid:      randomID(),
+		Name:     request.Name,
+		ObjType:  "AES",
+		KeySize:  request.KeySize,
+		KeyOps:   []string{"ENCRYPT", "DECRYPT", "WRAPKEY", "UNWRAPKEY", "EXPORT"},
+		Enabled:  true,
+		material: material,
+	}
+	if len(request.KeyOps) > 0 {
+		key.KeyOps = request.KeyOps
+	}
+
+	/* Names are unique like in SmartKey */
+	s.mu.Lock()
+	for _, existing := range s.keys {
+		if existing.Name == key.Name {
+			s.mu.Unlock()
+			writeError(w, http.StatusConflict, "a security object named "+key.Name+" already exists")
+			return
+		}
+	}
+	s.keys[key.Kid] = key
+	created := *key
+	s.mu.Unlock()
+	writeJSON(w, created)
+}
+
+/* handleList returns the keys, only the key of the given name with the name query parameter. */
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	s.mu.Lock()
+	keys := []Key{}
+	for _, key := range s.keys {
+		if len(name) == 0 || key.Name == name {
+			keys = append(keys, *key)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+	writeJSON(w, keys)
+}
+
+/*batchItem is an item of a batch encrypt or decrypt request. */
+type batchItem struct {
+	Kid     string          `json:"kid"`
+	Request json.RawMessage `json:"request"`
+}
+
+/*batchResult is an item of a batch response, with the body of a successful operation or the error message. */
+type batchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+/* handleBatch performs each encrypt or decrypt operation of a batch as if it was a separate request. */
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request, operation string) {
+	var items []batchItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	results := make([]batchResult, len(items))
+	for i, item := range items {
+		s.mu.Lock()
+		key, ok := s.keys[item.Kid]
+		var snapshot Key
+		if ok {
+			snapshot = *key
+		}
+		s.mu.Unlock()
+		if !ok {
+			results[i] = batchResult{Status: http.StatusNotFound, Error: "sobject does not exist"}
+			continue
+		}
+
+		recorder := httptest.NewRecorder()
+		itemRequest := httptest.NewRequest(http.MethodPost, "/crypto/v1/keys/"+item.Kid+"/"+operation, bytes.NewReader(item.Request))
+		if operation == "encrypt" {
+			s.handleEncrypt(recorder, itemRequest, &snapshot)
+		} else {
+			s.handleDecrypt(recorder, itemRequest, &snapshot)
+		}
+
+		results[i].Status = recorder.Code
+		if recorder.Code == http.StatusOK {
+			results[i].Body = json.RawMessage(bytes.TrimSpace(recorder.Body.Bytes()))
+		} else {
+			results[i].Error = recorder.Body.String()
+		}
+	}
+	writeJSON(w, results)
+}
+
+/* decodeCryptRequest parses the request body and checks the key allows the operation. */
+func decodeCryptRequest(w http.ResponseWriter, r *http.Request, key *Key, op string, generateIv bool) (*cryptRequest, []byte, bool) {
+	if !key.Enabled {
+		writeError(w, http.StatusBadRequest, "sobject is disabled")
+		return nil, nil, false
+	}
+	if !hasOp(key, op) {
+		writeError(w, http.StatusBadRequest, "operation "+op+" is not allowed for this sobject")
+		return nil, nil, false
+	}
+
+	var request cryptRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return nil, nil, false
+	}
+	if request.Alg != "AES" || request.Mode != "CBC" {
+		writeError(w, http.StatusBadRequest, "only AES CBC is supported")
+		return nil, nil, false
+	}
+
+	if len(request.Iv) == 0 && generateIv {
+		iv := make([]byte, aes.BlockSize)
+		rand.Read(iv)
+		return &request, iv, true
+	}
+	iv, err := base64.StdEncoding.DecodeString(request.Iv)
+	if err != nil || len(iv) != aes.BlockSize {
+		writeError(w, http.StatusBadRequest, "invalid iv")
+		return nil, nil, false
+	}
+	return &request, iv, true
+}
+
+func hasOp(key *Key, op string) bool {
+	for _, keyOp := range key.KeyOps {
+		if keyOp == op {
+			return true
+		}
+	}
+	return false
+}
+
+func encryptCBC(material []byte, iv []byte, plain []byte) []byte {
+	block, _ := aes.NewCipher(material)
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	padded := append(append([]byte(nil), plain...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+	return padded
+}
+
+func decryptCBC(material []byte, iv []byte, data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid cipher length")
+	}
+	block, _ := aes.NewCipher(material)
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("invalid padding")
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+/* writeError writes an error the way SmartKey does, as a plain text message. */
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(message))
+}
+
+func randomID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
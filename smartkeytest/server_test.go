@@ -0,0 +1,249 @@
+package smartkeytest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testIv = "rFvgbU6EygpLUObqFZxITg=="
+
+func call(t *testing.T, s *Server, method string, path string, apiKey string, body interface{}) (int, map[string]interface{}) {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, s.URL+path, bytes.NewReader(data))
+	req.Header.Set("Authorization", "Basic "+apiKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	raw, _ := ioutil.ReadAll(resp.Body)
+	var response map[string]interface{}
+	json.Unmarshal(raw, &response)
+	return resp.StatusCode, response
+}
+
+func TestServer_Auth(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+
+	if status, _ := call(t, s, "POST", "/sys/v1/session/auth", "api-key", nil); status != 200 {
+		t.Error("Authentication should succeed with a valid API key")
+	}
+	if status, _ := call(t, s, "POST", "/sys/v1/session/auth", "wrong", nil); status != 401 {
+		t.Error("Authentication should fail with an invalid API key")
+	}
+	if s.RequestCount("auth") != 2 {
+		t.Error("Invalid request count")
+	}
+}
+
+func TestServer_GetKey(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+	s.AddKey("uuid-1", 128)
+
+	status, key := call(t, s, "GET", "/crypto/v1/keys/uuid-1", "api-key", nil)
+	if status != 200 || key["obj_type"] != "AES" || key["key_size"] != float64(128) {
+		t.Error("Invalid key returned", key)
+	}
+	if status, _ := call(t, s, "GET", "/crypto/v1/keys/unknown", "api-key", nil); status != 404 {
+		t.Error("Unknown key should not be found")
+	}
+}
+
+func TestServer_EncryptDecrypt(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+	s.AddKey("uuid-1", 256)
+
+	plain := base64.StdEncoding.EncodeToString([]byte{0, 1, 2, 0xff})
+	status, encrypted := call(t, s, "POST", "/crypto/v1/keys/uuid-1/encrypt", "api-key",
+		map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "plain": plain})
+	if status != 200 || encrypted["cipher"] == nil {
+		t.Fatal("Encryption failed", encrypted)
+	}
+
+	status, decrypted := call(t, s, "POST", "/crypto/v1/keys/uuid-1/decrypt", "api-key",
+		map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "cipher": encrypted["cipher"].(string)})
+	if status != 200 || decrypted["plain"] != plain {
+		t.Error("Decryption failed", decrypted)
+	}
+}
+
+func TestServer_WrapUnwrapKey(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+	s.AddKey("kek", 256)
+	s.AddKey("dek", 256)
+
+	status, wrapped := call(t, s, "POST", "/crypto/v1/keys/kek/wrapkey", "api-key",
+		map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "kid": "dek"})
+	if status != 200 || wrapped["wrapped_key"] == nil {
+		t.Fatal("Wrapping failed", wrapped)
+	}
+
+	status, unwrapped := call(t, s, "POST", "/crypto/v1/keys/kek/unwrapkey", "api-key",
+		map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "obj_type": "AES", "name": "restored", "wrapped_key": wrapped["wrapped_key"].(string)})
+	if status != 200 || unwrapped["name"] != "restored" || unwrapped["key_size"] != float64(256) {
+		t.Error("Unwrapping failed", unwrapped)
+	}
+}
+
+func TestServer_Negative_DisabledKey(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+	s.AddKey("uuid-1", 256)
+	s.UpdateKey("uuid-1", func(key *Key) { key.Enabled = false })
+
+	status, _ := call(t, s, "POST", "/crypto/v1/keys/uuid-1/encrypt", "api-key",
+		map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "plain": "cGxhaW4="})
+	if status != 400 {
+		t.Error("Encryption should fail with a disabled key")
+	}
+}
+
+func TestServer_InjectFailure(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+
+	s.InjectFailure(Failure{StatusCode: 503, Times: 2})
+	for i := 0; i < 2; i++ {
+		if status, _ := call(t, s, "POST", "/sys/v1/session/auth", "api-key", nil); status != 503 {
+			t.Error("Injected failure expected")
+		}
+	}
+	if status, _ := call(t, s, "POST", "/sys/v1/session/auth", "api-key", nil); status != 200 {
+		t.Error("Injected failure should be cleared after 2 requests")
+	}
+
+	s.InjectFailure(Failure{Malformed: true})
+	status, body := call(t, s, "POST", "/sys/v1/session/auth", "api-key", nil)
+	if status != 200 || body != nil {
+		t.Error("Malformed body expected")
+	}
+	s.ClearFailure()
+
+	s.InjectFailure(Failure{Latency: 50 * time.Millisecond, Times: 1})
+	start := time.Now()
+	call(t, s, "POST", "/sys/v1/session/auth", "api-key", nil)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Injected latency expected")
+	}
+}
+
+func TestServer_Batch(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+	s.AddKey("uuid-1", 256)
+
+	data, _ := json.Marshal([]map[string]interface{}{
+		{"kid": "uuid-1", "request": map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "plain": "c2VjcmV0"}},
+		{"kid": "unknown", "request": map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "plain": "c2VjcmV0"}},
+		{"kid": "uuid-1", "request": map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "plain": "not base64"}},
+	})
+	req, _ := http.NewRequest("POST", s.URL+"/crypto/v1/keys/batch/encrypt", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Basic api-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var results []struct {
+		Status int               `json:"status"`
+		Body   map[string]string `json:"body"`
+		Error  string            `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil || len(results) != 3 {
+		t.Fatal("Batch response expected", err)
+	}
+	if results[0].Status != 200 || len(results[0].Body["cipher"]) == 0 {
+		t.Error("First item should be encrypted", results[0])
+	}
+	if results[1].Status != 404 || results[2].Status != 400 || len(results[2].Error) == 0 {
+		t.Error("Item errors should be reported separately", results[1], results[2])
+	}
+	if s.RequestCount("batchencrypt") != 1 || s.RequestCount("encrypt") != 0 {
+		t.Error("Invalid request count")
+	}
+
+	status, response := call(t, s, "POST", "/crypto/v1/keys/uuid-1/decrypt", "api-key",
+		map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "cipher": results[0].Body["cipher"]})
+	if status != 200 || response["plain"] != "c2VjcmV0" {
+		t.Error("Batch cipher should decrypt", response)
+	}
+}
+
+func TestServer_CreateKey(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+
+	status, key := call(t, s, "POST", "/crypto/v1/keys", "api-key",
+		map[string]interface{}{"name": "rotated", "obj_type": "AES", "key_size": 192, "key_ops": []string{"ENCRYPT", "DECRYPT"}})
+	if status != 200 || key["name"] != "rotated" || key["key_size"] != float64(192) || len(key["kid"].(string)) == 0 {
+		t.Fatal("Created key expected", key)
+	}
+
+	status, response := call(t, s, "POST", "/crypto/v1/keys/"+key["kid"].(string)+"/encrypt", "api-key",
+		map[string]string{"alg": "AES", "mode": "CBC", "iv": testIv, "plain": "c2VjcmV0"})
+	if status != 200 || len(response["cipher"].(string)) == 0 {
+		t.Error("Created key should encrypt", response)
+	}
+	if status, _ := call(t, s, "POST", "/crypto/v1/keys/"+key["kid"].(string)+"/wrapkey", "api-key",
+		map[string]string{"alg": "AES", "mode": "CBC", "kid": key["kid"].(string)}); status != 400 {
+		t.Error("Operations not requested should not be permitted")
+	}
+	if status, _ := call(t, s, "POST", "/crypto/v1/keys", "api-key", map[string]interface{}{"obj_type": "RSA", "key_size": 2048}); status != 400 {
+		t.Error("Only AES keys should be created")
+	}
+
+	/* Names are unique and keys can be looked up by name */
+	if status, _ := call(t, s, "POST", "/crypto/v1/keys", "api-key", map[string]interface{}{"name": "rotated", "obj_type": "AES", "key_size": 256}); status != 409 {
+		t.Error("A second key of the same name should be rejected with 409, got", status)
+	}
+	req, _ := http.NewRequest("GET", s.URL+"/crypto/v1/keys?name=rotated", nil)
+	req.Header.Set("Authorization", "Basic api-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var keys []Key
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil || len(keys) != 1 || keys[0].Kid != key["kid"] || s.RequestCount("list") != 1 {
+		t.Error("Key should be listed by name", keys, err)
+	}
+}
+
+func TestServer_Health(t *testing.T) {
+	s := NewServer("api-key")
+	defer s.Close()
+
+	response, err := http.Get(s.URL + "/sys/v1/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent || s.RequestCount("health") != 1 {
+		t.Error("Health check should succeed without authentication", response.Status)
+	}
+
+	s.InjectFailure(Failure{StatusCode: 503})
+	response, err = http.Get(s.URL + "/sys/v1/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 503 {
+		t.Error("Injected failures should apply to health checks", response.Status)
+	}
+}